@@ -4,14 +4,19 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/auth"
 	"github.com/helloellinor/p2k16/internal/database"
 	"github.com/helloellinor/p2k16/internal/handlers"
+	"github.com/helloellinor/p2k16/internal/mail"
 	"github.com/helloellinor/p2k16/internal/middleware"
 	"github.com/helloellinor/p2k16/internal/models"
+	"github.com/helloellinor/p2k16/internal/mqtt"
+	"github.com/helloellinor/p2k16/internal/session"
 )
 
 func main() {
@@ -44,52 +49,154 @@ func main() {
 	toolRepo := models.NewToolRepository(db.DB)
 	eventRepo := models.NewEventRepository(db.DB)
 	membershipRepo := models.NewMembershipRepository(db.DB)
+	apiTokenRepo := models.NewApiTokenRepository(db.DB)
+	sessionRepo := models.NewSessionRepository(db.DB)
+	twoFactorRepo := models.NewTwoFactorRepository(db.DB)
+
+	// Mail configuration - without SMTP_HOST emails are only logged
+	mailer := mail.NewMailer(mail.Config{
+		Host: getEnv("SMTP_HOST", ""),
+		Port: getEnvInt("SMTP_PORT", 25),
+		From: getEnv("MAIL_FROM", "Bitraf <post@bitraf.no>"),
+		// Bcc on welcome emails, same as the legacy MEMBERSHIP_CC setting
+		MembershipCC: getEnv("MEMBERSHIP_CC", ""),
+	})
+
+	// Failed login tracking - per username and per client IP with exponential backoff
+	loginThrottle := auth.NewLoginThrottle(auth.DefaultThrottleConfig())
+	stopThrottleCleanup := loginThrottle.StartCleanup(1 * time.Hour)
+	defer stopThrottleCleanup()
+
+	// Password hashing and policy for new passwords
+	models.PasswordCost = getEnvInt("PASSWORD_BCRYPT_COST", models.PasswordCost)
+	passwordPolicy := auth.DefaultPasswordPolicy()
+	passwordPolicy.MinLength = getEnvInt("PASSWORD_MIN_LENGTH", passwordPolicy.MinLength)
+	passwordPolicy.RejectCommon = getEnv("PASSWORD_REJECT_COMMON", "true") == "true"
+
+	// MQTT configuration for tool locks and doors - without MQTT_HOST commands are only logged
+	mqttClient := mqtt.NewClient(mqtt.Config{
+		Host:       getEnv("MQTT_HOST", ""),
+		Port:       getEnvInt("MQTT_PORT", 1883),
+		Username:   getEnv("MQTT_USERNAME", ""),
+		Password:   getEnv("MQTT_PASSWORD", ""),
+		Prefix:     getEnv("MQTT_PREFIX", "public/p2k16-dev/"),
+		ToolPrefix: getEnv("MQTT_PREFIX_TOOL", "public/p2k16-dev/tool"),
+	})
+	defer mqttClient.Close()
+
+	// Links in emails are built from PUBLIC_URL, the Host header of a request can't be trusted
+	publicURL := getEnv("PUBLIC_URL", "")
+	if publicURL == "" {
+		if gin.Mode() == gin.ReleaseMode {
+			log.Fatalf("PUBLIC_URL must be set in production")
+		}
+		publicURL = "http://localhost:8080"
+	}
+
+	// Open Badges issuer profile, assertions are hosted on PUBLIC_URL
+	handlers.OpenBadgesIssuerName = getEnv("OPEN_BADGES_ISSUER_NAME", handlers.OpenBadgesIssuerName)
+	handlers.OpenBadgesIssuerURL = getEnv("OPEN_BADGES_ISSUER_URL", handlers.OpenBadgesIssuerURL)
+	handlers.OpenBadgesIssuerEmail = getEnv("OPEN_BADGES_ISSUER_EMAIL", handlers.OpenBadgesIssuerEmail)
 
 	// Initialize handlers
-	handler := handlers.NewHandler(accountRepo, circleRepo, badgeRepo, toolRepo, eventRepo, membershipRepo)
+	handler := handlers.NewHandler(accountRepo, circleRepo, badgeRepo, toolRepo, eventRepo, membershipRepo, apiTokenRepo, sessionRepo, twoFactorRepo, mailer, loginThrottle, passwordPolicy, mqttClient, publicURL)
+
+	// Remove expired circle memberships, they stop granting access as soon as they expire
+	stopCircleExpiry := handler.StartCircleMembershipExpiry(15 * time.Minute)
+	defer stopCircleExpiry()
+
+	// Remind members of badges that expire soon
+	reminderDays := getEnvInt("BADGE_REMINDER_DAYS", 30)
+	stopBadgeReminders := handler.StartBadgeExpiryReminders(1*time.Hour, time.Duration(reminderDays)*24*time.Hour, publicURL)
+	defer stopBadgeReminders()
 
 	// Set up Gin router
 	r := gin.New()
 
+	// X-Forwarded-For is only used for the client IP (login lockouts, session list) when the
+	// request comes from one of TRUSTED_PROXIES, by default the peer address is used
+	if err := r.SetTrustedProxies(getEnvList("TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Add middleware
 	r.Use(middleware.Logger())
 	r.Use(middleware.Recovery())
-	r.Use(middleware.CORS())
+	r.Use(middleware.CORS(getEnvList("CORS_ALLOWED_ORIGINS")))
 
 	// Serve static files
 	r.Static("/styles", "./styles")
 
-	// Session middleware
-	sessionSecret := getEnv("SESSION_SECRET", "p2k16-secret-key-change-in-production")
-	store := cookie.NewStore([]byte(sessionSecret))
+	// Session middleware - sessions live in Postgres, the cookie only holds a random key
+	store := session.NewSessionStore(sessionRepo)
+	defer store.Stop()
+	sessionTimeouts := middleware.DefaultSessionTimeouts()
+	sessionTimeouts.Idle = getEnvDuration("SESSION_IDLE_TIMEOUT", sessionTimeouts.Idle)
+	sessionTimeouts.Absolute = getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", sessionTimeouts.Absolute)
 	store.Options(sessions.Options{
-		MaxAge:   86400 * 7, // 7 days
+		MaxAge:   int(sessionTimeouts.Idle.Seconds()), // Extended on activity, see SessionValidationMiddleware
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 	})
+	r.Use(session.ClientIP())
 	r.Use(sessions.Sessions(middleware.SessionName, store))
+	r.Use(middleware.SessionValidationMiddleware(sessionTimeouts))
+	r.Use(middleware.CSRF())
 
 	// Public routes
 	r.GET("/", middleware.OptionalAuth(handler.GetAccountRepo()), handler.Home)
 	r.GET("/login", middleware.OptionalAuth(handler.GetAccountRepo()), handler.Login)
 	r.POST("/logout", handler.Logout)
+	r.GET("/forgot-password", middleware.OptionalAuth(handler.GetAccountRepo()), handler.ForgotPassword)
+	r.GET("/reset-password-form", middleware.OptionalAuth(handler.GetAccountRepo()), handler.ResetPasswordForm)
+	r.POST("/set-new-password", handler.SetNewPassword)
+	r.GET("/register", middleware.OptionalAuth(handler.GetAccountRepo()), handler.Register)
+	r.GET("/badges/:slug", middleware.OptionalAuth(handler.GetAccountRepo()), handler.BadgePage)
+
+	// Open Badges 2.0, fetched by verifiers without logging in
+	r.GET("/badges/assertions/issuer", handler.GetOpenBadgesIssuer)
+	r.GET("/badges/assertions/classes/:id", handler.GetOpenBadgesClass)
+	r.GET("/badges/assertions/:id", handler.GetOpenBadgesAssertion)
+
+	// Admin access - members of the admin circle, optionally only after two-factor authentication
+	adminAccess := []gin.HandlerFunc{middleware.RequireCircle(handler.GetCircleRepo(), middleware.AdminCircle)}
+	if getEnv("REQUIRE_ADMIN_2FA", "false") == "true" {
+		adminAccess = append(adminAccess, middleware.RequireTwoFactor(handler.GetTwoFactorRepo()))
+	}
 
 	// Protected routes
 	protected := r.Group("/")
-	protected.Use(middleware.RequireAuth(handler.GetAccountRepo()))
+	protected.Use(middleware.RequireAuth(handler.GetAccountRepo(), handler.GetApiTokenRepo()))
 	{
 		protected.GET("/dashboard", handler.Dashboard)
 		protected.GET("/profile", handler.Profile)
-		protected.GET("/admin", handler.Admin)
+		protected.GET("/badges/award", handler.AwardBadgePage)
+		protected.GET("/circles", handler.Circles)
+		protected.GET("/circles/:id", handler.Circle)
 
-		// Admin routes
-		protected.GET("/admin/users", handler.AdminUsers)
-		protected.GET("/admin/tools", handler.AdminTools)
-		protected.GET("/admin/companies", handler.AdminCompanies)
-		protected.GET("/admin/circles", handler.AdminCircles)
-		protected.GET("/admin/logs", handler.AdminLogs)
-		protected.GET("/admin/config", handler.AdminConfig)
+		// Admin routes - members of the admin circle only
+		admin := protected.Group("/admin")
+		admin.Use(adminAccess...)
+		{
+			admin.GET("", handler.Admin)
+			admin.GET("/users", handler.AdminUsers)
+			admin.GET("/tools", handler.AdminTools)
+			admin.GET("/companies", handler.AdminCompanies)
+			admin.GET("/circles", handler.AdminCircles)
+			admin.POST("/circles", handler.CreateCircle)
+			admin.GET("/circles/:id", handler.AdminCircle)
+			admin.GET("/circles/:id/edit", handler.EditCircleForm)
+			admin.POST("/circles/:id", handler.UpdateCircle)
+			admin.DELETE("/circles/:id", handler.DeleteCircle)
+			admin.GET("/badges", handler.AdminBadges)
+			admin.POST("/badges/:id/circles", handler.UpdateBadgeCircles)
+			admin.GET("/badges/:id/edit", handler.EditBadgePage)
+			admin.GET("/logs", handler.AdminLogs)
+			admin.GET("/config", handler.AdminConfig)
+			admin.GET("/lockouts", handler.AdminLockouts)
+			admin.POST("/lockouts/unlock", handler.UnlockLogin)
+		}
 
 		// Profile management endpoints
 		protected.POST("/profile/change-password", handler.ChangePassword)
@@ -101,15 +208,34 @@ func main() {
 	api := r.Group("/api")
 	{
 		api.GET("/members/active", handler.GetActiveMembers)
+		api.GET("/memberinfo", handler.MemberInfo) // HTTP Basic auth, "api" circle only
 		api.POST("/auth/login", handler.AuthLogin)
+		api.POST("/auth/2fa", handler.AuthTwoFactor)
+		api.POST("/auth/start-reset-password", handler.StartResetPassword)
+		api.POST("/auth/register", handler.RegisterAccount)
+		api.GET("/auth/check-username", handler.CheckUsername)
+		api.GET("/auth/check-email", handler.CheckEmail)
 
 		// Protected API routes
 		apiProtected := api.Group("/")
-		apiProtected.Use(middleware.RequireAuth(handler.GetAccountRepo()))
+		apiProtected.Use(middleware.RequireAuth(handler.GetAccountRepo(), handler.GetApiTokenRepo()))
 		{
-			// Account management endpoints
-			apiProtected.GET("/accounts", handler.GetAccounts)
-			apiProtected.GET("/accounts/:id", handler.GetAccount)
+			// Account management endpoints - admin circle only
+			accounts := apiProtected.Group("/accounts")
+			accounts.Use(adminAccess...)
+			{
+				accounts.GET("", handler.GetAccounts)
+				accounts.GET("/:id", handler.GetAccount)
+				accounts.POST("/:id/sessions/revoke", handler.RevokeAccountSessions)
+			}
+
+			// Circle rosters and membership, allowed for those who can administer the circle
+			apiProtected.GET("/circles/:id", handler.GetCircle)
+			apiProtected.POST("/circles/:id/members", handler.AddCircleMember)
+			apiProtected.DELETE("/circles/:id/members/:account", handler.RemoveCircleMember)
+			apiProtected.POST("/circles/:id/requests", handler.RequestCircleMembership)
+			apiProtected.POST("/circles/:id/requests/:request/approve", handler.ApproveCircleMembershipRequest)
+			apiProtected.POST("/circles/:id/requests/:request/reject", handler.RejectCircleMembershipRequest)
 
 			// Badge management endpoints
 			apiProtected.GET("/badges", handler.GetBadges)
@@ -117,6 +243,16 @@ func main() {
 			apiProtected.GET("/badges/available", handler.GetAvailableBadges)
 			apiProtected.POST("/badges/create", handler.CreateBadge)
 			apiProtected.POST("/badges/award", handler.AwardBadge)
+			apiProtected.POST("/badges/award-member", handler.AwardBadgeToMember)
+			apiProtected.POST("/badges/revoke", handler.RevokeBadge)
+			apiProtected.POST("/badges/renew", handler.RenewBadge)
+
+			// Badge descriptions are edited by the admin circle
+			badgesAdmin := apiProtected.Group("/badges")
+			badgesAdmin.Use(adminAccess...)
+			{
+				badgesAdmin.PUT("/:id", handler.UpdateBadge)
+			}
 
 			// Membership endpoints
 			apiProtected.GET("/memberships", handler.GetMembershipStatusAPI)
@@ -132,6 +268,27 @@ func main() {
 			// Profile card flip endpoints for HTMX
 			apiProtected.GET("/profile/card/front", handler.ProfileCardFront)
 			apiProtected.GET("/profile/card/back", handler.ProfileCardBack)
+
+			// Personal API tokens
+			apiProtected.GET("/profile/tokens", handler.GetApiTokens)
+			apiProtected.POST("/profile/tokens", handler.CreateApiToken)
+			apiProtected.DELETE("/profile/tokens/:id", handler.RevokeApiToken)
+
+			// Two-factor authentication
+			apiProtected.GET("/profile/2fa", handler.GetTwoFactor)
+			apiProtected.POST("/profile/2fa/setup", handler.SetupTwoFactor)
+			apiProtected.POST("/profile/2fa/confirm", handler.ConfirmTwoFactor)
+			apiProtected.POST("/profile/2fa/recovery-codes", handler.RegenerateRecoveryCodes)
+			apiProtected.POST("/profile/2fa/disable", handler.DisableTwoFactor)
+
+			// Active login sessions
+			apiProtected.GET("/profile/sessions", handler.GetSessions)
+			apiProtected.POST("/profile/sessions/revoke-others", handler.RevokeOtherSessions)
+			apiProtected.DELETE("/profile/sessions/:id", handler.RevokeSession)
+
+			// Publishing badges as Open Badges
+			apiProtected.GET("/profile/open-badges", handler.GetOpenBadges)
+			apiProtected.POST("/profile/open-badges", handler.SetOpenBadges)
 		}
 	}
 
@@ -162,3 +319,24 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvDuration reads a duration such as "30m" or "12h" from the environment
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList reads a comma separated list from the environment
+func getEnvList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/helloellinor/p2k16/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// CompareDummyPassword spends the same time as checking a real password. Used when a
+// username does not exist so response times don't reveal which accounts are registered.
+func CompareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		// Same cost as real hashes, so the comparison takes as long
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("p2k16-dummy-password"), models.PasswordCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
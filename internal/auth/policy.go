@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strings"
+)
+
+// commonPasswordList is bundled so the check works offline
+//
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var commonPasswords = parseCommonPasswords(commonPasswordList)
+
+// bcryptMaxLength is the number of bytes bcrypt looks at, anything after is ignored
+const bcryptMaxLength = 72
+
+// PasswordPolicy decides which new passwords are accepted, for registration, change and reset
+type PasswordPolicy struct {
+	MinLength      int
+	RejectCommon   bool // Refuse passwords from the bundled common password list
+	RejectUsername bool // Refuse the username (in any case) as password
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      8,
+		RejectCommon:   true,
+		RejectUsername: true,
+	}
+}
+
+// Validate checks a new password for the given username, returning a user facing message if refused
+func (p PasswordPolicy) Validate(password, username string) string {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters long", p.MinLength)
+	}
+	// bcrypt's limit is in bytes, not characters
+	if len(password) > bcryptMaxLength {
+		return fmt.Sprintf("Password cannot be longer than %d bytes, letters like æ, ø and å count as two", bcryptMaxLength)
+	}
+	if p.RejectUsername && username != "" && strings.EqualFold(strings.TrimSpace(password), strings.TrimSpace(username)) {
+		return "Password cannot be the same as your username"
+	}
+	if p.RejectCommon && IsCommonPassword(password) {
+		return "This password is too common, please choose another one"
+	}
+	return ""
+}
+
+// IsCommonPassword reports whether the password is on the bundled list, ignoring case
+func IsCommonPassword(password string) bool {
+	return commonPasswords[strings.ToLower(strings.TrimSpace(password))]
+}
+
+func parseCommonPasswords(list string) map[string]bool {
+	passwords := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = true
+	}
+	return passwords
+}
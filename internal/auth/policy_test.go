@@ -0,0 +1,44 @@
+package auth
+
+import "testing"
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	cases := []struct {
+		password string
+		username string
+		valid    bool
+	}{
+		{"short", "alice", false},
+		{"Password123", "alice", false},
+		{"BITRAF123", "alice", false},
+		{"alice-the-maker", "alice-the-maker", false},
+		{"Alice-The-Maker", "alice-the-maker", false},
+		{"correct horse battery staple", "alice", true},
+		{"laser-cutter-2000", "alice", true},
+		{string(make([]byte, 73)), "alice", false},
+	}
+	for _, tc := range cases {
+		msg := policy.Validate(tc.password, tc.username)
+		if (msg == "") != tc.valid {
+			t.Errorf("Validate(%q, %q) = %q, expected valid=%v", tc.password, tc.username, msg, tc.valid)
+		}
+	}
+}
+
+func TestPasswordPolicyOptions(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 6}
+	if msg := policy.Validate("qwerty", "qwerty"); msg != "" {
+		t.Errorf("Expected common and username checks to be off, got %q", msg)
+	}
+}
+
+func TestCommonPasswordListLoaded(t *testing.T) {
+	if len(commonPasswords) < 100 {
+		t.Errorf("Expected the bundled list to be loaded, got %d entries", len(commonPasswords))
+	}
+	if commonPasswords["# common and breached passwords refused by the password policy, checked case-insensitively."] {
+		t.Error("Comment lines should be skipped")
+	}
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig controls when failed logins start to be delayed
+type ThrottleConfig struct {
+	AccountFreeAttempts int           // Failures per username before lockouts start
+	IPFreeAttempts      int           // Failures per client IP before lockouts start, higher since members share the space's IP
+	BaseLockout         time.Duration // First lockout, doubled for every further failure
+	MaxLockout          time.Duration // Upper bound for a single lockout
+	ResetAfter          time.Duration // Failures are forgotten after this long without new ones
+}
+
+// DefaultThrottleConfig returns the settings used by the server
+func DefaultThrottleConfig() ThrottleConfig {
+	return ThrottleConfig{
+		AccountFreeAttempts: 5,
+		IPFreeAttempts:      20,
+		BaseLockout:         30 * time.Second,
+		MaxLockout:          1 * time.Hour,
+		ResetAfter:          24 * time.Hour,
+	}
+}
+
+// Lockout describes a username or client IP that is currently locked out
+type Lockout struct {
+	Kind        string    `json:"kind"` // "account" or "ip"
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginThrottle tracks failed logins per username and per client IP and applies
+// exponential backoff. Usernames are tracked whether or not the account exists,
+// so lockouts do not reveal which usernames are registered.
+type LoginThrottle struct {
+	mu       sync.Mutex
+	config   ThrottleConfig
+	accounts map[string]*attempts
+	ips      map[string]*attempts
+	now      func() time.Time
+}
+
+// NewLoginThrottle creates a new login throttle
+func NewLoginThrottle(config ThrottleConfig) *LoginThrottle {
+	return &LoginThrottle{
+		config:   config,
+		accounts: make(map[string]*attempts),
+		ips:      make(map[string]*attempts),
+		now:      time.Now,
+	}
+}
+
+// Check returns how long the caller has to wait before a login for username from ip is allowed
+func (t *LoginThrottle) Check(username, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	wait := t.remaining(t.accounts[normalizeUsername(username)], now)
+	if ipWait := t.remaining(t.ips[ip], now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// RecordFailure registers a failed login and returns the lockout it caused, zero if none
+func (t *LoginThrottle) RecordFailure(username, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	lockout := t.fail(t.accounts, normalizeUsername(username), t.config.AccountFreeAttempts, now)
+	if ipLockout := t.fail(t.ips, ip, t.config.IPFreeAttempts, now); ipLockout > lockout {
+		lockout = ipLockout
+	}
+	return lockout
+}
+
+// RecordSuccess clears the failures for a username. The IP counter is kept so a
+// valid account can't be used to reset guessing from the same address.
+func (t *LoginThrottle) RecordSuccess(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.accounts, normalizeUsername(username))
+}
+
+// Unlock clears failures and any lockout for a username
+func (t *LoginThrottle) Unlock(username string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := normalizeUsername(username)
+	_, exists := t.accounts[key]
+	delete(t.accounts, key)
+	return exists
+}
+
+// UnlockIP clears failures and any lockout for a client IP
+func (t *LoginThrottle) UnlockIP(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, exists := t.ips[ip]
+	delete(t.ips, ip)
+	return exists
+}
+
+// Lockouts lists the usernames and IPs that are currently locked out
+func (t *LoginThrottle) Lockouts() []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var lockouts []Lockout
+	collect := func(kind string, entries map[string]*attempts) {
+		for key, a := range entries {
+			if a.lockedUntil.After(now) {
+				lockouts = append(lockouts, Lockout{
+					Kind:        kind,
+					Key:         key,
+					Failures:    a.failures,
+					LastFailure: a.lastFailure,
+					LockedUntil: a.lockedUntil,
+				})
+			}
+		}
+	}
+	collect("account", t.accounts)
+	collect("ip", t.ips)
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+	})
+	return lockouts
+}
+
+// CleanupExpired forgets failures older than ResetAfter
+func (t *LoginThrottle) CleanupExpired() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	count := 0
+	for _, entries := range []map[string]*attempts{t.accounts, t.ips} {
+		for key, a := range entries {
+			if t.expired(a, now) {
+				delete(entries, key)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// StartCleanup runs CleanupExpired periodically until the returned stop function is called
+func (t *LoginThrottle) StartCleanup(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stopCh := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				t.CleanupExpired()
+			case <-stopCh:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(stopCh) }
+}
+
+func (t *LoginThrottle) fail(entries map[string]*attempts, key string, freeAttempts int, now time.Time) time.Duration {
+	a := entries[key]
+	if a == nil || t.expired(a, now) {
+		a = &attempts{}
+		entries[key] = a
+	}
+
+	a.failures++
+	a.lastFailure = now
+
+	if a.failures <= freeAttempts {
+		return 0
+	}
+
+	// 30s, 1m, 2m, 4m, ... up to MaxLockout
+	lockout := t.config.BaseLockout
+	for i := freeAttempts + 1; i < a.failures && lockout < t.config.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > t.config.MaxLockout {
+		lockout = t.config.MaxLockout
+	}
+
+	a.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (t *LoginThrottle) remaining(a *attempts, now time.Time) time.Duration {
+	if a == nil || !a.lockedUntil.After(now) {
+		return 0
+	}
+	return a.lockedUntil.Sub(now)
+}
+
+func (t *LoginThrottle) expired(a *attempts, now time.Time) bool {
+	return now.Sub(a.lastFailure) > t.config.ResetAfter && !a.lockedUntil.After(now)
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestThrottle() (*LoginThrottle, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle := NewLoginThrottle(DefaultThrottleConfig())
+	throttle.now = func() time.Time { return now }
+	return throttle, &now
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle, _ := newTestThrottle()
+
+	for i := 0; i < 5; i++ {
+		if lockout := throttle.RecordFailure("Alice", "10.0.0.1"); lockout != 0 {
+			t.Fatalf("Expected no lockout on failure %d, got %s", i+1, lockout)
+		}
+	}
+
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for _, want := range expected {
+		if lockout := throttle.RecordFailure("alice", "10.0.0.1"); lockout != want {
+			t.Errorf("Expected lockout %s, got %s", want, lockout)
+		}
+	}
+
+	if wait := throttle.Check("ALICE", "10.0.0.2"); wait != 4*time.Minute {
+		t.Errorf("Expected username lockout to apply from any IP, got %s", wait)
+	}
+	if wait := throttle.Check("bob", "10.0.0.1"); wait != 0 {
+		t.Errorf("Expected IP below its limit not to be locked, got %s", wait)
+	}
+}
+
+func TestLoginThrottleMaxLockout(t *testing.T) {
+	throttle, _ := newTestThrottle()
+
+	var lockout time.Duration
+	for i := 0; i < 30; i++ {
+		lockout = throttle.RecordFailure("alice", "10.0.0.1")
+	}
+	if lockout != time.Hour {
+		t.Errorf("Expected lockout capped at 1h, got %s", lockout)
+	}
+}
+
+func TestLoginThrottleIPLockout(t *testing.T) {
+	throttle, _ := newTestThrottle()
+
+	// Spread over many usernames so only the IP limit is hit
+	for i := 0; i < 21; i++ {
+		throttle.RecordFailure(string(rune('a'+i)), "10.0.0.1")
+	}
+	if wait := throttle.Check("someone-else", "10.0.0.1"); wait == 0 {
+		t.Error("Expected IP to be locked out")
+	}
+
+	if !throttle.UnlockIP("10.0.0.1") {
+		t.Error("Expected UnlockIP to find the IP")
+	}
+	if wait := throttle.Check("someone-else", "10.0.0.1"); wait != 0 {
+		t.Errorf("Expected IP to be unlocked, got %s", wait)
+	}
+}
+
+func TestLoginThrottleUnlockAndExpiry(t *testing.T) {
+	throttle, now := newTestThrottle()
+
+	for i := 0; i < 6; i++ {
+		throttle.RecordFailure("alice", "10.0.0.1")
+	}
+	if len(throttle.Lockouts()) != 1 {
+		t.Fatalf("Expected one lockout, got %v", throttle.Lockouts())
+	}
+
+	*now = now.Add(31 * time.Second)
+	if wait := throttle.Check("alice", "10.0.0.1"); wait != 0 {
+		t.Errorf("Expected lockout to have passed, got %s", wait)
+	}
+
+	// Failures are remembered until ResetAfter, so the next one locks again right away
+	if lockout := throttle.RecordFailure("alice", "10.0.0.1"); lockout != time.Minute {
+		t.Errorf("Expected 1m lockout, got %s", lockout)
+	}
+	if !throttle.Unlock("Alice") {
+		t.Error("Expected Unlock to find the username")
+	}
+	if wait := throttle.Check("alice", "10.0.0.1"); wait != 0 {
+		t.Errorf("Expected username to be unlocked, got %s", wait)
+	}
+
+	*now = now.Add(25 * time.Hour)
+	if removed := throttle.CleanupExpired(); removed != 1 {
+		t.Errorf("Expected the IP entry to be cleaned up, removed %d", removed)
+	}
+}
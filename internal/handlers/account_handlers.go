@@ -268,6 +268,9 @@ func (h *Handler) GetAccount(c *gin.Context) {
 					<dt class="col-sm-3">Created:</dt>
 					<dd class="col-sm-9">` + account.CreatedAt.Format("2006-01-02 15:04:05") + `</dd>
 				</dl>
+				<button class="btn btn-sm btn-outline-danger" hx-post="/api/accounts/` + fmt.Sprintf("%d", account.ID) + `/sessions/revoke"
+					hx-target="#account-sessions-result" hx-confirm="Log this user out of all sessions?">Log out everywhere</button>
+				<div id="account-sessions-result" class="mt-2"></div>
 			</div>
 		</div>`
 		
@@ -23,7 +23,7 @@ func (h *Handler) Admin(c *gin.Context) {
 	<main>
 		<div>
 			<h1>Admin Console</h1>
-			<p>Workspace for privileged tasks: manage users, tools, companies, circles, logs, and configuration.</p>
+			<p>Workspace for privileged tasks: manage users, tools, companies, circles, badges, logs, login lockouts, and configuration.</p>
 		</div>
 		<section>
 			<nav aria-label="Admin sections">
@@ -32,7 +32,9 @@ func (h *Handler) Admin(c *gin.Context) {
 					<li><a href="/admin/tools">Tools</a></li>
 					<li><a href="/admin/companies">Companies</a></li>
 					<li><a href="/admin/circles">Circles</a></li>
+					<li><a href="/admin/badges">Badges</a></li>
 					<li><a href="/admin/logs">Logs</a></li>
+					<li><a href="/admin/lockouts">Login lockouts</a></li>
 					<li><a href="/admin/config">Config</a></li>
 				</ul>
 			</nav>
@@ -129,27 +131,6 @@ func (h *Handler) AdminCompanies(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
 }
 
-// AdminCircles shows the circles admin page
-func (h *Handler) AdminCircles(c *gin.Context) {
-	html := `
-<!DOCTYPE html>
-<html>
-<head>
-	<title>Admin / Circles - P2K16</title>
-	<meta name="viewport" content="width=device-width, initial-scale=1">
-	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
-</head>
-<body>
-	` + h.renderNavbarWithTrail(c, "Admin / Circles") + `
-	<main>
-		<h1>Circles</h1>
-		<p>Manage user groups and permissions.</p>
-	</main>
-</body>
-</html>`
-	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
-}
-
 // AdminLogs shows the logs admin page
 func (h *Handler) AdminLogs(c *gin.Context) {
 	html := `
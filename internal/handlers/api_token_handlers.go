@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+)
+
+// GetApiTokens returns the API tokens section of the profile card (requires auth)
+func (h *Handler) GetApiTokens(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderApiTokensSectionHTML(user.ID, "")))
+}
+
+// CreateApiToken mints a named token and shows it once
+func (h *Handler) CreateApiToken(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	name := strings.TrimSpace(c.PostForm("name"))
+
+	// A leaked token must not be usable to mint more tokens
+	if middleware.IsTokenAuthenticated(c) {
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "message": "API tokens can only be created from a logged in session"})
+		return
+	}
+
+	if name == "" || len(name) > 100 {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Token name is required (max 100 characters)</p>`))
+		return
+	}
+
+	token, apiToken, err := h.apiTokenRepo.Create(user.ID, name)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to create API token for user %d: %v", user.ID, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to create token</p>`))
+		return
+	}
+
+	logging.LogSuccess("API TOKEN", fmt.Sprintf("Token '%s' (%d) created by %s", apiToken.Name, apiToken.ID, user.Username))
+
+	notice := `<section aria-live="polite">
+		<p>Token "` + escapeHTML(apiToken.Name) + `" created. Copy it now, it will not be shown again:</p>
+		<pre><code>` + token + `</code></pre>
+		<p>Use it as <code>Authorization: Bearer &lt;token&gt;</code>.</p>
+	</section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderApiTokensSectionHTML(user.ID, notice)))
+}
+
+// RevokeApiToken deletes one of the current user's tokens
+func (h *Handler) RevokeApiToken(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	tokenID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid token id</p>`))
+		return
+	}
+
+	if err := h.apiTokenRepo.Revoke(tokenID, user.ID); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to revoke API token %d: %v", tokenID, err))
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to revoke token</p>`))
+		return
+	}
+
+	logging.LogSuccess("API TOKEN", fmt.Sprintf("Token %d revoked by %s", tokenID, user.Username))
+	notice := `<section aria-live="polite"><p>Token revoked.</p></section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderApiTokensSectionHTML(user.ID, notice)))
+}
+
+// renderApiTokensSectionHTML lists the user's API tokens with a form to create new ones
+func (h *Handler) renderApiTokensSectionHTML(accountID int, notice string) string {
+	tokens, _ := h.apiTokenRepo.GetForAccount(accountID)
+
+	html := `
+<section id="api-tokens" aria-labelledby="api-tokens-title">
+	<header><h2 id="api-tokens-title">API Tokens</h2></header>
+	<p>Tokens let scripts use the API on your behalf. Treat them like passwords.</p>` + notice
+
+	if len(tokens) == 0 {
+		html += `
+	<p>No tokens yet.</p>`
+	} else {
+		html += `
+	<ul>`
+		for _, token := range tokens {
+			lastUsed := "never used"
+			if token.LastUsedAt.Valid {
+				lastUsed = "last used " + token.LastUsedAt.Time.Format("2006-01-02 15:04")
+			}
+			html += `
+		<li>
+			<span>` + escapeHTML(token.Name) + `</span>
+			<span>(created ` + token.CreatedAt.Format("2006-01-02") + `, ` + lastUsed + `)</span>
+			<button
+				hx-delete="/api/profile/tokens/` + strconv.Itoa(token.ID) + `"
+				hx-target="#api-tokens"
+				hx-swap="outerHTML"
+				hx-confirm="Revoke this token? Scripts using it will stop working.">Revoke</button>
+		</li>`
+		}
+		html += `
+	</ul>`
+	}
+
+	html += `
+	<form hx-post="/api/profile/tokens" hx-target="#api-tokens" hx-swap="outerHTML">
+		<div>
+			<label for="token-name">Token name</label>
+			<input type="text" id="token-name" name="name" placeholder="e.g. door dashboard" maxlength="100" required>
+		</div>
+		<button type="submit">Create Token</button>
+	</form>
+</section>`
+	return html
+}
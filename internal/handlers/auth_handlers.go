@@ -1,12 +1,18 @@
 package handlers
 
 import (
+	"database/sql"
 	"fmt"
+	"html/template"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/auth"
 	"github.com/helloellinor/p2k16/internal/logging"
 	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
 )
 
 // AuthLogin handles login form submission
@@ -14,8 +20,9 @@ func (h *Handler) AuthLogin(c *gin.Context) {
 	logging.LogHandlerAction("API REQUEST", "Login attempt received")
 	username := c.PostForm("username")
 	password := c.PostForm("password")
+	clientIP := c.ClientIP()
 
-	logging.LogHandlerAction("LOGIN ATTEMPT", fmt.Sprintf("Username: %s", username))
+	logging.LogHandlerAction("LOGIN ATTEMPT", fmt.Sprintf("Username: %s, IP: %s", username, clientIP))
 
 	if username == "" || password == "" {
 		logging.LogError("LOGIN FAILED", "Missing username or password")
@@ -24,23 +31,58 @@ func (h *Handler) AuthLogin(c *gin.Context) {
 		return
 	}
 
+	// Lockouts are tracked per username whether or not it exists, so this doesn't reveal accounts
+	if wait := h.loginThrottle.Check(username, clientIP); wait > 0 {
+		logging.LogWarning("LOGIN THROTTLED", fmt.Sprintf("Username '%s' / IP %s locked for %s", username, clientIP, wait.Round(time.Second)))
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.Data(http.StatusTooManyRequests, "text/html; charset=utf-8",
+			[]byte(`<p>Too many failed login attempts. Please try again in `+formatWait(wait)+`.</p>`))
+		return
+	}
+
 	// Database authentication
 	account, err := h.accountRepo.FindByUsername(username)
 	if err != nil {
 		logging.LogError("LOGIN FAILED", fmt.Sprintf("User '%s' not found in database: %v", username, err))
-		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
-			[]byte(`<p>Invalid username or password</p>`))
+		// Spend as long as a real password check so timing doesn't reveal unknown usernames
+		auth.CompareDummyPassword(password)
+		h.loginFailed(c, username, clientIP, nil)
 		return
 	}
 
 	logging.LogHandlerAction("USER FOUND", fmt.Sprintf("User '%s' found in database, validating password", username))
 	if !account.ValidatePassword(password) {
 		logging.LogError("LOGIN FAILED", fmt.Sprintf("Invalid password for user '%s'", username))
-		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
-			[]byte(`<p>Invalid username or password</p>`))
+		h.loginFailed(c, username, clientIP, account)
+		return
+	}
+
+	// Hashes from the Python app or an older configuration are upgraded while the password is at hand
+	if account.NeedsRehash() {
+		h.upgradePasswordHash(account, password)
+	}
+
+	// Accounts with two-factor authentication need a code before they are logged in
+	twoFactor, err := h.twoFactorRepo.IsEnabled(account.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check two-factor status for %s: %v", username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to login. Please try again.</p>`))
+		return
+	}
+	if twoFactor {
+		if err := middleware.StartTwoFactorLogin(c, account); err != nil {
+			logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to start two-factor login for %s: %v", username, err))
+			c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+				[]byte(`<p>Failed to login. Please try again.</p>`))
+			return
+		}
+		logging.LogHandlerAction("LOGIN 2FA", fmt.Sprintf("Password accepted for %s, waiting for second factor", username))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(renderTwoFactorLoginHTML(c.PostForm("next"))))
 		return
 	}
 
+	h.loginThrottle.RecordSuccess(username)
 	logging.LogSuccess("LOGIN SUCCESS", fmt.Sprintf("User authenticated: %s", username))
 
 	// Login user by setting session
@@ -51,29 +93,113 @@ func (h *Handler) AuthLogin(c *gin.Context) {
 		return
 	}
 
-	// Successful login - redirect via HTMX
+	loginSucceeded(c, account)
+}
+
+// upgradePasswordHash stores a new hash with the configured cost. Failing is not fatal,
+// the old hash still works and the upgrade is tried again on the next login.
+func (h *Handler) upgradePasswordHash(account *models.Account, password string) {
+	hashed, err := models.HashPassword(password)
+	if err == nil {
+		err = h.accountRepo.UpdatePasswordHash(account.ID, hashed)
+	}
+	if err != nil {
+		logging.LogError("PASSWORD REHASH", fmt.Sprintf("Failed to upgrade password hash for %s: %v", account.Username, err))
+		return
+	}
+	account.Password = hashed
+	logging.LogInfo("PASSWORD REHASH", fmt.Sprintf("Upgraded password hash for %s to cost %d", account.Username, models.PasswordCost))
+}
+
+// loginSucceeded redirects via HTMX, back to the page that asked for the login if any
+func loginSucceeded(c *gin.Context, account *models.Account) {
+	next := middleware.SafeRedirectPath(c.PostForm("next"))
 	html := `
 		<section aria-live="polite">
 			<p>Login successful! Welcome, ` + account.Username + `</p>
 		</section>
 		<script>
-			window.location.href = '/';
+			window.location.href = '` + template.JSEscapeString(next) + `';
 		</script>`
 
-	logging.LogSuccess("SESSION CREATED", fmt.Sprintf("Session created for user: %s", username))
+	logging.LogSuccess("SESSION CREATED", fmt.Sprintf("Session created for user: %s", account.Username))
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
 }
 
+// loginFailed records a failed attempt and answers with the same response for
+// unknown usernames and wrong passwords. account is nil for unknown usernames.
+func (h *Handler) loginFailed(c *gin.Context, username, clientIP string, account *models.Account) {
+	h.recordLoginFailure(username, clientIP, account)
+
+	c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
+		[]byte(`<p>Invalid username or password</p>`))
+}
+
+// recordLoginFailure counts a failed attempt towards the lockouts, account is nil for unknown usernames
+func (h *Handler) recordLoginFailure(username, clientIP string, account *models.Account) {
+	lockout := h.loginThrottle.RecordFailure(username, clientIP)
+
+	// Events need an account to be created by, so attempts on unknown usernames are only logged
+	if account != nil {
+		h.logAuthEvent("login-failed", account.ID, clientIP, 0)
+		if lockout > 0 {
+			h.logAuthEvent("login-locked", account.ID, clientIP, int(lockout.Seconds()))
+		}
+	}
+	if lockout > 0 {
+		logging.LogWarning("LOGIN LOCKOUT", fmt.Sprintf("Username '%s' / IP %s locked for %s", username, clientIP, lockout))
+	}
+}
+
+// logAuthEvent stores an event in the "auth" domain
+func (h *Handler) logAuthEvent(key string, accountID int, text string, number int) {
+	h.logEvent("auth", key, accountID, text, number)
+}
+
+// logEvent stores an event created by accountID. Failures are logged, not returned,
+// the action the event records has already happened.
+func (h *Handler) logEvent(domain, key string, accountID int, text string, number int) {
+	event := &models.Event{
+		Domain:    domain,
+		Key:       key,
+		Text1:     sql.NullString{String: text, Valid: text != ""},
+		Int1:      sql.NullInt64{Int64: int64(number), Valid: number != 0},
+		CreatedBy: sql.NullInt64{Int64: int64(accountID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log %s/%s event: %v", domain, key, err))
+	}
+}
+
+// formatWait renders a lockout duration for users
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		return fmt.Sprintf("%d seconds", int(wait.Seconds())+1)
+	}
+	return fmt.Sprintf("%d minutes", int(wait.Minutes())+1)
+}
+
 // Login handles user authentication page
 func (h *Handler) Login(c *gin.Context) {
 	logging.LogHandlerAction("PAGE REQUEST", "Login page visited")
 	// If already logged in, redirect to home
 	if middleware.IsAuthenticated(c) {
-		logging.LogHandlerAction("LOGIN REDIRECT", "User already authenticated, redirecting to home")
-		c.Redirect(http.StatusFound, "/")
+		logging.LogHandlerAction("LOGIN REDIRECT", "User already authenticated, redirecting")
+		c.Redirect(http.StatusFound, middleware.SafeRedirectPath(c.Query("next")))
 		return
 	}
 
+	// Messages passed along by redirects, same keys as the legacy login page
+	message := ""
+	switch c.Query("show_message") {
+	case "recovery-invalid-request":
+		message = `<div class="alert alert-info">The URL you had is not valid anymore.</div>`
+	case "password-reset":
+		message = `<div class="alert alert-success">Your password has been changed. You can now log in.</div>`
+	case "session-expired":
+		message = `<div class="alert alert-info">Your session has expired. Please log in again.</div>`
+	}
+
 	html := `
 <!DOCTYPE html>
 <html>
@@ -94,7 +220,10 @@ func (h *Handler) Login(c *gin.Context) {
 						<h2 class="card-title mb-0">Login to P2K16</h2>
 					</div>
 					<div class="card-body">
+						` + message + `
+						<div id="login-form">
 						<form hx-post="/api/auth/login" hx-target="#login-result" method="post" action="/api/auth/login">
+							` + csrfFieldHTML(c) + `
 							<div class="mb-3">
 								<label for="username" class="form-label">Username</label>
 								<input type="text" class="form-control" id="username" name="username" required>
@@ -103,11 +232,15 @@ func (h *Handler) Login(c *gin.Context) {
 								<label for="password" class="form-label">Password</label>
 								<input type="password" class="form-control" id="password" name="password" required>
 							</div>
+							<input type="hidden" name="next" value="` + escapeHTML(middleware.SafeRedirectPath(c.Query("next"))) + `">
 							<div class="d-grid">
 								<button type="submit" class="btn btn-primary">Login</button>
 							</div>
 						</form>
+						</div>
 						<div id="login-result" class="mt-3"></div>
+						<p class="mt-3 mb-0"><a href="/forgot-password">Forgot your password?</a></p>
+						<p class="mb-0">New to Bitraf? <a href="/register">Create an account</a></p>
 					</div>
 				</div>
 			</div>
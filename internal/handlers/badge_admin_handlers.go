@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// AdminBadges shows the badges admin page, where badges are set up to grant circle memberships
+func (h *Handler) AdminBadges(c *gin.Context) {
+	descriptions, err := h.badgeRepo.GetAllDescriptions()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badges: %v", err))
+	}
+	circles, err := h.circleRepo.GetAll()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles: %v", err))
+	}
+
+	list := `<p>There are no badges.</p>`
+	if len(descriptions) > 0 {
+		list = ""
+		for i := range descriptions {
+			list += h.renderBadgeGrantsHTML(&descriptions[i], circles, "")
+		}
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Admin / Badges - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Admin / Badges") + `
+	<main>
+		<h1>Badges</h1>
+		<p>Members awarded a badge are added to the circles it grants, and removed again when the badge is revoked or expires.
+		Changing the circles only affects badges awarded afterwards.</p>
+		` + list + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// UpdateBadgeCircles replaces the circles a badge grants
+func (h *Handler) UpdateBadgeCircles(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	desc, ok := h.badgeParam(c)
+	if !ok {
+		return
+	}
+
+	var circleIDs []int
+	for _, value := range c.PostFormArray("circle_id") {
+		circleID, err := strconv.Atoi(value)
+		if err != nil {
+			c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+				[]byte(`<p>Invalid circle id</p>`))
+			return
+		}
+		circleIDs = append(circleIDs, circleID)
+	}
+
+	circles, err := h.circleRepo.GetAll()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles: %v", err))
+	}
+
+	notice := "Saved."
+	if err := h.badgeRepo.SetGrantedCircles(desc.ID, circleIDs, user.ID); errors.Is(err, models.ErrGrantsNeedCertification) {
+		notice = "Can't save the circles: " + err.Error() + "."
+	} else if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to update circles granted by badge %d: %v", desc.ID, err))
+		notice = "Failed to save the circles."
+	} else {
+		logging.LogSuccess("BADGE", fmt.Sprintf("Circles granted by '%s' set to %v by %s", desc.Title, circleIDs, user.Username))
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderBadgeGrantsHTML(desc, circles,
+		`<section aria-live="polite"><p>`+escapeHTML(notice)+`</p></section>`)))
+}
+
+// renderBadgeGrantsHTML shows one badge with the circles it grants, as a form to change them
+func (h *Handler) renderBadgeGrantsHTML(desc *models.BadgeDescription, circles []models.Circle, notice string) string {
+	granted, err := h.badgeRepo.GetGrantedCircles(desc.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles granted by badge %d: %v", desc.ID, err))
+	}
+	grants := make(map[int]bool)
+	for _, circle := range granted {
+		grants[circle.ID] = true
+	}
+
+	certification := "Anyone can award this badge, so it can't grant circles before it gets a certification circle."
+	for _, circle := range circles {
+		if desc.CertificationCircleID.Valid && int64(circle.ID) == desc.CertificationCircleID.Int64 {
+			certification = "Awarded by members of " + escapeHTML(circle.Name) + "."
+		}
+	}
+
+	id := strconv.Itoa(desc.ID)
+	options := ""
+	for _, circle := range circles {
+		selected := ""
+		if grants[circle.ID] {
+			selected = " selected"
+		}
+		options += `
+				<option value="` + strconv.Itoa(circle.ID) + `"` + selected + `>` + escapeHTML(circle.Name) + `</option>`
+	}
+
+	return `
+<section id="badge-` + id + `-grants" aria-labelledby="badge-` + id + `-title">
+	<header><h2 id="badge-` + id + `-title">` + renderBadgeLabelHTML(desc) + `</h2></header>` + notice + `
+	<p>` + certification + ` <a href="/admin/badges/` + id + `/edit">Edit badge</a></p>
+	<form hx-post="/admin/badges/` + id + `/circles" hx-target="#badge-` + id + `-grants" hx-swap="outerHTML">
+		<label for="badge-` + id + `-circles">Grants membership in</label>
+		<select id="badge-` + id + `-circles" name="circle_id" multiple size="4">` + options + `
+		</select>
+		<button type="submit">Save</button>
+	</form>
+</section>`
+}
+
+// EditBadgePage shows the form for all fields of a badge description
+func (h *Handler) EditBadgePage(c *gin.Context) {
+	desc, ok := h.badgeParam(c)
+	if !ok {
+		return
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Admin / Badges / ` + escapeHTML(desc.Title) + ` - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Admin / Badges / "+escapeHTML(desc.Title)) + `
+	<main>
+		<h1>Edit badge</h1>
+		<p><a href="/admin/badges">All badges</a></p>
+		` + h.renderBadgeFormHTML(desc, "") + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// badgeUpdate is the body of PUT /api/badges/:id, all fields are replaced and left out ones cleared
+type badgeUpdate struct {
+	Title               string `json:"title"`
+	Description         string `json:"description"`
+	Slug                string `json:"slug"`
+	Icon                string `json:"icon"`
+	Color               string `json:"color"`
+	ValidityDays        *int   `json:"validity_days"`
+	CertificationCircle *int   `json:"certification_circle"`
+}
+
+// UpdateBadge saves a badge description (API endpoint: PUT /api/badges/:id). The body is a form
+// or JSON, HTMX requests get the form back, other clients JSON.
+func (h *Handler) UpdateBadge(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	desc, ok := h.badgeParam(c)
+	if !ok {
+		return
+	}
+	htmx := c.GetHeader("HX-Request") == "true"
+
+	var update badgeUpdate
+	switch c.ContentType() {
+	case binding.MIMEJSON:
+		if err := c.ShouldBindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid JSON: " + err.Error()})
+			return
+		}
+	case binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+		update = formBadgeUpdate(c)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"status": "error",
+			"message": "The badge must be sent as a form or as JSON"})
+		return
+	}
+
+	desc.Title = strings.TrimSpace(update.Title)
+	desc.Description = nullString(update.Description)
+	desc.Slug = nullString(update.Slug)
+	desc.Icon = nullString(update.Icon)
+	desc.Color = nullString(update.Color)
+	desc.ValidityDays = sql.NullInt64{}
+	if update.ValidityDays != nil {
+		desc.ValidityDays = sql.NullInt64{Int64: int64(*update.ValidityDays), Valid: true}
+	}
+	desc.CertificationCircleID = sql.NullInt64{}
+	if update.CertificationCircle != nil {
+		desc.CertificationCircleID = sql.NullInt64{Int64: int64(*update.CertificationCircle), Valid: true}
+	}
+
+	if err := h.badgeRepo.UpdateBadgeDescription(desc, user.ID); err != nil {
+		status, message := http.StatusBadRequest, err.Error()
+		switch {
+		case errors.Is(err, models.ErrInvalidBadge), errors.Is(err, models.ErrGrantsNeedCertification):
+		case errors.Is(err, models.ErrDuplicateBadgeTitle), errors.Is(err, models.ErrDuplicateBadgeSlug):
+			status = http.StatusConflict
+		default:
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to update badge %d: %v", desc.ID, err))
+			status, message = http.StatusInternalServerError, "Failed to save the badge"
+		}
+		if htmx {
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderBadgeFormHTML(desc,
+				`<section aria-live="polite"><p>`+escapeHTML(message)+`.</p></section>`)))
+			return
+		}
+		c.JSON(status, gin.H{"status": "error", "message": message})
+		return
+	}
+
+	logging.LogSuccess("BADGE", fmt.Sprintf("Badge '%s' updated by %s", desc.Title, user.Username))
+	if htmx {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderBadgeFormHTML(desc,
+			`<section aria-live="polite"><p>Saved.</p></section>`)))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": badgeResponse(desc)})
+}
+
+// formBadgeUpdate reads a badgeUpdate from the edit form, where empty fields are cleared
+func formBadgeUpdate(c *gin.Context) badgeUpdate {
+	update := badgeUpdate{
+		Title:       c.PostForm("title"),
+		Description: c.PostForm("description"),
+		Slug:        c.PostForm("slug"),
+		Icon:        c.PostForm("icon"),
+		Color:       c.PostForm("color"),
+	}
+	if days := strings.TrimSpace(c.PostForm("validity_days")); days != "" {
+		// Anything but a number is stored as 0, which Validate rejects
+		n, _ := strconv.Atoi(days)
+		update.ValidityDays = &n
+	}
+	if circleID, err := strconv.Atoi(c.PostForm("certification_circle")); err == nil {
+		update.CertificationCircle = &circleID
+	}
+	return update
+}
+
+// badgeParam loads the badge description in the :id parameter, writing the response if there is none
+func (h *Handler) badgeParam(c *gin.Context) (*models.BadgeDescription, bool) {
+	badgeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		badgeParamError(c, http.StatusBadRequest, "Invalid badge id")
+		return nil, false
+	}
+	desc, err := h.badgeRepo.FindBadgeDescriptionByID(badgeID)
+	if err != nil {
+		badgeParamError(c, http.StatusNotFound, "Badge not found")
+		return nil, false
+	}
+	return desc, true
+}
+
+// badgeParamError answers HTMX and pages with HTML and API clients with JSON
+func badgeParamError(c *gin.Context, status int, message string) {
+	if c.GetHeader("HX-Request") != "true" && middleware.IsAPIRequest(c) {
+		c.JSON(status, gin.H{"status": "error", "message": message})
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", []byte(`<p>`+message+`</p>`))
+}
+
+// nullString trims an optional value, empty values are stored as NULL
+func nullString(value string) sql.NullString {
+	value = strings.TrimSpace(value)
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// renderBadgeFormHTML is the edit form for a badge description
+func (h *Handler) renderBadgeFormHTML(desc *models.BadgeDescription, notice string) string {
+	circles, err := h.circleRepo.GetAll()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles: %v", err))
+	}
+	circleOptions := `<option value="">None, anyone can award it</option>`
+	for _, circle := range circles {
+		selected := ""
+		if desc.CertificationCircleID.Valid && desc.CertificationCircleID.Int64 == int64(circle.ID) {
+			selected = " selected"
+		}
+		circleOptions += `<option value="` + strconv.Itoa(circle.ID) + `"` + selected + `>` + escapeHTML(circle.Name) + `</option>`
+	}
+
+	publicLink := ""
+	if desc.Slug.Valid {
+		publicLink = `
+	<p><a href="/badges/` + escapeHTML(desc.Slug.String) + `">Public page</a></p>`
+	}
+
+	validity := ""
+	if desc.ValidityDays.Valid {
+		validity = strconv.FormatInt(desc.ValidityDays.Int64, 10)
+	}
+
+	return `
+<section id="badge-form" aria-labelledby="badge-form-title">
+	<header><h2 id="badge-form-title">` + renderBadgeLabelHTML(desc) + `</h2></header>` + notice + publicLink + `
+	<form hx-put="/api/badges/` + strconv.Itoa(desc.ID) + `" hx-target="#badge-form" hx-swap="outerHTML">
+		<div>
+			<label for="badge-title">Title</label>
+			<input type="text" id="badge-title" name="title" value="` + escapeHTML(desc.Title) + `" maxlength="` + strconv.Itoa(models.BadgeTitleMaxLength) + `" required>
+		</div>
+		<div>
+			<label for="badge-description">Description</label>
+			<textarea id="badge-description" name="description" rows="4">` + escapeHTML(desc.Description.String) + `</textarea>
+		</div>
+		<div>
+			<label for="badge-slug">Slug, the address of the public page</label>
+			<input type="text" id="badge-slug" name="slug" value="` + escapeHTML(desc.Slug.String) + `" pattern="[a-z0-9]+(-[a-z0-9]+)*" placeholder="laser-certified">
+		</div>
+		<div>
+			<label for="badge-icon">Icon URL</label>
+			<input type="text" id="badge-icon" name="icon" value="` + escapeHTML(desc.Icon.String) + `" placeholder="https://...">
+		</div>
+		<div>
+			<label for="badge-color">Color</label>
+			<input type="text" id="badge-color" name="color" value="` + escapeHTML(desc.Color.String) + `" pattern="#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})" placeholder="#ff8800">
+		</div>
+		<div>
+			<label for="badge-validity">Valid for days, empty if the badge doesn't expire</label>
+			<input type="number" id="badge-validity" name="validity_days" value="` + validity + `" min="1" placeholder="365">
+		</div>
+		<div>
+			<label for="badge-certification-circle">Certification circle, whose members award the badge</label>
+			<select id="badge-certification-circle" name="certification_circle">` + circleOptions + `</select>
+		</div>
+		<button type="submit">Save Badge</button>
+	</form>
+</section>`
+}
@@ -1,21 +1,51 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
 	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
 )
 
 // BadgeResponse represents the public badge information for API responses
 type BadgeResponse struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description,omitempty"`
-	Slug        string `json:"slug,omitempty"`
-	Icon        string `json:"icon,omitempty"`
-	Color       string `json:"color,omitempty"`
+	ID                    int    `json:"id"`
+	Title                 string `json:"title"`
+	Description           string `json:"description,omitempty"`
+	Slug                  string `json:"slug,omitempty"`
+	Icon                  string `json:"icon,omitempty"`
+	Color                 string `json:"color,omitempty"`
+	CertificationCircleID *int   `json:"certification_circle_id,omitempty"`
+	ValidityDays          *int   `json:"validity_days,omitempty"`
+}
+
+// badgeResponse converts a badge description for API responses
+func badgeResponse(desc *models.BadgeDescription) BadgeResponse {
+	response := BadgeResponse{
+		ID:          desc.ID,
+		Title:       desc.Title,
+		Description: desc.Description.String,
+		Slug:        desc.Slug.String,
+		Icon:        desc.Icon.String,
+		Color:       desc.Color.String,
+	}
+	if desc.CertificationCircleID.Valid {
+		circleID := int(desc.CertificationCircleID.Int64)
+		response.CertificationCircleID = &circleID
+	}
+	if desc.ValidityDays.Valid {
+		days := int(desc.ValidityDays.Int64)
+		response.ValidityDays = &days
+	}
+	return response
 }
 
 // GetBadges returns a list of all badge descriptions (API endpoint: GET /api/badges/)
@@ -32,26 +62,8 @@ func (h *Handler) GetBadges(c *gin.Context) {
 
 	// Convert to response format
 	var badgeResponses []BadgeResponse
-	for _, desc := range descriptions {
-		response := BadgeResponse{
-			ID:    desc.ID,
-			Title: desc.Title,
-		}
-		
-		if desc.Description.Valid {
-			response.Description = desc.Description.String
-		}
-		if desc.Slug.Valid {
-			response.Slug = desc.Slug.String
-		}
-		if desc.Icon.Valid {
-			response.Icon = desc.Icon.String
-		}
-		if desc.Color.Valid {
-			response.Color = desc.Color.String
-		}
-		
-		badgeResponses = append(badgeResponses, response)
+	for i := range descriptions {
+		badgeResponses = append(badgeResponses, badgeResponse(&descriptions[i]))
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -111,6 +123,7 @@ func (h *Handler) GetAvailableBadges(c *gin.Context) {
 	<div>
 		<p>Want something new? Use the dedicated page to create a badge.</p>
 		<p><a href="/badges/new">Create a new badge</a></p>
+		<p><a href="/badges/award">Award a badge to another member</a></p>
 	</div>
 </section>`
 
@@ -145,12 +158,14 @@ func (h *Handler) CreateBadge(c *gin.Context) {
 	}
 
 	// Award to self
-	_, err = h.badgeRepo.AwardBadge(user.ID, desc.ID, user.ID)
+	badge, err := h.badgeRepo.AwardBadge(user.ID, desc.ID, user.ID)
 	if err != nil {
 		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
 			[]byte(`<p>Badge created but failed to award</p>`))
 		return
 	}
+	h.logBadgeAwardedEvent(user.ID, badge)
+	h.logBadgeGrantEvents("member-added", user.ID, badge.GrantedMemberships)
 
 	// Build success feedback and update the user badges via OOB swap
 	updated := h.renderUserBadgesSectionHTML(user.ID)
@@ -182,21 +197,37 @@ func (h *Handler) AwardBadge(c *gin.Context) {
 		return
 	}
 
-	// Prevent duplicates
-	has, _ := h.badgeRepo.AccountHasBadge(user.ID, desc.ID)
-	if has {
+	// Prevent duplicates, badges that expire are renewed instead
+	if held, err := h.badgeRepo.FindHeldBadge(user.ID, desc.ID); err == nil {
+		message := "You already have '" + badgeTitle + "'."
+		if held.ExpiresAt.Valid {
+			message = h.renewHeldBadge(user, desc, held)
+		}
 		c.Data(http.StatusOK, "text/html; charset=utf-8",
-			[]byte(`<section aria-live="polite"><p>You already have '`+badgeTitle+`'.</p></section>`))
+			[]byte(`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`+
+				`<div id="user-badges" hx-swap-oob="true">`+h.renderUserBadgesSectionHTML(user.ID)+`</div>`))
 		return
 	}
 
 	// Award badge
-	_, err = h.badgeRepo.AwardBadge(user.ID, desc.ID, user.ID)
+	badge, err := h.badgeRepo.AwardBadge(user.ID, desc.ID, user.ID)
+	if errors.Is(err, models.ErrNotCertifier) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8",
+			[]byte(`<section aria-live="polite"><p>'`+escapeHTML(badgeTitle)+`' has to be awarded by a certifier.</p></section>`))
+		return
+	}
+	if errors.Is(err, models.ErrSelfAwardGrantsCircles) || errors.Is(err, models.ErrGrantsNeedCertification) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8",
+			[]byte(`<section aria-live="polite"><p>Can't add '`+escapeHTML(badgeTitle)+`': `+escapeHTML(err.Error())+`.</p></section>`))
+		return
+	}
 	if err != nil {
 		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
 			[]byte("<p>Failed to award badge</p>"))
 		return
 	}
+	h.logBadgeAwardedEvent(user.ID, badge)
+	h.logBadgeGrantEvents("member-added", user.ID, badge.GrantedMemberships)
 
 	// Return feedback and out-of-band update of the user badges section
 	updated := h.renderUserBadgesSectionHTML(user.ID)
@@ -206,25 +237,473 @@ func (h *Handler) AwardBadge(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
 }
 
-// RemoveBadge removes an awarded badge from the current user
-func (h *Handler) RemoveBadge(c *gin.Context) {
+// AwardBadgePage shows the form for awarding a badge to another member (requires authentication)
+func (h *Handler) AwardBadgePage(c *gin.Context) {
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Award Badge - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Award Badge") + `
+	<main>
+		<h1>Award a Badge</h1>
+		<p>Badges with a certification circle can only be awarded by members of that circle.</p>
+		` + h.renderAwardBadgeSectionHTML(c, "") + `
+	</main>
+</body>
+</html>`
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// AwardBadgeToMember awards a badge to another member, with the current user as the awarder
+func (h *Handler) AwardBadgeToMember(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+
+	username := strings.TrimSpace(c.PostForm("username"))
+	account, err := h.accountRepo.FindByUsername(username)
+	if err != nil {
+		h.awardBadgeNotice(c, "No such account: "+username)
+		return
+	}
+	badgeID, err := strconv.Atoi(c.PostForm("badge_id"))
+	if err != nil {
+		h.awardBadgeNotice(c, "Please pick a badge.")
+		return
+	}
+	desc, err := h.badgeRepo.FindBadgeDescriptionByID(badgeID)
+	if err != nil {
+		h.awardBadgeNotice(c, "No such badge.")
+		return
+	}
+
+	// Awarding a badge that expires again renews it
+	held, err := h.badgeRepo.FindHeldBadge(account.ID, desc.ID)
+	if err != nil && err != sql.ErrNoRows {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check badges of %s: %v", account.Username, err))
+	}
+	if held != nil {
+		if !held.ExpiresAt.Valid {
+			h.awardBadgeNotice(c, account.Username+" already has '"+desc.Title+"'.")
+			return
+		}
+		h.awardBadgeNotice(c, h.renewHeldBadge(user, desc, held))
+		return
+	}
+
+	badge, err := h.badgeRepo.AwardBadge(account.ID, desc.ID, user.ID)
+	if errors.Is(err, models.ErrNotCertifier) || errors.Is(err, models.ErrSelfAwardGrantsCircles) ||
+		errors.Is(err, models.ErrGrantsNeedCertification) {
+		logging.LogWarning("BADGE", fmt.Sprintf("%s was refused awarding '%s' to %s: %v", user.Username, desc.Title, account.Username, err))
+		c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+			[]byte(`<p>`+escapeHTML(err.Error())+`</p>`))
+		return
+	}
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to award '%s' to %s: %v", desc.Title, account.Username, err))
+		h.awardBadgeNotice(c, "Failed to award '"+desc.Title+"' to "+account.Username+".")
+		return
+	}
+
+	logging.LogSuccess("BADGE", fmt.Sprintf("'%s' awarded to %s by %s", desc.Title, account.Username, user.Username))
+	h.logBadgeAwardedEvent(user.ID, badge)
+	h.logBadgeGrantEvents("member-added", user.ID, badge.GrantedMemberships)
+	h.awardBadgeNotice(c, "Awarded '"+desc.Title+"' to "+account.Username+".")
+}
+
+// logBadgeAwardedEvent stores a badge/awarded event like the legacy BadgeAwardedEvent:
+// int1 is the account badge, int2 the badge description
+func (h *Handler) logBadgeAwardedEvent(awarderID int, badge *models.AccountBadge) {
+	event := &models.Event{
+		Domain:    "badge",
+		Key:       "awarded",
+		Int1:      sql.NullInt64{Int64: int64(badge.ID), Valid: true},
+		Int2:      sql.NullInt64{Int64: int64(badge.BadgeDescriptionID), Valid: true},
+		CreatedBy: sql.NullInt64{Int64: int64(awarderID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log badge/awarded event: %v", err))
+	}
+}
+
+// logBadgeGrantEvents records the circle memberships a badge added or removed as circle events
+func (h *Handler) logBadgeGrantEvents(key string, actorID int, memberships []models.CircleMember) {
+	for _, member := range memberships {
+		circle, err := h.circleRepo.FindByID(member.CircleID)
+		if err != nil {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circle %d: %v", member.CircleID, err))
+			continue
+		}
+		logging.LogSuccess("CIRCLE", fmt.Sprintf("Badge %d of account %d: %s in circle '%s'",
+			member.AccountBadgeID.Int64, member.AccountID, key, circle.Name))
+		h.logCircleMemberEvent(key, actorID, circle, member.AccountID, member.Comment.String, member.ExpiresAt)
+	}
+}
+
+// awardBadgeNotice answers with the award form and a message
+func (h *Handler) awardBadgeNotice(c *gin.Context, message string) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderAwardBadgeSectionHTML(c,
+		`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`)))
+}
+
+// renderAwardBadgeSectionHTML is the award form, listing only the badges the current user may award
+func (h *Handler) renderAwardBadgeSectionHTML(c *gin.Context, notice string) string {
+	user := middleware.GetCurrentUser(c)
+	descriptions, err := h.badgeRepo.GetAllDescriptions()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badges: %v", err))
+	}
+
+	options := ""
+	for _, desc := range descriptions {
+		label := escapeHTML(desc.Title)
+		if desc.CertificationCircleID.Valid {
+			certifier, err := h.circleRepo.IsAccountInCircle(user.ID, int(desc.CertificationCircleID.Int64))
+			if err != nil {
+				logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check certification circle of badge %d: %v", desc.ID, err))
+			}
+			if !certifier {
+				continue
+			}
+			label += " (certified)"
+		}
+		options += `
+				<option value="` + strconv.Itoa(desc.ID) + `">` + label + `</option>`
+	}
+
+	return `
+<section id="award-badge" aria-labelledby="award-badge-title">
+	<header><h2 id="award-badge-title">Award to a member</h2></header>` + notice + `
+	<form hx-post="/api/badges/award-member" hx-target="#award-badge" hx-swap="outerHTML">
+		<div>
+			<label for="award-username">Username</label>
+			<input type="text" id="award-username" name="username" required>
+		</div>
+		<div>
+			<label for="award-badge-id">Badge</label>
+			<select id="award-badge-id" name="badge_id" required>
+				<option value="">Choose a badge</option>` + options + `
+			</select>
+		</div>
+		<button type="submit">Award Badge</button>
+	</form>
+</section>`
+}
+
+// BadgePage is the public page of a badge, with its description and who holds it
+func (h *Handler) BadgePage(c *gin.Context) {
+	desc, err := h.badgeRepo.FindBadgeDescriptionBySlug(c.Param("slug"))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badge '%s': %v", c.Param("slug"), err))
+		}
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Badge not found</p>`))
+		return
+	}
+	certification := "<p>Any member can award this badge.</p>"
+	if desc.CertificationCircleID.Valid {
+		if circle, err := h.circleRepo.FindByID(int(desc.CertificationCircleID.Int64)); err == nil {
+			certification = "<p>Awarded by members of the " + escapeHTML(circle.Name) + " circle.</p>"
+		}
+	}
+
+	editLink := ""
+	if h.isAdmin(middleware.GetCurrentUser(c)) {
+		editLink = `<p><a href="/admin/badges/` + strconv.Itoa(desc.ID) + `/edit">Edit badge</a></p>`
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>` + escapeHTML(desc.Title) + ` - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Badges / "+escapeHTML(desc.Title)) + `
+	<main>
+		<h1>` + renderBadgeLabelHTML(desc) + `</h1>
+		<p>` + escapeHTML(desc.Description.String) + `</p>
+		` + certification + `
+		` + editLink + `
+		` + h.renderBadgeHoldersSectionHTML(c, desc, "") + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// renderBadgeLabelHTML shows a badge title with its icon and color. Values stored by the legacy
+// app weren't validated, so invalid icons and colors are left out.
+func renderBadgeLabelHTML(desc *models.BadgeDescription) string {
+	html := ""
+	if desc.Icon.Valid && models.IsValidBadgeIcon(desc.Icon.String) {
+		html += `<img src="` + escapeHTML(desc.Icon.String) + `" alt="" width="24" height="24"> `
+	}
+	if desc.Color.Valid && models.IsValidBadgeColor(desc.Color.String) {
+		return html + `<span style="color: ` + escapeHTML(desc.Color.String) + `">` + escapeHTML(desc.Title) + `</span>`
+	}
+	return html + `<span>` + escapeHTML(desc.Title) + `</span>`
+}
+
+// renderBadgeLinkHTML is the badge label, linking to its public page if it has one
+func renderBadgeLinkHTML(desc *models.BadgeDescription) string {
+	if !desc.Slug.Valid {
+		return renderBadgeLabelHTML(desc)
+	}
+	return `<a href="/badges/` + escapeHTML(desc.Slug.String) + `">` + renderBadgeLabelHTML(desc) + `</a>`
+}
+
+// RenewBadge renews an awarded badge that expires (API endpoint: POST /api/badges/renew).
+// Renewing takes a certifier, the same as awarding the badge.
+func (h *Handler) RenewBadge(c *gin.Context) {
 	user := middleware.GetCurrentUser(c)
-	idStr := c.PostForm("account_badge_id")
-	accountBadgeID, err := strconv.Atoi(idStr)
+	accountBadgeID, err := strconv.Atoi(c.PostForm("account_badge_id"))
 	if err != nil {
 		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
 			[]byte(`<p>Invalid badge id</p>`))
 		return
 	}
-	if err := h.badgeRepo.DeleteAccountBadge(accountBadgeID, user.ID); err != nil {
-		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
-			[]byte(`<p>Failed to remove badge</p>`))
+	descID, _ := strconv.Atoi(c.PostForm("badge_description_id"))
+	desc, err := h.badgeRepo.FindBadgeDescriptionByID(descID)
+	if err != nil {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Badge not found</p>`))
+		return
+	}
+
+	h.accountBadgeNotice(c, h.renewHeldBadge(user, desc, &models.AccountBadge{ID: accountBadgeID}))
+}
+
+// renewHeldBadge renews an awarded badge on behalf of user and returns the message to show
+func (h *Handler) renewHeldBadge(user *middleware.AuthenticatedUser, desc *models.BadgeDescription, held *models.AccountBadge) string {
+	badge, err := h.badgeRepo.RenewAccountBadge(held.ID, user.ID)
+	switch {
+	case errors.Is(err, models.ErrNotCertifier):
+		logging.LogWarning("BADGE", fmt.Sprintf("%s tried to renew badge %d without being a certifier", user.Username, held.ID))
+		return "'" + desc.Title + "' has to be renewed by a certifier."
+	case errors.Is(err, models.ErrBadgeRevoked), errors.Is(err, models.ErrBadgeDoesNotExpire):
+		return "Can't renew the badge: " + err.Error() + "."
+	case err == sql.ErrNoRows:
+		return "Badge not found."
+	case err != nil:
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to renew badge %d: %v", held.ID, err))
+		return "Failed to renew '" + desc.Title + "'."
+	}
+
+	expires := badge.ExpiresAt.Time.Format("2006-01-02")
+	logging.LogSuccess("BADGE", fmt.Sprintf("Badge %d of account %d renewed by %s until %s", badge.ID, badge.AccountID, user.Username, expires))
+	h.logBadgeRenewedEvent(user.ID, badge)
+	h.logBadgeGrantEvents("member-added", user.ID, badge.GrantedMemberships)
+	return "Renewed '" + desc.Title + "' until " + expires + "."
+}
+
+// logBadgeRenewedEvent stores a badge/renewed event: int1 is the account badge, int2 the badge
+// description, int3 the member and text1 the new expiry date
+func (h *Handler) logBadgeRenewedEvent(renewerID int, badge *models.AccountBadge) {
+	event := &models.Event{
+		Domain:    "badge",
+		Key:       "renewed",
+		Text1:     sql.NullString{String: badge.ExpiresAt.Time.Format(time.RFC3339), Valid: true},
+		Int1:      sql.NullInt64{Int64: int64(badge.ID), Valid: true},
+		Int2:      sql.NullInt64{Int64: int64(badge.BadgeDescriptionID), Valid: true},
+		Int3:      sql.NullInt64{Int64: int64(badge.AccountID), Valid: true},
+		CreatedBy: sql.NullInt64{Int64: int64(renewerID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log badge/renewed event: %v", err))
+	}
+}
+
+// RevokeBadge revokes an awarded badge with a reason. The awarder, members of the badge's
+// certification circle and admins may revoke it, the badge stays in the member's history.
+func (h *Handler) RevokeBadge(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	accountBadgeID, err := strconv.Atoi(c.PostForm("account_badge_id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid badge id</p>`))
+		return
+	}
+
+	canRevoke, err := h.badgeRepo.CanRevokeBadge(accountBadgeID, user.ID)
+	if err == sql.ErrNoRows {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Badge not found</p>`))
+		return
+	}
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check revocation rights on badge %d: %v", accountBadgeID, err))
+	}
+	if !canRevoke && !h.isAdmin(user) {
+		logging.LogWarning("BADGE", fmt.Sprintf("%s tried to revoke badge %d without being allowed to", user.Username, accountBadgeID))
+		c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+			[]byte(`<p>Only the awarder, certifiers and admins can revoke this badge</p>`))
+		return
+	}
+
+	badge, err := h.badgeRepo.RevokeAccountBadge(accountBadgeID, user.ID, c.PostForm("reason"))
+	if err != nil {
+		message := "Failed to revoke the badge."
+		if errors.Is(err, models.ErrRevocationReasonRequired) || errors.Is(err, models.ErrBadgeRevoked) {
+			message = "Can't revoke the badge: " + err.Error() + "."
+		} else {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to revoke badge %d: %v", accountBadgeID, err))
+		}
+		h.accountBadgeNotice(c, message)
 		return
 	}
+
+	logging.LogSuccess("BADGE", fmt.Sprintf("Badge %d of account %d revoked by %s: %s", badge.ID, badge.AccountID, user.Username, badge.RevokedReason.String))
+	h.logBadgeRevokedEvent(user.ID, badge)
+	h.logBadgeGrantEvents("member-removed", user.ID, badge.GrantedMemberships)
+	h.accountBadgeNotice(c, "Badge revoked.")
+}
+
+// accountBadgeNotice answers a revocation or renewal from a badge page with its holder list, and
+// one from the profile with a message and the updated badges of the current user
+func (h *Handler) accountBadgeNotice(c *gin.Context, message string) {
+	notice := `<section aria-live="polite"><p>` + escapeHTML(message) + `</p></section>`
+	if c.GetHeader("HX-Target") == "badge-holders" {
+		descID, _ := strconv.Atoi(c.PostForm("badge_description_id"))
+		if desc, err := h.badgeRepo.FindBadgeDescriptionByID(descID); err == nil {
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderBadgeHoldersSectionHTML(c, desc, notice)))
+			return
+		}
+	}
+
+	user := middleware.GetCurrentUser(c)
 	updated := h.renderUserBadgesSectionHTML(user.ID)
-	html := `<section aria-live="polite"><p>Badge removed.</p></section>` +
-		`<div id="user-badges" hx-swap-oob="true">` + updated + `</div>`
-	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+	c.Data(http.StatusOK, "text/html; charset=utf-8",
+		[]byte(notice+`<div id="user-badges" hx-swap-oob="true">`+updated+`</div>`))
+}
+
+// logBadgeRevokedEvent stores a badge/revoked event: int1 is the account badge, int2 the
+// badge description, int3 the member and text1 the reason
+func (h *Handler) logBadgeRevokedEvent(revokerID int, badge *models.AccountBadge) {
+	event := &models.Event{
+		Domain:    "badge",
+		Key:       "revoked",
+		Text1:     badge.RevokedReason,
+		Int1:      sql.NullInt64{Int64: int64(badge.ID), Valid: true},
+		Int2:      sql.NullInt64{Int64: int64(badge.BadgeDescriptionID), Valid: true},
+		Int3:      sql.NullInt64{Int64: int64(badge.AccountID), Valid: true},
+		CreatedBy: sql.NullInt64{Int64: int64(revokerID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log badge/revoked event: %v", err))
+	}
+}
+
+// renderBadgeHoldersSectionHTML lists who holds a badge. Holders the current user may revoke
+// the badge from get a revoke form.
+func (h *Handler) renderBadgeHoldersSectionHTML(c *gin.Context, desc *models.BadgeDescription, notice string) string {
+	// Visitors who aren't logged in only see members who publish their badges
+	user := middleware.GetCurrentUser(c)
+	holders, err := h.badgeRepo.GetHolders(desc.ID, user == nil)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load holders of badge %d: %v", desc.ID, err))
+	}
+
+	// Anyone can award and renew badges without a certification circle
+	certifier := user != nil && !desc.CertificationCircleID.Valid
+	if user != nil && desc.CertificationCircleID.Valid {
+		certifier, err = h.circleRepo.IsAccountInCircle(user.ID, int(desc.CertificationCircleID.Int64))
+		if err != nil {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check certification circle of badge %d: %v", desc.ID, err))
+		}
+	}
+	// Awarders can revoke what they awarded, certifiers and admins anything
+	revokeAll := h.isAdmin(user) || (certifier && desc.CertificationCircleID.Valid)
+
+	html := `
+<section id="badge-holders" aria-labelledby="badge-holders-title">
+	<h2 id="badge-holders-title">Holders (` + strconv.Itoa(len(holders)) + `)</h2>` + notice
+	if user == nil {
+		html += `
+	<p>Only members who publish their badges are shown. <a href="/login">Log in</a> to see everyone.</p>`
+	}
+	if len(holders) == 0 {
+		return html + `
+	<p>Nobody has this badge yet.</p>
+</section>`
+	}
+
+	html += `
+	<ul>`
+	now := time.Now()
+	for _, holder := range holders {
+		// The awarder didn't necessarily publish anything
+		awarded := ", awarded"
+		if user != nil {
+			awarded += " by " + escapeHTML(holder.AwardedBy.Username)
+		}
+		html += `
+		<li` + expiredBadgeStyle(&holder, now) + `>` + escapeHTML(holder.Account.Username) + awarded +
+			` on ` + holder.CreatedAt.Format("2006-01-02") + renderBadgeExpiryHTML(&holder, now)
+		if certifier && holder.ExpiresAt.Valid {
+			html += renderRenewBadgeFormHTML(&holder, "#badge-holders", `hx-swap="outerHTML"`)
+		}
+		if user != nil && (revokeAll || holder.AwardedByID.Int64 == int64(user.ID)) {
+			html += renderRevokeBadgeFormHTML(&holder, "#badge-holders", `hx-swap="outerHTML"`)
+		}
+		html += `</li>`
+	}
+	return html + `
+	</ul>
+</section>`
+}
+
+// renderRenewBadgeFormHTML is the button renewing an awarded badge that expires
+func renderRenewBadgeFormHTML(badge *models.AccountBadge, target, swap string) string {
+	return `
+			<form hx-post="/api/badges/renew" hx-target="` + target + `" ` + swap + `>
+				<input type="hidden" name="account_badge_id" value="` + strconv.Itoa(badge.ID) + `">
+				<input type="hidden" name="badge_description_id" value="` + strconv.Itoa(badge.BadgeDescriptionID) + `">
+				<button type="submit">Renew</button>
+			</form>`
+}
+
+// renderBadgeExpiryHTML tells when an awarded badge expires or expired, if it does
+func renderBadgeExpiryHTML(badge *models.AccountBadge, now time.Time) string {
+	switch {
+	case !badge.ExpiresAt.Valid:
+		return ""
+	case badge.IsExpired(now):
+		return ` (expired on ` + badge.ExpiresAt.Time.Format("2006-01-02") + `)`
+	default:
+		return ` (valid until ` + badge.ExpiresAt.Time.Format("2006-01-02") + `)`
+	}
+}
+
+// expiredBadgeStyle greys out expired badges in lists
+func expiredBadgeStyle(badge *models.AccountBadge, now time.Time) string {
+	if badge.IsExpired(now) {
+		return ` style="opacity: 0.5"`
+	}
+	return ""
+}
+
+// renderRevokeBadgeFormHTML is the form asking for the reason to revoke an awarded badge
+func renderRevokeBadgeFormHTML(badge *models.AccountBadge, target, swap string) string {
+	id := strconv.Itoa(badge.ID)
+	return `
+			<details>
+				<summary>Revoke</summary>
+				<form hx-post="/api/badges/revoke" hx-target="` + target + `" ` + swap + `>
+					<input type="hidden" name="account_badge_id" value="` + id + `">
+					<input type="hidden" name="badge_description_id" value="` + strconv.Itoa(badge.BadgeDescriptionID) + `">
+					<label for="revoke-reason-` + id + `">Reason</label>
+					<input type="text" id="revoke-reason-` + id + `" name="reason" maxlength="500" required>
+					<button type="submit">Revoke badge</button>
+				</form>
+			</details>`
 }
 
 // BadgeCreatePage shows a dedicated page to create a new badge (requires authentication)
@@ -269,4 +748,58 @@ func (h *Handler) BadgeCreatePage(c *gin.Context) {
 </html>`
 
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
-}
\ No newline at end of file
+}
+
+// StartBadgeExpiryReminders emails members whose badges expire within notice, checking every
+// interval. Each badge gets one reminder until it is renewed. baseURL is the public address of
+// the site, used for links in the emails. Call the returned function to stop.
+func (h *Handler) StartBadgeExpiryReminders(interval, notice time.Duration, baseURL string) func() {
+	ticker := time.NewTicker(interval)
+	stopCh := make(chan struct{})
+
+	go func() {
+		h.sendBadgeExpiryReminders(notice, baseURL)
+		for {
+			select {
+			case <-ticker.C:
+				h.sendBadgeExpiryReminders(notice, baseURL)
+			case <-stopCh:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(stopCh) }
+}
+
+// sendBadgeExpiryReminders runs one pass of the reminder job
+func (h *Handler) sendBadgeExpiryReminders(notice time.Duration, baseURL string) {
+	badges, err := h.badgeRepo.GetExpiringBadges(notice)
+	if err != nil {
+		logging.LogError("BADGE EXPIRY", fmt.Sprintf("Failed to load expiring badges: %v", err))
+		return
+	}
+
+	sent := 0
+	for i := range badges {
+		badge := &badges[i]
+		url := ""
+		if badge.BadgeDescription.Slug.Valid {
+			url = strings.TrimRight(baseURL, "/") + "/badges/" + badge.BadgeDescription.Slug.String
+		}
+		// Reminders that fail are tried again on the next pass
+		if err := h.mailer.SendBadgeExpiring(badge.Account, badge, url); err != nil {
+			logging.LogError("BADGE EXPIRY", fmt.Sprintf("Failed to remind %s about badge %d: %v", badge.Account.Username, badge.ID, err))
+			continue
+		}
+		if err := h.badgeRepo.MarkReminderSent(badge.ID); err != nil {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to record reminder for badge %d: %v", badge.ID, err))
+			continue
+		}
+		sent++
+	}
+	if sent > 0 {
+		logging.LogInfo("BADGE EXPIRY", fmt.Sprintf("Sent %d badge expiry reminders", sent))
+	}
+}
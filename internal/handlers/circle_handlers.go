@@ -0,0 +1,872 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// memberExpiryLayout is the format of datetime-local inputs
+const memberExpiryLayout = "2006-01-02T15:04"
+
+// systemUsername is the account created by V001.017, automatic changes are recorded as made by it
+const systemUsername = "system"
+
+// builtinCircles are looked up by name in the code, renaming or removing them breaks access checks
+var builtinCircles = []string{middleware.AdminCircle, MemberInfoCircle}
+
+// AdminCircles shows the circles admin page
+func (h *Handler) AdminCircles(c *gin.Context) {
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Admin / Circles - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Admin / Circles") + `
+	<main>
+		<h1>Circles</h1>
+		<p>Manage user groups and permissions. ADMIN_CIRCLE circles are managed by the members of their admin circle, SELF_ADMIN circles by their own members.</p>
+		` + h.renderCirclesSectionHTML(c, nil, "") + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// AdminCircle shows one circle with its members. Members can be added and removed by
+// those who may administer the circle, see CircleRepository.CanAdminCircle.
+func (h *Handler) AdminCircle(c *gin.Context) {
+	circleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid circle id</p>`))
+		return
+	}
+	circle, err := h.circleRepo.FindByID(circleID)
+	if err != nil {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Circle not found</p>`))
+		return
+	}
+
+	requests, err := h.circleRepo.GetPendingRequests(circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load requests to join circle %d: %v", circle.ID, err))
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Admin / Circles / ` + escapeHTML(circle.Name) + ` - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Admin / Circles / "+escapeHTML(circle.Name)) + `
+	<main>
+		<h1>` + escapeHTML(circle.Name) + `</h1>
+		<p>` + escapeHTML(circle.Description) + `</p>
+		` + h.renderCircleInfoHTML(circle) + `
+		<p><a href="/admin/circles">All circles</a></p>
+		<p><a href="/circles/` + strconv.Itoa(circle.ID) + `">Requests to join (` + strconv.Itoa(len(requests)) + ` pending)</a></p>
+		` + h.renderCircleMembersSectionHTML(c, circle, "") + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// CircleResponse is a circle with its members for API responses
+type CircleResponse struct {
+	ID                           int                    `json:"id"`
+	Name                         string                 `json:"name"`
+	Description                  string                 `json:"description"`
+	ManagementStyle              string                 `json:"management_style"`
+	AdminCircleID                *int                   `json:"admin_circle_id"`
+	AdminCircleName              string                 `json:"admin_circle_name,omitempty"`
+	CommentRequiredForMembership bool                   `json:"comment_required_for_membership"`
+	Members                      []CircleMemberResponse `json:"members"`
+}
+
+// CircleMemberResponse is one member of a circle, with the account that added them
+type CircleMemberResponse struct {
+	AccountID      int        `json:"account_id"`
+	Username       string     `json:"username"`
+	Name           string     `json:"name,omitempty"`
+	Comment        string     `json:"comment,omitempty"`
+	IssuerID       int        `json:"issuer_id"`
+	IssuerUsername string     `json:"issuer_username"`
+	AddedAt        time.Time  `json:"added_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetCircle returns a circle and its members (API endpoint: GET /api/circles/:id). Members can be
+// filtered with ?q=, and ?format=csv downloads them. HTMX requests get the member table.
+func (h *Handler) GetCircle(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+
+	// Rosters show comments on why people got access, only for admins of the circle or the site
+	canAdmin, err := h.circleRepo.CanAdminCircle(user.ID, circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check admin rights on circle %d: %v", circle.ID, err))
+	}
+	if !canAdmin && !h.isAdmin(user) {
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "message": "You can't administer the " + circle.Name + " circle"})
+		return
+	}
+
+	members, err := h.circleRepo.GetMembers(circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load members of circle %d: %v", circle.ID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "Failed to retrieve circle members"})
+		return
+	}
+	members = filterCircleMembers(members, c.Query("q"))
+
+	switch {
+	case c.Query("format") == "csv":
+		writeCircleMembersCSV(c, circle, members)
+	case c.GetHeader("HX-Request") == "true":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(renderCircleMemberListHTML(circle, members, canAdmin)))
+	default:
+		response := CircleResponse{
+			ID:                           circle.ID,
+			Name:                         circle.Name,
+			Description:                  circle.Description,
+			ManagementStyle:              circle.ManagementStyle,
+			CommentRequiredForMembership: circle.CommentRequiredForMembership,
+			Members:                      []CircleMemberResponse{},
+		}
+		if adminCircle := h.adminCircleOf(circle); adminCircle != nil {
+			response.AdminCircleID = &adminCircle.ID
+			response.AdminCircleName = adminCircle.Name
+		}
+		for _, member := range members {
+			memberResponse := CircleMemberResponse{
+				AccountID:      member.AccountID,
+				Username:       member.Account.Username,
+				Name:           member.Account.Name.String,
+				Comment:        member.Comment.String,
+				IssuerID:       member.IssuerID,
+				IssuerUsername: member.Issuer.Username,
+				AddedAt:        member.CreatedAt,
+			}
+			if member.ExpiresAt.Valid {
+				memberResponse.ExpiresAt = &member.ExpiresAt.Time
+			}
+			response.Members = append(response.Members, memberResponse)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "data": response})
+	}
+}
+
+// writeCircleMembersCSV sends the members as a CSV download
+func writeCircleMembersCSV(c *gin.Context, circle *models.Circle, members []models.CircleMember) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"username", "name", "comment", "added_by", "added_at", "expires_at"})
+	for _, member := range members {
+		expiresAt := ""
+		if member.ExpiresAt.Valid {
+			expiresAt = member.ExpiresAt.Time.Format(time.RFC3339)
+		}
+		w.Write([]string{
+			csvCell(member.Account.Username),
+			csvCell(member.Account.Name.String),
+			csvCell(member.Comment.String),
+			csvCell(member.Issuer.Username),
+			member.CreatedAt.Format(time.RFC3339),
+			expiresAt,
+		})
+	}
+	w.Flush()
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="circle-%d-members.csv"`, circle.ID))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// csvCell stops spreadsheets from running values members chose themselves as formulas
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// adminCircleOf loads the circle managing an ADMIN_CIRCLE circle, nil for SELF_ADMIN circles
+func (h *Handler) adminCircleOf(circle *models.Circle) *models.Circle {
+	if circle.ManagementStyle != models.ManagementStyleAdminCircle || !circle.AdminCircleID.Valid {
+		return nil
+	}
+	adminCircle, err := h.circleRepo.FindByID(int(circle.AdminCircleID.Int64))
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load admin circle of circle %d: %v", circle.ID, err))
+		return nil
+	}
+	return adminCircle
+}
+
+// renderCircleInfoHTML describes how a circle is managed
+func (h *Handler) renderCircleInfoHTML(circle *models.Circle) string {
+	managedBy := "Its own members (SELF_ADMIN)"
+	if adminCircle := h.adminCircleOf(circle); adminCircle != nil {
+		managedBy = `Members of <a href="/admin/circles/` + strconv.Itoa(adminCircle.ID) + `">` + escapeHTML(adminCircle.Name) + `</a> (ADMIN_CIRCLE)`
+	}
+	commentRequired := "No"
+	if circle.CommentRequiredForMembership {
+		commentRequired = "Yes"
+	}
+	return `
+		<dl>
+			<dt>Managed by</dt>
+			<dd>` + managedBy + `</dd>
+			<dt>Comment required when adding members</dt>
+			<dd>` + commentRequired + `</dd>
+		</dl>`
+}
+
+// AddCircleMember adds an account to a circle, like the legacy /service/circle/create-membership
+func (h *Handler) AddCircleMember(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+
+	username := strings.TrimSpace(c.PostForm("username"))
+	account, err := h.accountRepo.FindByUsername(username)
+	if err != nil {
+		h.circleMembersNotice(c, circle, "No such account: "+username)
+		return
+	}
+
+	// Optional end of the membership, as sent by a datetime-local input in the server's time zone
+	var expiresAt time.Time
+	if value := strings.TrimSpace(c.PostForm("expires_at")); value != "" {
+		expiresAt, err = time.ParseInLocation(memberExpiryLayout, value, time.Local)
+		if err != nil {
+			h.circleMembersNotice(c, circle, "Invalid expiry time: "+value)
+			return
+		}
+	}
+
+	member, err := h.circleRepo.AddMember(circle.ID, account.ID, user.ID, c.PostForm("comment"), expiresAt)
+	if err != nil {
+		h.circleMemberWriteFailed(c, circle, "add "+account.Username+" to", err)
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("%s added to circle '%s' by %s", account.Username, circle.Name, user.Username))
+	h.logCircleMemberEvent("member-added", user.ID, circle, account.ID, member.Comment.String, member.ExpiresAt)
+	h.circleMembersNotice(c, circle, account.Username+" added to "+circle.Name+".")
+}
+
+// RemoveCircleMember removes an account from a circle, like the legacy /data/account/remove-membership
+func (h *Handler) RemoveCircleMember(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+
+	accountID, err := strconv.Atoi(c.Param("account"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid account id</p>`))
+		return
+	}
+	account, err := h.accountRepo.FindByID(accountID)
+	if err != nil {
+		h.circleMembersNotice(c, circle, "No such account.")
+		return
+	}
+
+	if err := h.circleRepo.RemoveMember(circle.ID, account.ID, user.ID); err != nil {
+		h.circleMemberWriteFailed(c, circle, "remove "+account.Username+" from", err)
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("%s removed from circle '%s' by %s", account.Username, circle.Name, user.Username))
+	h.logCircleMemberEvent("member-removed", user.ID, circle, account.ID, "", sql.NullTime{})
+	h.circleMembersNotice(c, circle, account.Username+" removed from "+circle.Name+".")
+}
+
+// circleParam loads the circle in the :id parameter, writing the response if there is none
+func (h *Handler) circleParam(c *gin.Context) (*models.Circle, bool) {
+	circleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid circle id</p>`))
+		return nil, false
+	}
+	circle, err := h.circleRepo.FindByID(circleID)
+	if err != nil {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Circle not found</p>`))
+		return nil, false
+	}
+	return circle, true
+}
+
+// circleMemberWriteFailed shows why adding or removing a member didn't work
+func (h *Handler) circleMemberWriteFailed(c *gin.Context, circle *models.Circle, action string, err error) {
+	switch {
+	case errors.Is(err, models.ErrNotCircleAdmin):
+		logging.LogWarning("CIRCLE", fmt.Sprintf("%s tried to %s circle '%s' without admin rights",
+			middleware.GetCurrentUser(c).Username, action, circle.Name))
+		c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+			[]byte(`<p>You can't administer the `+escapeHTML(circle.Name)+` circle</p>`))
+	case errors.Is(err, models.ErrCommentRequired), errors.Is(err, models.ErrAlreadyMember),
+		errors.Is(err, models.ErrNotMember), errors.Is(err, models.ErrLastCircleAdmin),
+		errors.Is(err, models.ErrExpiryInPast):
+		h.circleMembersNotice(c, circle, "Can't "+action+" "+circle.Name+": "+err.Error()+".")
+	default:
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to %s circle %d: %v", action, circle.ID, err))
+		h.circleMembersNotice(c, circle, "Failed to "+action+" "+circle.Name+".")
+	}
+}
+
+// circleMembersNotice answers with the members section and a message
+func (h *Handler) circleMembersNotice(c *gin.Context, circle *models.Circle, message string) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCircleMembersSectionHTML(c, circle,
+		`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`)))
+}
+
+// logCircleMemberEvent stores a membership change: int1 is the circle, int2 the member,
+// text2 the comment and text3 when the membership expires
+func (h *Handler) logCircleMemberEvent(key string, issuerID int, circle *models.Circle, accountID int, comment string, expiresAt sql.NullTime) {
+	event := &models.Event{
+		Domain:    "circle",
+		Key:       key,
+		Text1:     sql.NullString{String: circle.Name, Valid: true},
+		Text2:     sql.NullString{String: comment, Valid: comment != ""},
+		Text3:     sql.NullString{String: expiresAt.Time.Format(time.RFC3339), Valid: expiresAt.Valid},
+		Int1:      sql.NullInt64{Int64: int64(circle.ID), Valid: true},
+		Int2:      sql.NullInt64{Int64: int64(accountID), Valid: true},
+		CreatedBy: sql.NullInt64{Int64: int64(issuerID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log circle/%s event: %v", key, err))
+	}
+}
+
+// renderCircleMembersSectionHTML lists the members of a circle, with add and remove
+// controls for those who may administer it. The list keeps the filter sent along as "q".
+func (h *Handler) renderCircleMembersSectionHTML(c *gin.Context, circle *models.Circle, notice string) string {
+	user := middleware.GetCurrentUser(c)
+	canAdmin, err := h.circleRepo.CanAdminCircle(user.ID, circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check admin rights on circle %d: %v", circle.ID, err))
+	}
+	members, err := h.circleRepo.GetMembers(circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load members of circle %d: %v", circle.ID, err))
+	}
+	filter := strings.TrimSpace(c.Request.FormValue("q"))
+
+	id := strconv.Itoa(circle.ID)
+	html := `
+<section id="circle-members" aria-labelledby="circle-members-title">
+	<header><h2 id="circle-members-title">Members (` + strconv.Itoa(len(members)) + `)</h2></header>` + notice + `
+	<form action="/api/circles/` + id + `" method="get">
+		<label for="member-filter">Filter</label>
+		<input type="search" id="member-filter" name="q" value="` + escapeHTML(filter) + `" placeholder="username, name, comment or added by"
+			hx-get="/api/circles/` + id + `" hx-trigger="input changed delay:300ms, search" hx-target="#circle-member-list" hx-swap="outerHTML">
+		<input type="hidden" name="format" value="csv">
+		<button type="submit">Download CSV</button>
+	</form>
+	` + renderCircleMemberListHTML(circle, filterCircleMembers(members, filter), canAdmin)
+
+	if !canAdmin {
+		who := "its own members"
+		if circle.ManagementStyle == models.ManagementStyleAdminCircle {
+			who = "members of its admin circle"
+		}
+		return html + `
+	<p>The members of this circle can only be changed by ` + who + `.</p>
+</section>`
+	}
+
+	commentRequired, commentLabel := "", "Comment"
+	if circle.CommentRequiredForMembership {
+		commentRequired, commentLabel = " required", "Comment (required)"
+	}
+	return html + `
+	<form hx-post="/api/circles/` + id + `/members" hx-target="#circle-members" hx-swap="outerHTML" hx-include="#member-filter">
+		<div>
+			<label for="member-username">Username</label>
+			<input type="text" id="member-username" name="username" required>
+		</div>
+		<div>
+			<label for="member-comment">` + commentLabel + `</label>
+			<input type="text" id="member-comment" name="comment" maxlength="200"` + commentRequired + `>
+		</div>
+		<div>
+			<label for="member-expires-at">Expires (optional)</label>
+			<input type="datetime-local" id="member-expires-at" name="expires_at">
+		</div>
+		<button type="submit">Add Member</button>
+	</form>
+</section>`
+}
+
+// renderCircleMemberListHTML is the member table, swapped on its own when filtering
+func renderCircleMemberListHTML(circle *models.Circle, members []models.CircleMember, canAdmin bool) string {
+	if len(members) == 0 {
+		return `<div id="circle-member-list"><p>No members found.</p></div>`
+	}
+
+	id := strconv.Itoa(circle.ID)
+	now := time.Now()
+	html := `<div id="circle-member-list">
+	<table>
+		<thead>
+			<tr><th>Username</th><th>Name</th><th>Comment</th><th>Added by</th><th>Added</th><th>Expires</th><th></th></tr>
+		</thead>
+		<tbody>`
+	for _, member := range members {
+		remove := ""
+		if canAdmin {
+			remove = `<button hx-delete="/api/circles/` + id + `/members/` + strconv.Itoa(member.AccountID) + `"
+						hx-target="#circle-members" hx-swap="outerHTML" hx-include="#member-filter"
+						hx-confirm="Remove ` + escapeHTML(member.Account.Username) + ` from ` + escapeHTML(circle.Name) + `?">Remove</button>`
+		}
+		html += `
+			<tr>
+				<td>` + escapeHTML(member.Account.Username) + `</td>
+				<td>` + escapeHTML(member.Account.Name.String) + `</td>
+				<td>` + escapeHTML(member.Comment.String) + `</td>
+				<td>` + escapeHTML(member.Issuer.Username) + `</td>
+				<td>` + member.CreatedAt.Format("2006-01-02 15:04") + `</td>
+				<td>` + renderMemberExpiry(member, now) + `</td>
+				<td>` + remove + `</td>
+			</tr>`
+	}
+	return html + `
+		</tbody>
+	</table>
+</div>`
+}
+
+// renderMemberExpiry shows when a membership ends, expired ones are removed by the expiry job shortly
+func renderMemberExpiry(member models.CircleMember, now time.Time) string {
+	switch {
+	case !member.ExpiresAt.Valid:
+		return "never"
+	case member.IsExpired(now):
+		return "expired " + member.ExpiresAt.Time.Local().Format("2006-01-02 15:04")
+	default:
+		return member.ExpiresAt.Time.Local().Format("2006-01-02 15:04")
+	}
+}
+
+// filterCircleMembers keeps the members whose username, name, comment or issuer contains filter
+func filterCircleMembers(members []models.CircleMember, filter string) []models.CircleMember {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	if filter == "" {
+		return members
+	}
+
+	var filtered []models.CircleMember
+	for _, member := range members {
+		fields := []string{member.Account.Username, member.Account.Name.String, member.Comment.String, member.Issuer.Username}
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), filter) {
+				filtered = append(filtered, member)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// EditCircleForm shows the circles section with the edit form for one circle
+func (h *Handler) EditCircleForm(c *gin.Context) {
+	circle, ok := h.adminCircleParam(c)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, circle, "")))
+}
+
+// CreateCircle creates a circle from the admin form
+func (h *Handler) CreateCircle(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle := circleFromForm(c)
+
+	// SELF_ADMIN circles start out with one member who can then add the others
+	initialMemberID := 0
+	if circle.ManagementStyle == models.ManagementStyleSelfAdmin {
+		username := strings.TrimSpace(c.PostForm("username"))
+		if username == "" {
+			username = user.Username
+		}
+		account, err := h.accountRepo.FindByUsername(username)
+		if err != nil {
+			h.circleFormError(c, circle, "No such account: "+username)
+			return
+		}
+		initialMemberID = account.ID
+	}
+
+	if err := h.circleRepo.Create(circle, initialMemberID, strings.TrimSpace(c.PostForm("comment")), user.ID); err != nil {
+		h.circleWriteFailed(c, circle, "create", err)
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("Circle '%s' (%d) created by %s", circle.Name, circle.ID, user.Username))
+	h.logEvent("circle", "created", user.ID, circle.Name, circle.ID)
+	notice := `<section aria-live="polite"><p>Circle "` + escapeHTML(circle.Name) + `" created.</p></section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, nil, notice)))
+}
+
+// UpdateCircle saves changes to a circle the user may administer
+func (h *Handler) UpdateCircle(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	existing, ok := h.adminCircleParam(c)
+	if !ok {
+		return
+	}
+
+	circle := circleFromForm(c)
+	circle.ID = existing.ID
+	if isBuiltinCircle(existing.Name) && circle.Name != existing.Name {
+		h.circleFormError(c, circle, `The "`+existing.Name+`" circle is used by p2k16 itself and can't be renamed.`)
+		return
+	}
+
+	if err := h.circleRepo.Update(circle, user.ID); err != nil {
+		h.circleWriteFailed(c, circle, "update", err)
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("Circle '%s' (%d) updated by %s", circle.Name, circle.ID, user.Username))
+	h.logEvent("circle", "updated", user.ID, circle.Name, circle.ID)
+	notice := `<section aria-live="polite"><p>Circle "` + escapeHTML(circle.Name) + `" saved.</p></section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, nil, notice)))
+}
+
+// DeleteCircle removes a circle, following the legacy remove_circle rules
+func (h *Handler) DeleteCircle(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.adminCircleParam(c)
+	if !ok {
+		return
+	}
+
+	notice := ""
+	if isBuiltinCircle(circle.Name) {
+		notice = `The "` + circle.Name + `" circle is used by p2k16 itself and can't be removed.`
+	} else if err := h.circleRepo.Delete(circle.ID, user.ID); err != nil {
+		if errors.Is(err, models.ErrCircleInUse) || errors.Is(err, models.ErrCircleNotEmpty) {
+			notice = "Can't remove " + circle.Name + ": " + err.Error() + "."
+		} else {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to remove circle %d: %v", circle.ID, err))
+			notice = "Failed to remove circle."
+		}
+	}
+	if notice != "" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, nil,
+			`<section aria-live="polite"><p>`+escapeHTML(notice)+`</p></section>`)))
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("Circle '%s' (%d) removed by %s", circle.Name, circle.ID, user.Username))
+	h.logEvent("circle", "removed", user.ID, circle.Name, circle.ID)
+	notice = `<section aria-live="polite"><p>Circle "` + escapeHTML(circle.Name) + `" removed.</p></section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, nil, notice)))
+}
+
+// adminCircleParam loads the circle in the :id parameter and checks that the current user
+// may administer it, like the legacy _assert_can_admin_circle. Writes the response if not.
+func (h *Handler) adminCircleParam(c *gin.Context) (*models.Circle, bool) {
+	user := middleware.GetCurrentUser(c)
+	circleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid circle id</p>`))
+		return nil, false
+	}
+
+	circle, err := h.circleRepo.FindByID(circleID)
+	if err != nil {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Circle not found</p>`))
+		return nil, false
+	}
+
+	canAdmin, err := h.circleRepo.CanAdminCircle(user.ID, circle.ID)
+	if err != nil || !canAdmin {
+		c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+			[]byte(`<p>You can't administer the `+escapeHTML(circle.Name)+` circle</p>`))
+		return nil, false
+	}
+
+	return circle, true
+}
+
+// circleFromForm reads the circle fields posted by the circle form
+func circleFromForm(c *gin.Context) *models.Circle {
+	circle := &models.Circle{
+		Name:                         strings.TrimSpace(c.PostForm("name")),
+		Description:                  strings.TrimSpace(c.PostForm("description")),
+		ManagementStyle:              c.PostForm("management_style"),
+		CommentRequiredForMembership: c.PostForm("comment_required_for_membership") != "",
+	}
+	if adminCircleID, err := strconv.Atoi(c.PostForm("admin_circle")); err == nil {
+		circle.AdminCircleID = sql.NullInt64{Int64: int64(adminCircleID), Valid: true}
+	}
+	return circle
+}
+
+// circleWriteFailed shows repository errors on the form, users can fix the invalid ones
+func (h *Handler) circleWriteFailed(c *gin.Context, circle *models.Circle, action string, err error) {
+	if errors.Is(err, models.ErrInvalidCircle) || errors.Is(err, models.ErrDuplicateCircle) {
+		h.circleFormError(c, circle, strings.TrimPrefix(err.Error(), models.ErrInvalidCircle.Error()+": "))
+		return
+	}
+	logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to %s circle '%s': %v", action, circle.Name, err))
+	h.circleFormError(c, circle, "Failed to "+action+" circle.")
+}
+
+// circleFormError shows the form again with the submitted values and a message
+func (h *Handler) circleFormError(c *gin.Context, circle *models.Circle, message string) {
+	logging.LogHandlerAction("VALIDATION ERROR", message)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCirclesSectionHTML(c, circle,
+		`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`)))
+}
+
+func isBuiltinCircle(name string) bool {
+	for _, builtin := range builtinCircles {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// renderCirclesSectionHTML lists all circles with a form below. form is nil for an empty
+// create form, a circle without ID to show submitted values again, or the circle to edit.
+func (h *Handler) renderCirclesSectionHTML(c *gin.Context, form *models.Circle, notice string) string {
+	circles, err := h.circleRepo.GetAll()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles: %v", err))
+	}
+
+	names := make(map[int64]string, len(circles))
+	for _, circle := range circles {
+		names[int64(circle.ID)] = circle.Name
+	}
+
+	html := `
+<section id="circles" aria-labelledby="circles-title">
+	<header><h2 id="circles-title">All circles</h2></header>` + notice
+
+	if len(circles) == 0 {
+		html += `
+	<p>No circles yet.</p>`
+	} else {
+		html += `
+	<table>
+		<thead>
+			<tr><th>Name</th><th>Description</th><th>Managed by</th><th>Comment required</th><th></th></tr>
+		</thead>
+		<tbody>`
+		for _, circle := range circles {
+			managedBy := "its members (SELF_ADMIN)"
+			if circle.ManagementStyle == models.ManagementStyleAdminCircle {
+				managedBy = escapeHTML(names[circle.AdminCircleID.Int64]) + " (ADMIN_CIRCLE)"
+			}
+			commentRequired := "no"
+			if circle.CommentRequiredForMembership {
+				commentRequired = "yes"
+			}
+			id := strconv.Itoa(circle.ID)
+			html += `
+			<tr>
+				<td><a href="/admin/circles/` + id + `">` + escapeHTML(circle.Name) + `</a></td>
+				<td>` + escapeHTML(circle.Description) + `</td>
+				<td>` + managedBy + `</td>
+				<td>` + commentRequired + `</td>
+				<td>
+					<button hx-get="/admin/circles/` + id + `/edit" hx-target="#circles" hx-swap="outerHTML">Edit</button>
+					<button hx-delete="/admin/circles/` + id + `" hx-target="#circles" hx-swap="outerHTML"
+						hx-confirm="Remove the ` + escapeHTML(circle.Name) + ` circle?">Remove</button>
+				</td>
+			</tr>`
+		}
+		html += `
+		</tbody>
+	</table>`
+	}
+
+	return html + renderCircleFormHTML(c, form, circles) + `
+</section>`
+}
+
+// renderCircleFormHTML is the create or edit form for a circle
+func renderCircleFormHTML(c *gin.Context, form *models.Circle, circles []models.Circle) string {
+	if form == nil {
+		form = &models.Circle{ManagementStyle: models.ManagementStyleAdminCircle}
+	}
+
+	title, action, submit := "New circle", "/admin/circles", "Create Circle"
+	if form.ID != 0 {
+		title, action, submit = "Edit "+escapeHTML(form.Name), "/admin/circles/"+strconv.Itoa(form.ID), "Save Circle"
+	}
+
+	adminCircleOptions := `<option value="">-</option>`
+	for _, circle := range circles {
+		if circle.ID == form.ID {
+			continue
+		}
+		selected := ""
+		if form.AdminCircleID.Valid && form.AdminCircleID.Int64 == int64(circle.ID) {
+			selected = " selected"
+		}
+		adminCircleOptions += `<option value="` + strconv.Itoa(circle.ID) + `"` + selected + `>` + escapeHTML(circle.Name) + `</option>`
+	}
+
+	styleOption := func(style string) string {
+		selected := ""
+		if form.ManagementStyle == style {
+			selected = " selected"
+		}
+		return `<option value="` + style + `"` + selected + `>` + style + `</option>`
+	}
+
+	commentChecked := ""
+	if form.CommentRequiredForMembership {
+		commentChecked = " checked"
+	}
+
+	html := `
+	<form hx-post="` + action + `" hx-target="#circles" hx-swap="outerHTML">
+		<h3>` + title + `</h3>
+		<div>
+			<label for="circle-name">Name</label>
+			<input type="text" id="circle-name" name="name" value="` + escapeHTML(form.Name) + `" maxlength="` + strconv.Itoa(models.CircleNameMaxLength) + `" required>
+		</div>
+		<div>
+			<label for="circle-description">Description</label>
+			<input type="text" id="circle-description" name="description" value="` + escapeHTML(form.Description) + `" maxlength="` + strconv.Itoa(models.CircleNameMaxLength) + `">
+		</div>
+		<div>
+			<label for="circle-management-style">Management style</label>
+			<select id="circle-management-style" name="management_style">
+				` + styleOption(models.ManagementStyleAdminCircle) + `
+				` + styleOption(models.ManagementStyleSelfAdmin) + `
+			</select>
+		</div>
+		<div>
+			<label for="circle-admin-circle">Admin circle (ADMIN_CIRCLE only)</label>
+			<select id="circle-admin-circle" name="admin_circle">` + adminCircleOptions + `</select>
+		</div>
+		<div>
+			<input type="checkbox" id="circle-comment-required" name="comment_required_for_membership" value="true"` + commentChecked + `>
+			<label for="circle-comment-required">Require a comment when adding members</label>
+		</div>`
+
+	if form.ID == 0 {
+		user := middleware.GetCurrentUser(c)
+		html += `
+		<fieldset>
+			<legend>Initial member (SELF_ADMIN only)</legend>
+			<div>
+				<label for="circle-username">Username</label>
+				<input type="text" id="circle-username" name="username" value="` + escapeHTML(user.Username) + `">
+			</div>
+			<div>
+				<label for="circle-comment">Comment</label>
+				<input type="text" id="circle-comment" name="comment">
+			</div>
+		</fieldset>`
+	}
+
+	html += `
+		<button type="submit">` + submit + `</button>`
+	if form.ID != 0 {
+		html += `
+		<button type="button" hx-get="/admin/circles" hx-select="#circles" hx-target="#circles" hx-swap="outerHTML">Cancel</button>`
+	}
+	return html + `
+	</form>`
+}
+
+// StartCircleMembershipExpiry removes expired circle memberships every interval and logs a
+// circle/member-expired event for each. Memberships stop counting when they expire, this only
+// cleans up and records it. Returns a function that stops the job.
+func (h *Handler) StartCircleMembershipExpiry(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stopCh := make(chan struct{})
+
+	go func() {
+		h.expireCircleMemberships()
+		for {
+			select {
+			case <-ticker.C:
+				h.expireCircleMemberships()
+			case <-stopCh:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(stopCh) }
+}
+
+// expireCircleMemberships runs one pass of the expiry job
+func (h *Handler) expireCircleMemberships() {
+	expired, err := h.circleRepo.DeleteExpiredMembers()
+	if err != nil {
+		logging.LogError("CIRCLE EXPIRY", fmt.Sprintf("Failed to remove expired circle memberships: %v", err))
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	systemID := 0
+	if system, err := h.accountRepo.FindByUsername(systemUsername); err == nil {
+		systemID = system.ID
+	}
+	circles := make(map[int]*models.Circle)
+	for _, member := range expired {
+		circle := circles[member.CircleID]
+		if circle == nil {
+			if circle, err = h.circleRepo.FindByID(member.CircleID); err != nil {
+				circle = &models.Circle{ID: member.CircleID}
+			}
+			circles[member.CircleID] = circle
+		}
+
+		// Without the system account the expiry is recorded as done by whoever added the member
+		actorID := systemID
+		if actorID == 0 {
+			actorID = member.IssuerID
+		}
+		h.logCircleMemberEvent("member-expired", actorID, circle, member.AccountID, member.Comment.String, member.ExpiresAt)
+	}
+	logging.LogInfo("CIRCLE EXPIRY", fmt.Sprintf("Removed %d expired circle memberships", len(expired)))
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// Circles lists the circles members can ask to join
+func (h *Handler) Circles(c *gin.Context) {
+	circles, err := h.circleRepo.GetAll()
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load circles: %v", err))
+	}
+
+	list := `<p>There are no circles.</p>`
+	if len(circles) > 0 {
+		list = `<ul>`
+		for _, circle := range circles {
+			list += `
+			<li><a href="/circles/` + strconv.Itoa(circle.ID) + `">` + escapeHTML(circle.Name) + `</a> ` + escapeHTML(circle.Description) + `</li>`
+		}
+		list += `
+		</ul>`
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Circles - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Circles") + `
+	<main>
+		<h1>Circles</h1>
+		<p>Circles give access to tools and rooms. Open a circle to ask its administrators to add you.</p>
+		` + list + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// Circle shows a circle to members, with a form to ask to join it. Those who may administer
+// the circle also get the queue of pending requests and the member list with add and remove
+// controls, since they may not be in the admin circle that can use the admin console.
+func (h *Handler) Circle(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+
+	adminLink := ""
+	if h.isAdmin(user) {
+		adminLink = `<p><a href="/admin/circles/` + strconv.Itoa(circle.ID) + `">Manage circle</a></p>`
+	}
+
+	members := ""
+	canAdmin, err := h.circleRepo.CanAdminCircle(user.ID, circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check admin rights on circle %d: %v", circle.ID, err))
+	}
+	if canAdmin {
+		members = h.renderCircleMembersSectionHTML(c, circle, "")
+	}
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Circles / ` + escapeHTML(circle.Name) + ` - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Circles / "+escapeHTML(circle.Name)) + `
+	<main>
+		<h1>` + escapeHTML(circle.Name) + `</h1>
+		<p>` + escapeHTML(circle.Description) + `</p>
+		` + h.renderCircleInfoHTML(circle) + `
+		<p><a href="/circles">All circles</a></p>
+		` + adminLink + `
+		` + h.renderCircleJoinSectionHTML(c, circle, "") + `
+		` + h.renderCircleRequestsSectionHTML(c, circle, "") + `
+		` + members + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// RequestCircleMembership asks the administrators of a circle to add the current user.
+// They are notified by email, the request waits in the queue on the circle page.
+func (h *Handler) RequestCircleMembership(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+
+	request, err := h.circleRepo.CreateMembershipRequest(circle.ID, user.ID, c.PostForm("motivation"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrMotivationRequired), errors.Is(err, models.ErrRequestPending),
+			errors.Is(err, models.ErrAlreadyMember):
+			h.circleJoinNotice(c, circle, "Can't ask to join "+circle.Name+": "+err.Error()+".")
+		default:
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to create request to join circle %d: %v", circle.ID, err))
+			h.circleJoinNotice(c, circle, "Failed to ask to join "+circle.Name+".")
+		}
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("%s asked to join circle '%s'", user.Username, circle.Name))
+	h.logCircleMemberEvent("membership-requested", user.ID, circle, user.ID, request.Motivation, sql.NullTime{})
+	h.notifyCircleAdmins(circle, user.Account, request.Motivation)
+
+	h.circleJoinNotice(c, circle, "Your request has been sent to the administrators of "+circle.Name+".")
+}
+
+// notifyCircleAdmins emails everyone who may approve a request. Failures are only logged,
+// the request is still in the queue on the circle page.
+func (h *Handler) notifyCircleAdmins(circle *models.Circle, requester *models.Account, motivation string) {
+	admins, err := h.circleRepo.GetAdmins(circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load administrators of circle %d: %v", circle.ID, err))
+		return
+	}
+	if len(admins) == 0 {
+		logging.LogWarning("CIRCLE", fmt.Sprintf("Circle '%s' has no administrators to notify", circle.Name))
+		return
+	}
+
+	circleURL := h.externalURL("/circles/" + strconv.Itoa(circle.ID))
+	for i := range admins {
+		if err := h.mailer.SendCircleMembershipRequest(&admins[i], requester, circle, motivation, circleURL); err != nil {
+			logging.LogError("MAIL ERROR", fmt.Sprintf("Failed to send circle membership request to %s: %v", admins[i].Email, err))
+		}
+	}
+}
+
+// ApproveCircleMembershipRequest adds the requesting member to the circle, with their
+// motivation as the membership comment
+func (h *Handler) ApproveCircleMembershipRequest(c *gin.Context) {
+	h.decideCircleMembershipRequest(c, models.RequestStatusApproved)
+}
+
+// RejectCircleMembershipRequest turns down a request to join a circle
+func (h *Handler) RejectCircleMembershipRequest(c *gin.Context) {
+	h.decideCircleMembershipRequest(c, models.RequestStatusRejected)
+}
+
+func (h *Handler) decideCircleMembershipRequest(c *gin.Context, status string) {
+	user := middleware.GetCurrentUser(c)
+	circle, ok := h.circleParam(c)
+	if !ok {
+		return
+	}
+	requestID, err := strconv.Atoi(c.Param("request"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid request id</p>`))
+		return
+	}
+
+	decide, action := h.circleRepo.ApproveMembershipRequest, "approve"
+	if status == models.RequestStatusRejected {
+		decide, action = h.circleRepo.RejectMembershipRequest, "reject"
+	}
+	request, err := decide(circle.ID, requestID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotCircleAdmin):
+			logging.LogWarning("CIRCLE", fmt.Sprintf("%s tried to %s a request to join circle '%s' without admin rights",
+				user.Username, action, circle.Name))
+			c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+				[]byte(`<p>You can't administer the `+escapeHTML(circle.Name)+` circle</p>`))
+		case errors.Is(err, sql.ErrNoRows):
+			h.circleRequestsNotice(c, circle, "No such request.")
+		case errors.Is(err, models.ErrRequestNotPending), errors.Is(err, models.ErrCommentRequired),
+			errors.Is(err, models.ErrAlreadyMember):
+			h.circleRequestsNotice(c, circle, "Can't "+action+" the request: "+err.Error()+".")
+		default:
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to %s request %d to join circle %d: %v", action, requestID, circle.ID, err))
+			h.circleRequestsNotice(c, circle, "Failed to "+action+" the request.")
+		}
+		return
+	}
+
+	username := strconv.Itoa(request.AccountID)
+	if account, err := h.accountRepo.FindByID(request.AccountID); err == nil {
+		username = account.Username
+	}
+
+	if status == models.RequestStatusApproved {
+		logging.LogSuccess("CIRCLE", fmt.Sprintf("%s added to circle '%s' by %s on request", username, circle.Name, user.Username))
+		h.logCircleMemberEvent("member-added", user.ID, circle, request.AccountID, request.Motivation, sql.NullTime{})
+		h.circleRequestsNotice(c, circle, username+" added to "+circle.Name+".")
+		return
+	}
+
+	logging.LogSuccess("CIRCLE", fmt.Sprintf("Request from %s to join circle '%s' rejected by %s", username, circle.Name, user.Username))
+	h.logCircleMemberEvent("request-rejected", user.ID, circle, request.AccountID, request.Motivation, sql.NullTime{})
+	h.circleRequestsNotice(c, circle, "Request from "+username+" rejected.")
+}
+
+// circleJoinNotice answers with the join section and a message
+func (h *Handler) circleJoinNotice(c *gin.Context, circle *models.Circle, message string) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCircleJoinSectionHTML(c, circle,
+		`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`)))
+}
+
+// circleRequestsNotice answers with the request queue and a message
+func (h *Handler) circleRequestsNotice(c *gin.Context, circle *models.Circle, message string) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderCircleRequestsSectionHTML(c, circle,
+		`<section aria-live="polite"><p>`+escapeHTML(message)+`</p></section>`)))
+}
+
+// renderCircleJoinSectionHTML shows the current user's membership, pending request or the form to ask to join
+func (h *Handler) renderCircleJoinSectionHTML(c *gin.Context, circle *models.Circle, notice string) string {
+	user := middleware.GetCurrentUser(c)
+	html := `
+<section id="circle-join" aria-labelledby="circle-join-title">
+	<header><h2 id="circle-join-title">Membership</h2></header>` + notice
+
+	isMember, err := h.circleRepo.IsAccountInCircle(user.ID, circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check membership of circle %d: %v", circle.ID, err))
+	}
+	if isMember {
+		return html + `
+	<p>You are a member of this circle.</p>
+</section>`
+	}
+
+	request, err := h.circleRepo.FindPendingRequest(circle.ID, user.ID)
+	if err == nil {
+		return html + `
+	<p>You asked to join on ` + request.CreatedAt.Format("2006-01-02") + `, waiting for an administrator:</p>
+	<blockquote>` + escapeHTML(request.Motivation) + `</blockquote>
+</section>`
+	}
+	if err != sql.ErrNoRows {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load request to join circle %d: %v", circle.ID, err))
+	}
+
+	return html + `
+	<form hx-post="/api/circles/` + strconv.Itoa(circle.ID) + `/requests" hx-target="#circle-join" hx-swap="outerHTML">
+		<div>
+			<label for="join-motivation">Why do you want to join? Mention courses taken or who trained you.</label>
+			<textarea id="join-motivation" name="motivation" rows="3" maxlength="500" required></textarea>
+		</div>
+		<button type="submit">Request to join</button>
+	</form>
+</section>`
+}
+
+// renderCircleRequestsSectionHTML is the queue of pending requests, only for those who may administer the circle
+func (h *Handler) renderCircleRequestsSectionHTML(c *gin.Context, circle *models.Circle, notice string) string {
+	user := middleware.GetCurrentUser(c)
+	canAdmin, err := h.circleRepo.CanAdminCircle(user.ID, circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check admin rights on circle %d: %v", circle.ID, err))
+	}
+	if !canAdmin {
+		return notice
+	}
+
+	requests, err := h.circleRepo.GetPendingRequests(circle.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load requests to join circle %d: %v", circle.ID, err))
+	}
+
+	html := `
+<section id="circle-requests" aria-labelledby="circle-requests-title">
+	<header><h2 id="circle-requests-title">Pending requests (` + strconv.Itoa(len(requests)) + `)</h2></header>` + notice
+	if len(requests) == 0 {
+		return html + `
+	<p>No one is waiting to join this circle.</p>
+</section>`
+	}
+
+	html += `
+	<table>
+		<thead>
+			<tr><th>Username</th><th>Name</th><th>Motivation</th><th>Requested</th><th>Actions</th></tr>
+		</thead>
+		<tbody>`
+	base := "/api/circles/" + strconv.Itoa(circle.ID) + "/requests/"
+	for _, request := range requests {
+		id := strconv.Itoa(request.ID)
+		html += `
+			<tr>
+				<td>` + escapeHTML(request.Account.Username) + `</td>
+				<td>` + escapeHTML(request.Account.Name.String) + `</td>
+				<td>` + escapeHTML(request.Motivation) + `</td>
+				<td>` + request.CreatedAt.Format("2006-01-02 15:04") + `</td>
+				<td>
+					<button hx-post="` + base + id + `/approve" hx-target="#circle-requests" hx-swap="outerHTML">Approve</button>
+					<button hx-post="` + base + id + `/reject" hx-target="#circle-requests" hx-swap="outerHTML"
+						hx-confirm="Reject the request from ` + escapeHTML(request.Account.Username) + `?">Reject</button>
+				</td>
+			</tr>`
+	}
+	return html + `
+		</tbody>
+	</table>
+</section>`
+}
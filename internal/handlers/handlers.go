@@ -5,9 +5,12 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/auth"
 	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/mail"
 	"github.com/helloellinor/p2k16/internal/middleware"
 	"github.com/helloellinor/p2k16/internal/models"
+	"github.com/helloellinor/p2k16/internal/mqtt"
 )
 
 type Handler struct {
@@ -17,9 +20,17 @@ type Handler struct {
 	toolRepo       *models.ToolRepository
 	eventRepo      *models.EventRepository
 	membershipRepo *models.MembershipRepository
+	apiTokenRepo   *models.ApiTokenRepository
+	sessionRepo    *models.SessionRepository
+	twoFactorRepo  *models.TwoFactorRepository
+	mailer         *mail.Mailer
+	loginThrottle  *auth.LoginThrottle
+	passwordPolicy auth.PasswordPolicy
+	mqttClient     mqtt.Client
+	publicURL      string
 }
 
-func NewHandler(accountRepo *models.AccountRepository, circleRepo *models.CircleRepository, badgeRepo *models.BadgeRepository, toolRepo *models.ToolRepository, eventRepo *models.EventRepository, membershipRepo *models.MembershipRepository) *Handler {
+func NewHandler(accountRepo *models.AccountRepository, circleRepo *models.CircleRepository, badgeRepo *models.BadgeRepository, toolRepo *models.ToolRepository, eventRepo *models.EventRepository, membershipRepo *models.MembershipRepository, apiTokenRepo *models.ApiTokenRepository, sessionRepo *models.SessionRepository, twoFactorRepo *models.TwoFactorRepository, mailer *mail.Mailer, loginThrottle *auth.LoginThrottle, passwordPolicy auth.PasswordPolicy, mqttClient mqtt.Client, publicURL string) *Handler {
 	return &Handler{
 		accountRepo:    accountRepo,
 		circleRepo:     circleRepo,
@@ -27,6 +38,14 @@ func NewHandler(accountRepo *models.AccountRepository, circleRepo *models.Circle
 		toolRepo:       toolRepo,
 		eventRepo:      eventRepo,
 		membershipRepo: membershipRepo,
+		apiTokenRepo:   apiTokenRepo,
+		sessionRepo:    sessionRepo,
+		twoFactorRepo:  twoFactorRepo,
+		mailer:         mailer,
+		loginThrottle:  loginThrottle,
+		passwordPolicy: passwordPolicy,
+		mqttClient:     mqttClient,
+		publicURL:      publicURL,
 	}
 }
 
@@ -35,6 +54,21 @@ func (h *Handler) GetAccountRepo() *models.AccountRepository {
 	return h.accountRepo
 }
 
+// GetCircleRepo returns the circle repository
+func (h *Handler) GetCircleRepo() *models.CircleRepository {
+	return h.circleRepo
+}
+
+// GetApiTokenRepo returns the API token repository
+func (h *Handler) GetApiTokenRepo() *models.ApiTokenRepository {
+	return h.apiTokenRepo
+}
+
+// GetTwoFactorRepo returns the two-factor repository
+func (h *Handler) GetTwoFactorRepo() *models.TwoFactorRepository {
+	return h.twoFactorRepo
+}
+
 // Home renders the front page
 func (h *Handler) Home(c *gin.Context) {
 	logging.LogHandlerAction("PAGE REQUEST", "Home page visited")
@@ -73,6 +107,7 @@ func (h *Handler) Home(c *gin.Context) {
 					</div>
 					<div class="card-body">
 						<form hx-post="/api/auth/login" hx-target="#login-result" method="post" action="/api/auth/login">
+							` + csrfFieldHTML(c) + `
 							<div class="mb-3">
 								<label for="username" class="form-label">Username</label>
 								<input type="text" class="form-control" id="username" name="username" required>
@@ -220,6 +255,6 @@ func (h *Handler) ProfileCardFront(c *gin.Context) {
 // ProfileCardBack returns the back (editing) of the membership card (requires auth)
 func (h *Handler) ProfileCardBack(c *gin.Context) {
 	user := middleware.GetCurrentUser(c)
-	html := h.renderProfileCardBackHTML(user)
+	html := h.renderProfileCardBackHTML(c, user)
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
 }
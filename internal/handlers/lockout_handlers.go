@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+)
+
+// AdminLockouts shows usernames and client IPs locked out after failed logins
+func (h *Handler) AdminLockouts(c *gin.Context) {
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Admin / Lockouts - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<script src="https://unpkg.com/htmx.org@1.9.10"></script>
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Admin / Lockouts") + `
+	<main>
+		<h1>Login Lockouts</h1>
+		<p>Usernames and addresses are locked out for a while after repeated failed logins. Unlock them here if a member is stuck.</p>
+		` + h.renderLockoutsSectionHTML("") + `
+	</main>
+</body>
+</html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// UnlockLogin clears the lockout for a username or client IP
+func (h *Handler) UnlockLogin(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	kind := c.PostForm("kind")
+	key := c.PostForm("key")
+
+	var found bool
+	switch kind {
+	case "account":
+		found = h.loginThrottle.Unlock(key)
+	case "ip":
+		found = h.loginThrottle.UnlockIP(key)
+	default:
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Unknown lockout kind</p>`))
+		return
+	}
+
+	notice := `<section aria-live="polite"><p>` + escapeHTML(key) + ` was not locked out.</p></section>`
+	if found {
+		logging.LogSuccess("LOGIN UNLOCK", fmt.Sprintf("%s %s unlocked by %s", kind, key, user.Username))
+		h.logAuthEvent("login-unlocked", user.ID, kind+":"+key, 0)
+		notice = `<section aria-live="polite"><p>` + escapeHTML(key) + ` unlocked.</p></section>`
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderLockoutsSectionHTML(notice)))
+}
+
+// renderLockoutsSectionHTML lists the current lockouts with unlock buttons
+func (h *Handler) renderLockoutsSectionHTML(notice string) string {
+	lockouts := h.loginThrottle.Lockouts()
+
+	html := `
+<section id="lockouts" aria-labelledby="lockouts-title">
+	<header><h2 id="lockouts-title">Current lockouts</h2></header>` + notice
+
+	if len(lockouts) == 0 {
+		return html + `
+	<p>Nobody is locked out.</p>
+</section>`
+	}
+
+	html += `
+	<table>
+		<thead>
+			<tr><th>Type</th><th>Username / IP</th><th>Failures</th><th>Last failure</th><th>Locked until</th><th></th></tr>
+		</thead>
+		<tbody>`
+	for _, lockout := range lockouts {
+		html += `
+			<tr>
+				<td>` + lockout.Kind + `</td>
+				<td>` + escapeHTML(lockout.Key) + `</td>
+				<td>` + fmt.Sprintf("%d", lockout.Failures) + `</td>
+				<td>` + lockout.LastFailure.Format("2006-01-02 15:04:05") + `</td>
+				<td>` + lockout.LockedUntil.Format("2006-01-02 15:04:05") + `</td>
+				<td>
+					<form hx-post="/admin/lockouts/unlock" hx-target="#lockouts" hx-swap="outerHTML">
+						<input type="hidden" name="kind" value="` + lockout.Kind + `">
+						<input type="hidden" name="key" value="` + escapeHTML(lockout.Key) + `">
+						<button type="submit">Unlock</button>
+					</form>
+				</td>
+			</tr>`
+	}
+	html += `
+		</tbody>
+	</table>
+</section>`
+	return html
+}
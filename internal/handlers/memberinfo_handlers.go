@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/auth"
+	"github.com/helloellinor/p2k16/internal/logging"
+)
+
+// MemberInfoCircle is the circle an account must be in to use /api/memberinfo
+const MemberInfoCircle = "api"
+
+// MemberInfo returns membership details for a username to external systems (legacy: api_blueprint.memberinfo).
+// The caller authenticates with HTTP Basic credentials of an account in the "api" circle.
+func (h *Handler) MemberInfo(c *gin.Context) {
+	apiUsername, apiPassword, ok := c.Request.BasicAuth()
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="p2k16"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	// Basic credentials are passwords too, so they get the same lockouts and timing as AuthLogin
+	clientIP := c.ClientIP()
+	if wait := h.loginThrottle.Check(apiUsername, clientIP); wait > 0 {
+		logging.LogWarning("MEMBERINFO", fmt.Sprintf("API user '%s' / IP %s locked for %s", apiUsername, clientIP, wait.Round(time.Second)))
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	apiAccount, err := h.accountRepo.FindByUsername(apiUsername)
+	if err != nil {
+		logging.LogError("MEMBERINFO", fmt.Sprintf("Unknown API user '%s'", apiUsername))
+		auth.CompareDummyPassword(apiPassword)
+		h.recordLoginFailure(apiUsername, clientIP, nil)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if !apiAccount.ValidatePassword(apiPassword) {
+		logging.LogError("MEMBERINFO", fmt.Sprintf("Bad credentials for API user '%s'", apiUsername))
+		h.recordLoginFailure(apiUsername, clientIP, apiAccount)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	h.loginThrottle.RecordSuccess(apiUsername)
+
+	inCircle, err := h.circleRepo.IsAccountInCircleByName(apiAccount.ID, MemberInfoCircle)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check circle membership: %v", err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !inCircle {
+		logging.LogError("MEMBERINFO", fmt.Sprintf("API user '%s' is not in the %s circle", apiUsername, MemberInfoCircle))
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	username := c.Query("username")
+	account, err := h.accountRepo.FindByUsername(username)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	payingMember, err := h.membershipRepo.IsAccountPayingMember(account.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check paying status for %s: %v", username, err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	monthCount, err := h.membershipRepo.GetMembershipMonthCount(account.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to count payments for %s: %v", username, err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	employment, err := h.membershipRepo.IsAccountCompanyEmployee(account.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check employment for %s: %v", username, err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := gin.H{
+		"username":      username,
+		"paying_member": payingMember,
+		"month_count":   monthCount,
+		"email":         account.Email,
+		"employment":    employment,
+	}
+
+	// Dates use the same format as Flask's jsonify so existing consumers keep parsing them
+	membership, err := h.membershipRepo.GetMembershipByAccount(account.ID)
+	switch {
+	case err == nil:
+		response["fee"] = membership.Fee
+		response["first_membership"] = membership.FirstMembership.UTC().Format(http.TimeFormat)
+		response["start_membership"] = membership.StartMembership.UTC().Format(http.TimeFormat)
+	case !errors.Is(err, sql.ErrNoRows):
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to get membership for %s: %v", username, err))
+	}
+
+	logging.LogSuccess("MEMBERINFO", fmt.Sprintf("API user '%s' looked up '%s'", apiUsername, username))
+	c.JSON(http.StatusOK, response)
+}
@@ -50,11 +50,8 @@ func (h *Handler) GetMembershipStatus(c *gin.Context) {
 			"<h3>Membership Details</h3>" +
 			"<p>Member since: " + membership.FirstMembership.Format("2006-01-02") + "</p>" +
 			"<p>Current membership start: " + membership.StartMembership.Format("2006-01-02") + "</p>" +
-			"<p>Monthly fee: " + fmt.Sprintf("%.2f NOK", float64(membership.Fee)/100) + "</p>"
-		if membership.MembershipNumber.Valid {
-			html += "<p><strong>Membership number:</strong> " + fmt.Sprintf("%d", membership.MembershipNumber.Int64) + "</p>"
-		}
-		html += "</section>"
+			"<p>Monthly fee: " + fmt.Sprintf("%.2f NOK", float64(membership.Fee)/100) + "</p>" +
+			"</section>"
 	}
 
 	html += "</div>" +
@@ -99,9 +96,6 @@ func (h *Handler) GetMembershipStatusAPI(c *gin.Context) {
 			"start_membership":  membership.StartMembership.Format("2006-01-02"),
 			"fee":               membership.Fee,
 		}
-		if membership.MembershipNumber.Valid {
-			membershipData["membership_number"] = membership.MembershipNumber.Int64
-		}
 		response["data"].(gin.H)["membership"] = membershipData
 	}
 
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// Open Badges 2.0 (https://www.imsglobal.org/sites/default/files/Badges/OBv2p0Final/index.html).
+// Awarded badges are published as hosted assertions, which verifiers check by fetching them from
+// here. Only members who opted in have their assertions published.
+
+const openBadgesContext = "https://w3id.org/openbadges/v2"
+
+// The space is the issuer of all badges, set from the OPEN_BADGES_ISSUER_* settings. Assertions
+// are hosted on PUBLIC_URL, which is allowed explicitly when the issuer URL is on another host.
+var (
+	OpenBadgesIssuerName  = "Bitraf"
+	OpenBadgesIssuerURL   = "https://bitraf.no"
+	OpenBadgesIssuerEmail = "post@bitraf.no"
+)
+
+// OpenBadgesIssuer is the Issuer profile of the space
+type OpenBadgesIssuer struct {
+	Context string `json:"@context"`
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Email   string `json:"email"`
+}
+
+// OpenBadgesBadgeClass describes a badge, derived from a badge description
+type OpenBadgesBadgeClass struct {
+	Context     string             `json:"@context"`
+	Type        string             `json:"type"`
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Image       string             `json:"image"`
+	Criteria    OpenBadgesCriteria `json:"criteria"`
+	Issuer      string             `json:"issuer"`
+}
+
+// OpenBadgesCriteria tells what it takes to earn a badge
+type OpenBadgesCriteria struct {
+	ID        string `json:"id,omitempty"`
+	Narrative string `json:"narrative"`
+}
+
+// OpenBadgesAssertion is an awarded badge. The recipient is identified by a salted hash of their email.
+type OpenBadgesAssertion struct {
+	Context      string                 `json:"@context"`
+	Type         string                 `json:"type"`
+	ID           string                 `json:"id"`
+	Recipient    OpenBadgesRecipient    `json:"recipient"`
+	Badge        string                 `json:"badge"`
+	Verification OpenBadgesVerification `json:"verification"`
+	IssuedOn     string                 `json:"issuedOn"`
+	Expires      string                 `json:"expires,omitempty"`
+}
+
+// OpenBadgesRecipient identifies who received an assertion
+type OpenBadgesRecipient struct {
+	Type     string `json:"type"`
+	Hashed   bool   `json:"hashed"`
+	Salt     string `json:"salt"`
+	Identity string `json:"identity"`
+}
+
+// OpenBadgesVerification tells verifiers how to check an assertion
+type OpenBadgesVerification struct {
+	Type           string   `json:"type"`
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+}
+
+// GetOpenBadgesIssuer serves the Issuer profile (GET /badges/assertions/issuer)
+func (h *Handler) GetOpenBadgesIssuer(c *gin.Context) {
+	c.JSON(http.StatusOK, OpenBadgesIssuer{
+		Context: openBadgesContext,
+		Type:    "Issuer",
+		ID:      h.externalURL("/badges/assertions/issuer"),
+		Name:    OpenBadgesIssuerName,
+		URL:     OpenBadgesIssuerURL,
+		Email:   OpenBadgesIssuerEmail,
+	})
+}
+
+// GetOpenBadgesClass serves the BadgeClass of a badge description (GET /badges/assertions/classes/:id)
+func (h *Handler) GetOpenBadgesClass(c *gin.Context) {
+	badgeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid badge id"})
+		return
+	}
+	desc, err := h.badgeRepo.FindBadgeDescriptionByID(badgeID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badge %d: %v", badgeID, err))
+		}
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Badge not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.openBadgesClass(desc))
+}
+
+// openBadgesClass converts a badge description to a BadgeClass
+func (h *Handler) openBadgesClass(desc *models.BadgeDescription) OpenBadgesBadgeClass {
+	criteria := OpenBadgesCriteria{Narrative: "Awarded by a member of " + OpenBadgesIssuerName + "."}
+	if desc.CertificationCircleID.Valid {
+		if circle, err := h.circleRepo.FindByID(int(desc.CertificationCircleID.Int64)); err == nil {
+			criteria.Narrative = "Awarded by the members of the " + circle.Name + " circle at " + OpenBadgesIssuerName + "."
+		}
+	}
+	if desc.Slug.Valid {
+		criteria.ID = h.externalURL("/badges/" + desc.Slug.String)
+	}
+
+	description := desc.Description.String
+	if description == "" {
+		description = desc.Title
+	}
+
+	return OpenBadgesBadgeClass{
+		Context:     openBadgesContext,
+		Type:        "BadgeClass",
+		ID:          h.externalURL("/badges/assertions/classes/" + strconv.Itoa(desc.ID)),
+		Name:        desc.Title,
+		Description: description,
+		Image:       h.openBadgesImage(desc),
+		Criteria:    criteria,
+		Issuer:      h.externalURL("/badges/assertions/issuer"),
+	}
+}
+
+// openBadgesImage is the icon of a badge, or for badges without one a generated image in its color
+func (h *Handler) openBadgesImage(desc *models.BadgeDescription) string {
+	if desc.Icon.Valid && models.IsValidBadgeIcon(desc.Icon.String) {
+		if strings.HasPrefix(desc.Icon.String, "/") {
+			return h.externalURL(desc.Icon.String)
+		}
+		return desc.Icon.String
+	}
+
+	color := "#6c757d"
+	if desc.Color.Valid && models.IsValidBadgeColor(desc.Color.String) {
+		color = desc.Color.String
+	}
+	initial := "?"
+	if title := strings.TrimSpace(desc.Title); title != "" {
+		initial = strings.ToUpper(string([]rune(title)[0]))
+	}
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256" viewBox="0 0 256 256">` +
+		`<circle cx="128" cy="128" r="120" fill="` + color + `"/>` +
+		`<text x="128" y="128" dy="0.35em" text-anchor="middle" font-family="sans-serif" font-size="128" fill="#fff">` +
+		escapeHTML(initial) + `</text></svg>`
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
+
+// GetOpenBadgesAssertion serves an awarded badge as a hosted assertion (GET /badges/assertions/:id).
+// Badges of members who haven't opted in are not found, revoked badges are gone.
+func (h *Handler) GetOpenBadgesAssertion(c *gin.Context) {
+	accountBadgeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid assertion id"})
+		return
+	}
+
+	badge, err := h.badgeRepo.FindAccountBadgeByID(accountBadgeID)
+	if err != nil && err != sql.ErrNoRows {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badge %d: %v", accountBadgeID, err))
+	}
+	publish := false
+	if badge != nil {
+		if publish, err = h.accountRepo.PublishesBadges(badge.AccountID); err != nil {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check if account %d publishes badges: %v", badge.AccountID, err))
+		}
+	}
+	if !publish {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Assertion not found"})
+		return
+	}
+
+	id := h.externalURL("/badges/assertions/" + strconv.Itoa(badge.ID))
+	if badge.IsRevoked() {
+		c.JSON(http.StatusGone, gin.H{"@context": openBadgesContext, "type": "Assertion", "id": id,
+			"revoked": true, "revocationReason": badge.RevokedReason.String})
+		return
+	}
+
+	// The salt only has to stay the same for the assertion, it doesn't need to be secret
+	salt := "p2k16-" + strconv.Itoa(badge.ID)
+	hash := sha256.Sum256([]byte(strings.ToLower(badge.Account.Email) + salt))
+	assertion := OpenBadgesAssertion{
+		Context: openBadgesContext,
+		Type:    "Assertion",
+		ID:      id,
+		Recipient: OpenBadgesRecipient{
+			Type:     "email",
+			Hashed:   true,
+			Salt:     salt,
+			Identity: "sha256$" + hex.EncodeToString(hash[:]),
+		},
+		Badge:        h.externalURL("/badges/assertions/classes/" + strconv.Itoa(badge.BadgeDescriptionID)),
+		Verification: h.openBadgesVerification(),
+		IssuedOn:     badge.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if badge.ExpiresAt.Valid {
+		assertion.Expires = badge.ExpiresAt.Time.UTC().Format(time.RFC3339)
+	}
+
+	c.JSON(http.StatusOK, assertion)
+}
+
+// openBadgesVerification is hosted verification. Verifiers only accept assertions on the issuer's
+// host unless other hosts are listed.
+func (h *Handler) openBadgesVerification() OpenBadgesVerification {
+	verification := OpenBadgesVerification{Type: "hosted"}
+	public, err := url.Parse(h.publicURL)
+	if err != nil {
+		logging.LogError("OPEN BADGES", fmt.Sprintf("Invalid PUBLIC_URL %q: %v", h.publicURL, err))
+		return verification
+	}
+	if issuer, err := url.Parse(OpenBadgesIssuerURL); err != nil || issuer.Host != public.Host {
+		verification.AllowedOrigins = []string{public.Host}
+	}
+	return verification
+}
+
+// GetOpenBadges returns the Open Badges section of the profile card (requires auth)
+func (h *Handler) GetOpenBadges(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderOpenBadgesSectionHTML(user.ID, "")))
+}
+
+// SetOpenBadges turns publishing the current user's badges on or off (API endpoint: POST /api/profile/open-badges)
+func (h *Handler) SetOpenBadges(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	publish := c.PostForm("publish") == "true"
+
+	notice := "Your badges are no longer published."
+	if publish {
+		notice = "Your badges are published."
+	}
+	if err := h.accountRepo.SetPublishBadges(user.ID, publish); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to set badge publishing for %s: %v", user.Username, err))
+		notice = "Failed to save the setting."
+	} else {
+		logging.LogSuccess("BADGE", fmt.Sprintf("Badge publishing set to %t by %s", publish, user.Username))
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderOpenBadgesSectionHTML(user.ID,
+		`<section aria-live="polite"><p>`+escapeHTML(notice)+`</p></section>`)))
+}
+
+// renderOpenBadgesSectionHTML shows the opt-in for publishing badges, and the assertion links when on
+func (h *Handler) renderOpenBadgesSectionHTML(accountID int, notice string) string {
+	publish, err := h.accountRepo.PublishesBadges(accountID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check if account %d publishes badges: %v", accountID, err))
+	}
+
+	html := `
+<section id="open-badges" aria-labelledby="open-badges-title">
+	<header><h2 id="open-badges-title">Share Badges</h2></header>
+	<p>Publish your badges as Open Badges, so you can show them on LinkedIn or your portfolio.
+	Anyone with the link to a badge can see that you hold it, and you are listed on the public badge pages.</p>` + notice
+	if !publish {
+		return html + `
+	<button hx-post="/api/profile/open-badges" hx-vals='{"publish":"true"}' hx-target="#open-badges" hx-swap="outerHTML">Publish my badges</button>
+</section>`
+	}
+
+	badges, err := h.badgeRepo.GetBadgesForAccount(accountID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to load badges of account %d: %v", accountID, err))
+	}
+	html += `
+	<ul>`
+	for _, badge := range badges {
+		link := h.externalURL("/badges/assertions/" + strconv.Itoa(badge.ID))
+		html += `
+		<li>` + escapeHTML(badge.BadgeDescription.Title) + `: <a href="` + escapeHTML(link) + `">` + escapeHTML(link) + `</a></li>`
+	}
+	return html + `
+	</ul>
+	<button hx-post="/api/profile/open-badges" hx-vals='{"publish":"false"}' hx-target="#open-badges" hx-swap="outerHTML">Stop publishing</button>
+</section>`
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// ForgotPassword shows the form for requesting a password reset email
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	logging.LogHandlerAction("PAGE REQUEST", "Forgot password page visited")
+
+	html := `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Forgot Password - P2K16</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <script src="https://unpkg.com/htmx.org@1.9.10"></script>
+    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Forgot Password") + `
+
+	<main class="container mt-4">
+		<div class="row justify-content-center">
+			<div class="col-md-6">
+				<div class="card">
+					<div class="card-header">
+						<h2 class="card-title mb-0">Reset Password</h2>
+					</div>
+					<div class="card-body">
+						<p>Enter your username or email and we will send you a link to set a new password.</p>
+						<form hx-post="/api/auth/start-reset-password" hx-target="#reset-result">
+							<div class="mb-3">
+								<label for="username" class="form-label">Username or email</label>
+								<input type="text" class="form-control" id="username" name="username" autocapitalize="off" required>
+							</div>
+							<div class="d-grid">
+								<button type="submit" class="btn btn-primary">Send reset email</button>
+							</div>
+						</form>
+						<div id="reset-result" class="mt-3" aria-live="polite"></div>
+					</div>
+				</div>
+			</div>
+		</div>
+    </main>
+    <script src="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/js/bootstrap.bundle.min.js"></script>
+</body>
+</html>`
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// StartResetPassword issues a reset token and emails the reset link (legacy: /service/start-reset-password)
+func (h *Handler) StartResetPassword(c *gin.Context) {
+	username := c.PostForm("username")
+	logging.LogHandlerAction("PASSWORD RESET", fmt.Sprintf("Reset requested for: %s", username))
+
+	// Always give the same answer so the form can't be used to probe for accounts
+	response := `<div class="alert alert-info">If we found your user in our systems we have sent an email to your registered email.</div>`
+
+	if username == "" {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Username or email is required</div>`))
+		return
+	}
+
+	account, err := h.accountRepo.FindByUsername(username)
+	if err != nil {
+		account, err = h.accountRepo.FindByEmail(username)
+	}
+	if err != nil {
+		logging.LogHandlerAction("PASSWORD RESET", fmt.Sprintf("Could not find account by username or email: %s", username))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(response))
+		return
+	}
+
+	token, err := h.accountRepo.CreateResetToken(account.ID)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to create reset token for %s: %v", account.Username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Failed to start password reset. Please try again.</div>`))
+		return
+	}
+
+	// A failed email gets the same answer too, an error would tell that the account exists
+	resetURL := h.externalURL("/reset-password-form?reset_token=" + url.QueryEscape(token))
+	if err := h.mailer.SendPasswordRecovery(account, resetURL); err != nil {
+		logging.LogError("MAIL ERROR", fmt.Sprintf("Failed to send password recovery email to %s: %v", account.Email, err))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(response))
+		return
+	}
+
+	logging.LogSuccess("PASSWORD RESET", fmt.Sprintf("Reset email sent for user: %s", account.Username))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(response))
+}
+
+// ResetPasswordForm shows the set new password form for a valid reset token
+func (h *Handler) ResetPasswordForm(c *gin.Context) {
+	resetToken := c.Query("reset_token")
+
+	account, err := h.accountRepo.FindByResetToken(resetToken)
+	if resetToken == "" || err != nil {
+		logging.LogHandlerAction("PASSWORD RESET", "Invalid or expired reset token")
+		c.Redirect(http.StatusFound, "/login?show_message=recovery-invalid-request")
+		return
+	}
+
+	page := `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Set New Password - P2K16</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <script src="https://unpkg.com/htmx.org@1.9.10"></script>
+    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Set New Password") + `
+
+	<main class="container mt-4">
+		<div class="row justify-content-center">
+			<div class="col-md-6">
+				<div class="card">
+					<div class="card-header">
+						<h2 class="card-title mb-0">Set new password</h2>
+					</div>
+					<div class="card-body">
+						<form hx-post="/set-new-password" hx-target="#reset-result" method="post" action="/set-new-password">
+							` + csrfFieldHTML(c) + `
+							<div class="mb-3">
+								<label class="form-label">Username</label>
+								<p><strong>` + escapeHTML(account.Username) + `</strong></p>
+							</div>
+							<div class="mb-3">
+								<label for="password" class="form-label">New password</label>
+								<input type="password" class="form-control" id="password" name="password" required>
+							</div>
+							<div class="mb-3">
+								<label for="confirmPassword" class="form-label">Confirm new password</label>
+								<input type="password" class="form-control" id="confirmPassword" name="confirmPassword" required>
+							</div>
+							<input type="hidden" name="reset_token" value="` + escapeHTML(resetToken) + `">
+							<div class="d-grid">
+								<button type="submit" class="btn btn-primary">Set new password</button>
+							</div>
+						</form>
+						<div id="reset-result" class="mt-3" aria-live="polite"></div>
+					</div>
+				</div>
+			</div>
+		</div>
+    </main>
+    <script src="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/js/bootstrap.bundle.min.js"></script>
+</body>
+</html>`
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// SetNewPassword validates the reset token, sets the new password and clears the token
+func (h *Handler) SetNewPassword(c *gin.Context) {
+	resetToken := c.PostForm("reset_token")
+	password := c.PostForm("password")
+	confirmPassword := c.PostForm("confirmPassword")
+
+	account, err := h.accountRepo.FindByResetToken(resetToken)
+	if resetToken == "" || err != nil {
+		logging.LogHandlerAction("PASSWORD RESET", "Invalid or expired reset token on submit")
+		redirectTo(c, "/login?show_message=recovery-invalid-request")
+		return
+	}
+
+	if confirmPassword != "" && password != confirmPassword {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Passwords do not match</div>`))
+		return
+	}
+
+	if msg := h.passwordPolicy.Validate(password, account.Username); msg != "" {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">`+msg+`</div>`))
+		return
+	}
+
+	hashed, err := models.HashPassword(password)
+	if err != nil {
+		logging.LogError("HASH ERROR", fmt.Sprintf("Failed to hash new password: %v", err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Failed to set new password</div>`))
+		return
+	}
+
+	// UpdatePassword also clears the reset token so the link can only be used once
+	if err := h.accountRepo.UpdatePassword(account.ID, hashed); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to save new password: %v", err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Failed to set new password</div>`))
+		return
+	}
+
+	logging.LogSuccess("PASSWORD RESET", fmt.Sprintf("Password reset for user: %s", account.Username))
+	redirectTo(c, "/login?show_message=password-reset")
+}
+
+// redirectTo redirects both regular and HTMX requests
+func redirectTo(c *gin.Context, location string) {
+	if IsHTMXRequest(c) {
+		SetHTMXRedirect(c, location)
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Redirect(http.StatusFound, location)
+}
+
+// externalURL builds an absolute URL for links that leave the site, e.g. in emails. It uses the
+// configured PUBLIC_URL because the Host header is chosen by the client.
+func (h *Handler) externalURL(path string) string {
+	return strings.TrimRight(h.publicURL, "/") + path
+}
@@ -34,13 +34,6 @@ func (h *Handler) ChangePassword(c *gin.Context) {
 		return
 	}
 
-	if len(newPassword) < 6 {
-		logging.LogHandlerAction("VALIDATION ERROR", "Password too short")
-		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
-			[]byte(`<div class="p2k16-alert p2k16-alert--danger">Password must be at least 6 characters long</div>`))
-		return
-	}
-
 	logging.LogHandlerAction("DATABASE OPERATION", "Fetching current account for password verification")
 	// Get current account
 	account, err := h.accountRepo.FindByID(user.ID)
@@ -61,6 +54,13 @@ func (h *Handler) ChangePassword(c *gin.Context) {
 
 	logging.LogHandlerAction("PASSWORD VALIDATION", "Current password verified successfully")
 
+	if msg := h.passwordPolicy.Validate(newPassword, account.Username); msg != "" {
+		logging.LogHandlerAction("VALIDATION ERROR", msg)
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<div class="p2k16-alert p2k16-alert--danger">`+msg+`</div>`))
+		return
+	}
+
 	// Update password
 	if err := account.SetPassword(newPassword); err != nil {
 		logging.LogError("HASH ERROR", fmt.Sprintf("Failed to hash new password: %v", err))
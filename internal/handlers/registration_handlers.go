@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// usernamePattern matches the characters the legacy register_account allows
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9@._+-]+$`)
+
+// Register shows the account registration page (legacy: /service/register-account)
+func (h *Handler) Register(c *gin.Context) {
+	logging.LogHandlerAction("PAGE REQUEST", "Registration page visited")
+
+	page := `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Register - P2K16</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <script src="https://unpkg.com/htmx.org@1.9.10"></script>
+    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+	` + h.renderNavbarWithTrail(c, "Register") + `
+
+	<main class="container mt-4">
+		<div class="row justify-content-center">
+			<div class="col-md-6">
+				<div class="card">
+					<div class="card-header">
+						<h2 class="card-title mb-0">Create a Bitraf account</h2>
+					</div>
+					<div class="card-body">
+						<form hx-post="/api/auth/register" hx-target="#register-result" method="post" action="/api/auth/register">
+							` + csrfFieldHTML(c) + `
+							<div class="mb-3">
+								<label for="username" class="form-label">Username</label>
+								<input type="text" class="form-control" id="username" name="username" autocapitalize="off" required
+									hx-get="/api/auth/check-username" hx-trigger="change, keyup delay:500ms" hx-target="#username-check">
+								<div id="username-check" class="form-text">Letters, digits and @ . _ + - only</div>
+							</div>
+							<div class="mb-3">
+								<label for="email" class="form-label">Email</label>
+								<input type="email" class="form-control" id="email" name="email" required
+									hx-get="/api/auth/check-email" hx-trigger="change" hx-target="#email-check">
+								<div id="email-check" class="form-text"></div>
+							</div>
+							<div class="mb-3">
+								<label for="name" class="form-label">Full name</label>
+								<input type="text" class="form-control" id="name" name="name" required>
+							</div>
+							<div class="mb-3">
+								<label for="phone" class="form-label">Phone (optional)</label>
+								<input type="tel" class="form-control" id="phone" name="phone">
+							</div>
+							<div class="mb-3">
+								<label for="password" class="form-label">Password</label>
+								<input type="password" class="form-control" id="password" name="password" required>
+							</div>
+							<div class="mb-3">
+								<label for="confirmPassword" class="form-label">Confirm password</label>
+								<input type="password" class="form-control" id="confirmPassword" name="confirmPassword" required>
+							</div>
+							<div class="d-grid">
+								<button type="submit" class="btn btn-primary">Register</button>
+							</div>
+						</form>
+						<div id="register-result" class="mt-3" aria-live="polite"></div>
+						<p class="mt-3 mb-0">Already have an account? <a href="/login">Log in</a></p>
+					</div>
+				</div>
+			</div>
+		</div>
+    </main>
+    <script src="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/js/bootstrap.bundle.min.js"></script>
+</body>
+</html>`
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// RegisterAccount validates the registration form and creates the account
+func (h *Handler) RegisterAccount(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	email := strings.TrimSpace(c.PostForm("email"))
+	name := strings.TrimSpace(c.PostForm("name"))
+	phone := strings.TrimSpace(c.PostForm("phone"))
+	password := c.PostForm("password")
+	confirmPassword := c.PostForm("confirmPassword")
+
+	logging.LogHandlerAction("REGISTRATION", fmt.Sprintf("Registration attempt for username: %s", username))
+
+	if msg := validateUsername(username); msg != "" {
+		registrationError(c, msg)
+		return
+	}
+	if email == "" {
+		registrationError(c, "Email is required")
+		return
+	}
+	if _, err := netmail.ParseAddress(email); err != nil {
+		registrationError(c, "Email address is not valid")
+		return
+	}
+	if name == "" {
+		registrationError(c, "Name cannot be empty")
+		return
+	}
+	if password != confirmPassword {
+		registrationError(c, "Passwords do not match")
+		return
+	}
+	if msg := h.passwordPolicy.Validate(password, username); msg != "" {
+		registrationError(c, msg)
+		return
+	}
+
+	if _, err := h.accountRepo.FindByUsername(username); err == nil {
+		registrationError(c, "Username is taken")
+		return
+	}
+	if _, err := h.accountRepo.FindByEmail(email); err == nil {
+		registrationError(c, "Email is already registered")
+		return
+	}
+
+	hashed, err := models.HashPassword(password)
+	if err != nil {
+		logging.LogError("HASH ERROR", fmt.Sprintf("Failed to hash password: %v", err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Failed to create account</div>`))
+		return
+	}
+
+	account, err := h.accountRepo.Create(username, email, name, phone, hashed)
+	if errors.Is(err, models.ErrDuplicateAccount) {
+		registrationError(c, "Username or email is already registered")
+		return
+	}
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to create account %s: %v", username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">Failed to create account</div>`))
+		return
+	}
+
+	logging.LogSuccess("REGISTRATION", fmt.Sprintf("New account: %s/%d", account.Username, account.ID))
+
+	// The account exists at this point, a failing welcome email should not fail the registration
+	if err := h.mailer.SendNewMember(account); err != nil {
+		logging.LogError("MAIL ERROR", fmt.Sprintf("Failed to send welcome email to %s: %v", account.Email, err))
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8",
+		[]byte(`<div class="alert alert-success">Welcome, `+escapeHTML(account.Username)+`! Your account has been created. You can now <a href="/login">log in</a>.</div>`))
+}
+
+// CheckUsername gives inline feedback on the registration form
+func (h *Handler) CheckUsername(c *gin.Context) {
+	username := strings.TrimSpace(c.Query("username"))
+	if username == "" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`Letters, digits and @ . _ + - only`))
+		return
+	}
+	if msg := validateUsername(username); msg != "" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`<span class="text-danger">`+msg+`</span>`))
+		return
+	}
+	if _, err := h.accountRepo.FindByUsername(username); err == nil {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`<span class="text-danger">Username is taken</span>`))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`<span class="text-success">Username is available</span>`))
+}
+
+// CheckEmail gives inline feedback on the registration form
+func (h *Handler) CheckEmail(c *gin.Context) {
+	email := strings.TrimSpace(c.Query("email"))
+	if email == "" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(``))
+		return
+	}
+	if _, err := h.accountRepo.FindByEmail(email); err == nil {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`<span class="text-danger">Email is already registered</span>`))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(``))
+}
+
+// validateUsername applies the legacy username rules, returning a user facing message if invalid
+func validateUsername(username string) string {
+	if username == "" {
+		return "Username is required"
+	}
+	if strings.Contains(username, " ") {
+		return "Username cannot contain spaces"
+	}
+	if len(username) > 50 {
+		return "Username cannot be longer than 50 characters"
+	}
+	if !usernamePattern.MatchString(username) {
+		return "Username can only contain a-z, 0-9, @, ., _, + and -."
+	}
+	return ""
+}
+
+func registrationError(c *gin.Context, message string) {
+	logging.LogHandlerAction("VALIDATION ERROR", message)
+	c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+		[]byte(`<div class="alert alert-danger">`+escapeHTML(message)+`</div>`))
+}
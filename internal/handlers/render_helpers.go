@@ -2,17 +2,44 @@ package handlers
 
 import (
 	"fmt"
-	"strconv"
+	"html"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/helloellinor/p2k16/internal/middleware"
 )
 
+// escapeHTML escapes user supplied text before it is put into markup
+func escapeHTML(s string) string {
+	return html.EscapeString(s)
+}
+
+// isAdmin reports whether the user is in the admin circle, used to show admin links
+func (h *Handler) isAdmin(user *middleware.AuthenticatedUser) bool {
+	if user == nil || h.circleRepo == nil {
+		return false
+	}
+	isAdmin, err := h.circleRepo.IsAccountInCircleByName(user.ID, middleware.AdminCircle)
+	return err == nil && isAdmin
+}
+
+// csrfHeadersHTML makes every HTMX request from the page send the CSRF token. It sets hx-headers
+// on <body> so forms swapped in later inherit it too. Part of both navbars, so all pages get it.
+func csrfHeadersHTML(c *gin.Context) string {
+	return `
+<script>document.body.setAttribute('hx-headers', '{"` + middleware.CSRFHeaderName + `": "` + middleware.CSRFToken(c) + `"}');</script>`
+}
+
+// csrfFieldHTML is the hidden CSRF field for forms that can also be submitted without HTMX
+func csrfFieldHTML(c *gin.Context) string {
+	return `<input type="hidden" name="` + middleware.CSRFFormField + `" value="` + middleware.CSRFToken(c) + `">`
+}
+
 // renderNavbar returns a Bootstrap navbar based on auth state
 func (h *Handler) renderNavbar(c *gin.Context) string {
 	user := middleware.GetCurrentUser(c)
 
-	html := `
+	html := csrfHeadersHTML(c) + `
 <nav class="navbar navbar-expand-lg navbar-dark bg-primary">
 	<div class="container">
 		<a class="navbar-brand fw-bold" href="/">P2K16</a>
@@ -32,9 +59,15 @@ func (h *Handler) renderNavbar(c *gin.Context) string {
 				<li class="nav-item">
 					<a class="nav-link" href="/profile">Profile</a>
 				</li>
+				<li class="nav-item">
+					<a class="nav-link" href="/circles">Circles</a>
+				</li>`
+		if h.isAdmin(user) {
+			html += `
 				<li class="nav-item">
 					<a class="nav-link" href="/admin">Admin</a>
 				</li>`
+		}
 	}
 
 	html += `
@@ -52,6 +85,7 @@ func (h *Handler) renderNavbar(c *gin.Context) string {
 				</li>
 				<li class="nav-item">
 					<form method="post" action="/logout" class="d-inline">
+						` + csrfFieldHTML(c) + `
 						<button type="submit" class="btn btn-outline-light btn-sm">Logout</button>
 					</form>`
 	}
@@ -70,7 +104,7 @@ func (h *Handler) renderNavbar(c *gin.Context) string {
 func (h *Handler) renderNavbarWithTrail(c *gin.Context, trail string) string {
 	user := middleware.GetCurrentUser(c)
 
-	html := `
+	html := csrfHeadersHTML(c) + `
 <nav class="navbar navbar-expand-lg navbar-dark bg-primary">
 	<div class="container">
 		<a class="navbar-brand fw-bold" href="/">P2K16</a>
@@ -90,9 +124,15 @@ func (h *Handler) renderNavbarWithTrail(c *gin.Context, trail string) string {
 				<li class="nav-item">
 					<a class="nav-link" href="/profile">Profile</a>
 				</li>
+				<li class="nav-item">
+					<a class="nav-link" href="/circles">Circles</a>
+				</li>`
+		if h.isAdmin(user) {
+			html += `
 				<li class="nav-item">
 					<a class="nav-link" href="/admin">Admin</a>
 				</li>`
+		}
 	}
 
 	html += `
@@ -110,6 +150,7 @@ func (h *Handler) renderNavbarWithTrail(c *gin.Context, trail string) string {
 				</li>
 				<li class="nav-item">
 					<form method="post" action="/logout" class="d-inline">
+						` + csrfFieldHTML(c) + `
 						<button type="submit" class="btn btn-outline-light btn-sm">Logout</button>
 					</form>`
 	}
@@ -149,6 +190,9 @@ func (h *Handler) renderNavbarWithTrail(c *gin.Context, trail string) string {
 			} else if trail == "Admin / Circles" {
 				html += `<li class="breadcrumb-item"><a href="/admin">Admin</a></li>
 						<li class="breadcrumb-item active" aria-current="page">Circles</li>`
+			} else if trail == "Admin / Badges" {
+				html += `<li class="breadcrumb-item"><a href="/admin">Admin</a></li>
+						<li class="breadcrumb-item active" aria-current="page">Badges</li>`
 			} else if trail == "Admin / Logs" {
 				html += `<li class="breadcrumb-item"><a href="/admin">Admin</a></li>
 						<li class="breadcrumb-item active" aria-current="page">Logs</li>`
@@ -188,15 +232,20 @@ func (h *Handler) renderUserBadgesSectionHTML(accountID int) string {
 <section id="user-badges" aria-labelledby="user-badges-title">
 	<h2 id="user-badges-title">Your Badges</h2>
 		<ul>`
+	now := time.Now()
 	for _, badge := range badges {
 		html += `
-			<li>
-				<span>` + badge.BadgeDescription.Title + `</span>
-				<button 
-					hx-post="/api/badges/remove" 
-					hx-vals='{"account_badge_id":"` + strconv.Itoa(badge.ID) + `"}'
-					hx-target="#badge-feedback"
-					hx-swap="innerHTML">Remove</button>
+			<li` + expiredBadgeStyle(&badge, now) + `>
+				` + renderBadgeLinkHTML(badge.BadgeDescription) + renderBadgeExpiryHTML(&badge, now)
+		// Badges anyone can award can be renewed by their holder, others by a certifier
+		if badge.ExpiresAt.Valid && !badge.BadgeDescription.CertificationCircleID.Valid {
+			html += renderRenewBadgeFormHTML(&badge, "#badge-feedback", `hx-swap="innerHTML"`)
+		}
+		// Self-awarded badges can be revoked here, others by their awarder or a certifier
+		if badge.AwardedByID.Int64 == int64(accountID) {
+			html += renderRevokeBadgeFormHTML(&badge, "#badge-feedback", `hx-swap="innerHTML"`)
+		}
+		html += `
 			</li>`
 	}
 	html += `
@@ -218,8 +267,10 @@ func (h *Handler) renderUserBadgesListReadOnly(accountID int) string {
 		html += `<p>No badges yet.</p>`
 	} else {
 		html += `<ul>`
+		now := time.Now()
 		for _, badge := range badges {
-			html += `<li><span>` + badge.BadgeDescription.Title + `</span></li>`
+			html += `<li` + expiredBadgeStyle(&badge, now) + `>` + renderBadgeLinkHTML(badge.BadgeDescription) +
+				renderBadgeExpiryHTML(&badge, now) + `</li>`
 		}
 		html += `</ul>`
 		html += `<p>You have ` + fmt.Sprintf("%d", len(badges)) + ` badge(s).</p>`
@@ -228,6 +279,27 @@ func (h *Handler) renderUserBadgesListReadOnly(accountID int) string {
 	return html
 }
 
+// renderBadgeHistoryHTML lists revoked badges with who revoked them and why
+func (h *Handler) renderBadgeHistoryHTML(accountID int) string {
+	history, _ := h.badgeRepo.GetBadgeHistoryForAccount(accountID)
+	items := ""
+	for _, badge := range history {
+		if !badge.IsRevoked() {
+			continue
+		}
+		items += `<li><s>` + escapeHTML(badge.BadgeDescription.Title) + `</s>, awarded by ` + escapeHTML(badge.AwardedBy.Username) +
+			` on ` + badge.CreatedAt.Format("2006-01-02") + `, revoked by ` + escapeHTML(badge.RevokedBy.Username) +
+			` on ` + badge.RevokedAt.Time.Format("2006-01-02") + `: ` + escapeHTML(badge.RevokedReason.String) + `</li>`
+	}
+	if items == "" {
+		return ""
+	}
+	return `<section aria-labelledby="badge-history-title">
+		<h2 id="badge-history-title">Revoked badges</h2>
+		<ul>` + items + `</ul>
+	</section>`
+}
+
 // renderProfileCardFrontHTML composes the front of the membership card
 func (h *Handler) renderProfileCardFrontHTML(user *middleware.AuthenticatedUser) string {
 	info := `<section aria-labelledby="info-title"><h2 id="info-title">Member</h2>` +
@@ -241,7 +313,7 @@ func (h *Handler) renderProfileCardFrontHTML(user *middleware.AuthenticatedUser)
 	}
 	info += `</section>`
 
-	badges := h.renderUserBadgesListReadOnly(user.ID)
+	badges := h.renderUserBadgesListReadOnly(user.ID) + h.renderBadgeHistoryHTML(user.ID)
 
 	html := `<div>` +
 		`<div><button hx-get="/api/profile/card/back" hx-target="#membership-card" hx-swap="innerHTML" aria-label="Edit membership card">Edit</button></div>` +
@@ -250,7 +322,7 @@ func (h *Handler) renderProfileCardFrontHTML(user *middleware.AuthenticatedUser)
 }
 
 // renderProfileCardBackHTML composes the back of the membership card (editing)
-func (h *Handler) renderProfileCardBackHTML(user *middleware.AuthenticatedUser) string {
+func (h *Handler) renderProfileCardBackHTML(c *gin.Context, user *middleware.AuthenticatedUser) string {
 	// Change Password form
 	changePassword := `
 <section>
@@ -305,8 +377,20 @@ func (h *Handler) renderProfileCardBackHTML(user *middleware.AuthenticatedUser)
 	// Editable badges section
 	badges := h.renderUserBadgesSectionHTML(user.ID)
 
+	// Publishing badges as Open Badges
+	openBadges := h.renderOpenBadgesSectionHTML(user.ID, "")
+
+	// Personal API tokens
+	apiTokens := h.renderApiTokensSectionHTML(user.ID, "")
+
+	// Two-factor authentication
+	twoFactor := h.renderTwoFactorSectionHTML(user.ID, "")
+
+	// Logged in browsers
+	activeSessions := h.renderSessionsSectionHTML(c, user.ID, "")
+
 	html := `<div>` +
 		`<div><button hx-get="/api/profile/card/front" hx-target="#membership-card" hx-swap="innerHTML" aria-label="Done editing">Done</button></div>` +
-		changePassword + details + badges + `</div>`
+		changePassword + twoFactor + details + badges + openBadges + apiTokens + activeSessions + `</div>`
 	return html
 }
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+)
+
+// GetSessions returns the active sessions section of the profile card (requires auth)
+func (h *Handler) GetSessions(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderSessionsSectionHTML(c, user.ID, "")))
+}
+
+// RevokeSession logs out one of the current user's other sessions
+func (h *Handler) RevokeSession(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid session id</p>`))
+		return
+	}
+
+	if sessionID == currentSessionID(c) {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8",
+			[]byte(`<p>Use Logout to end the current session</p>`))
+		return
+	}
+
+	if err := h.sessionRepo.Revoke(sessionID, user.ID); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to revoke session %d: %v", sessionID, err))
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to revoke session</p>`))
+		return
+	}
+
+	logging.LogSuccess("SESSION", fmt.Sprintf("Session %d revoked by %s", sessionID, user.Username))
+	h.logAuthEvent("sessions-revoked", user.ID, user.Username, 1)
+	notice := `<section aria-live="polite"><p>Session logged out.</p></section>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderSessionsSectionHTML(c, user.ID, notice)))
+}
+
+// RevokeOtherSessions logs the current user out everywhere except this browser
+func (h *Handler) RevokeOtherSessions(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+
+	count, err := h.sessionRepo.RevokeAllForAccount(user.ID, currentSessionID(c))
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to revoke sessions for %s: %v", user.Username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to log out other sessions</p>`))
+		return
+	}
+
+	logging.LogSuccess("SESSION", fmt.Sprintf("%d other sessions revoked by %s", count, user.Username))
+	if count > 0 {
+		h.logAuthEvent("sessions-revoked", user.ID, user.Username, int(count))
+	}
+	notice := fmt.Sprintf(`<section aria-live="polite"><p>Logged out %d other session(s).</p></section>`, count)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderSessionsSectionHTML(c, user.ID, notice)))
+}
+
+// RevokeAccountSessions logs an account out everywhere (admin only, API endpoint: POST /api/accounts/:id/sessions/revoke)
+func (h *Handler) RevokeAccountSessions(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "Invalid account ID"})
+		return
+	}
+
+	account, err := h.accountRepo.FindByID(accountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "Account not found"})
+		return
+	}
+
+	count, err := h.sessionRepo.RevokeAllForAccount(account.ID, 0)
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to revoke sessions for %s: %v", account.Username, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "Failed to revoke sessions"})
+		return
+	}
+
+	logging.LogSuccess("SESSION", fmt.Sprintf("All %d sessions of %s revoked by %s", count, account.Username, user.Username))
+	h.logAuthEvent("sessions-revoked", user.ID, account.Username, int(count))
+
+	if IsHTMXRequest(c) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8",
+			[]byte(fmt.Sprintf(`<div class="alert alert-success">Logged %s out of %d session(s).</div>`, escapeHTML(account.Username), count)))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "revoked": count})
+}
+
+// renderSessionsSectionHTML lists the account's active sessions, marking the current one
+func (h *Handler) renderSessionsSectionHTML(c *gin.Context, accountID int, notice string) string {
+	activeSessions, _ := h.sessionRepo.GetActiveForAccount(accountID)
+	currentID := currentSessionID(c)
+
+	html := `
+<section id="sessions" aria-labelledby="sessions-title">
+	<header><h2 id="sessions-title">Active Sessions</h2></header>
+	<p>Browsers where you are logged in. Log out any you don't recognize.</p>` + notice + `
+	<ul>`
+	for _, s := range activeSessions {
+		html += `
+		<li>
+			<span>` + escapeHTML(describeUserAgent(s.UserAgent)) + `</span>
+			<span>(` + escapeHTML(s.IPAddress) + `, last active ` + s.LastActivityAt.Format("2006-01-02 15:04") + `)</span>`
+		if s.ID == currentID {
+			html += `
+			<strong>This session</strong>`
+		} else {
+			html += `
+			<button
+				hx-delete="/api/profile/sessions/` + strconv.Itoa(s.ID) + `"
+				hx-target="#sessions"
+				hx-swap="outerHTML">Log out</button>`
+		}
+		html += `
+		</li>`
+	}
+	html += `
+	</ul>`
+
+	if len(activeSessions) > 1 {
+		html += `
+	<button hx-post="/api/profile/sessions/revoke-others" hx-target="#sessions" hx-swap="outerHTML"
+		hx-confirm="Log out all other sessions?">Log out everywhere else</button>`
+	}
+
+	html += `
+</section>`
+	return html
+}
+
+// currentSessionID returns the database id of the request's session, 0 for token requests
+func currentSessionID(c *gin.Context) int {
+	if middleware.IsTokenAuthenticated(c) {
+		return 0
+	}
+	id, _ := strconv.Atoi(sessions.Default(c).ID())
+	return id
+}
+
+// describeUserAgent turns a User-Agent header into "Browser on OS" for the session list
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := ""
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	system := ""
+	for _, candidate := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case len(userAgent) > 60:
+		return userAgent[:60] + "..."
+	default:
+		return userAgent
+	}
+}
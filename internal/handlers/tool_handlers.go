@@ -1,11 +1,16 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
 	"github.com/helloellinor/p2k16/internal/middleware"
+	"github.com/helloellinor/p2k16/internal/models"
 )
 
 // GetTools returns a list of all tools
@@ -105,19 +110,70 @@ func (h *Handler) CheckoutTool(c *gin.Context) {
 		return
 	}
 
-	// Create checkout record
-	_, err = h.toolRepo.CheckoutTool(toolID, user.ID)
+	// Same rules as the legacy ToolClient.checkout_tool: tools with a circle can only be used by
+	// its members, expired memberships don't count, and only by active members or employees of an
+	// active company
+	if tool.CircleID.Valid {
+		inCircle, err := h.circleRepo.IsAccountInCircle(user.ID, int(tool.CircleID.Int64))
+		if err != nil {
+			logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check circle of tool %d for %s: %v", tool.ID, user.Username, err))
+			c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+				[]byte("<p>Failed to checkout tool</p>"))
+			return
+		}
+		if !inCircle {
+			circleName := "required"
+			if tool.Circle != nil {
+				circleName = tool.Circle.Name
+			}
+			h.denyToolCheckout(c, user, tool, "You are not in the "+circleName+" circle, which is needed to use "+tool.Name+".")
+			return
+		}
+	}
+
+	active, err := h.membershipRepo.IsActiveMember(user.ID)
 	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check membership of %s: %v", user.Username, err))
 		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
 			[]byte("<p>Failed to checkout tool</p>"))
 		return
 	}
+	if !active {
+		h.denyToolCheckout(c, user, tool, "You don't have an active membership and are not employed in an active company.")
+		return
+	}
 
-	// Log event
-	h.eventRepo.CreateEvent("tool", "checkout", user.ID)
+	// Create checkout record, taking the tool over if someone else has it
+	checkout, err := h.toolRepo.CheckoutTool(toolID, user.ID)
+	if errors.Is(err, models.ErrToolAlreadyCheckedOut) || errors.Is(err, models.ErrToolCheckoutConflict) {
+		c.Data(http.StatusConflict, "text/html; charset=utf-8",
+			[]byte("<p>Can't check out \""+escapeHTML(tool.Name)+"\": "+escapeHTML(err.Error())+"</p>"))
+		return
+	}
+	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check out '%s' for %s: %v", tool.Name, user.Username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte("<p>Failed to checkout tool</p>"))
+		return
+	}
+
+	// Events store the tool name in text1 like the legacy ToolCheckoutEvent, takeovers the previous holder in int1
+	message := "Successfully checked out \"" + escapeHTML(tool.Name) + "\"!"
+	if checkout.TakenOver != nil {
+		logging.LogInfo("TOOL", fmt.Sprintf("'%s' taken over by %s from %s", tool.Name, user.Username, checkout.TakenOver.Account.Username))
+		h.logEvent("tool", "takeover", user.ID, tool.Name, checkout.TakenOver.AccountID)
+		message = "Checked out \"" + escapeHTML(tool.Name) + "\", taking it over from " + escapeHTML(checkout.TakenOver.Account.Username) + "."
+	}
+	h.logEvent("tool", "checkout", user.ID, tool.Name, 0)
+
+	// Only unlock once the checkout is saved, a taken over tool just stays unlocked for the new holder
+	if err := h.mqttClient.UnlockTool(tool.Name); err != nil {
+		logging.LogError("MQTT ERROR", fmt.Sprintf("Failed to unlock '%s' for %s: %v", tool.Name, user.Username, err))
+		message += " The tool could not be unlocked, please try again or ask for help."
+	}
 
 	html := "<section aria-live=\"polite\">" +
-		"<p>Successfully checked out \"" + tool.Name + "\"!</p>" +
+		"<p>" + message + "</p>" +
 		"<button hx-get=\"/api/tools/checkouts\" hx-target=\"#active-checkouts\">" +
 		"Refresh Checkouts" +
 		"</button>" +
@@ -139,22 +195,55 @@ func (h *Handler) CheckinTool(c *gin.Context) {
 	}
 
 	// Check in tool
-	err = h.toolRepo.CheckinTool(checkoutID)
+	checkout, err := h.toolRepo.CheckinTool(checkoutID)
+	if errors.Is(err, models.ErrToolNotCheckedOut) {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8",
+			[]byte("<p>Failed to check in tool: "+err.Error()+"</p>"))
+		return
+	}
 	if err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to check in checkout %d: %v", checkoutID, err))
 		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
-			[]byte("<p>Failed to check in tool: "+err.Error()+"</p>"))
+			[]byte("<p>Failed to check in tool</p>"))
 		return
 	}
 
 	// Log event
-	h.eventRepo.CreateEvent("tool", "checkin", user.ID)
+	h.logEvent("tool", "checkin", user.ID, checkout.Tool.Name, 0)
+
+	message := "Tool checked in successfully!"
+	if err := h.mqttClient.LockTool(checkout.Tool.Name); err != nil {
+		logging.LogError("MQTT ERROR", fmt.Sprintf("Failed to lock '%s' for %s: %v", checkout.Tool.Name, user.Username, err))
+		message += " The tool could not be locked."
+	}
 
 	html := "<section aria-live=\"polite\">" +
-		"<p>Tool checked in successfully!</p>" +
+		"<p>" + message + "</p>" +
 		"<button hx-get=\"/api/tools/checkouts\" hx-target=\"#active-checkouts\">" +
 		"Refresh Checkouts" +
 		"</button>" +
 		"</section>"
 
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
-}
\ No newline at end of file
+}
+
+// denyToolCheckout answers a refused checkout with the reason and stores a tool/checkout-denied
+// event: text1 is the tool name, text2 the reason and int1 the tool
+func (h *Handler) denyToolCheckout(c *gin.Context, user *middleware.AuthenticatedUser, tool *models.ToolDescription, reason string) {
+	logging.LogWarning("TOOL", fmt.Sprintf("Checkout of '%s' by %s denied: %s", tool.Name, user.Username, reason))
+
+	event := &models.Event{
+		Domain:    "tool",
+		Key:       "checkout-denied",
+		Text1:     sql.NullString{String: tool.Name, Valid: true},
+		Text2:     sql.NullString{String: reason, Valid: true},
+		Int1:      sql.NullInt64{Int64: int64(tool.ID), Valid: true},
+		CreatedBy: sql.NullInt64{Int64: int64(user.ID), Valid: true},
+	}
+	if err := h.eventRepo.CreateEventWithData(event); err != nil {
+		logging.LogError("DATABASE ERROR", fmt.Sprintf("Failed to log tool/checkout-denied event: %v", err))
+	}
+
+	c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+		[]byte("<p>"+escapeHTML(reason)+"</p>"))
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/auth"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/middleware"
+)
+
+// recoveryCodeCount is how many recovery codes are handed out at a time
+const recoveryCodeCount = 10
+
+// AuthTwoFactor handles the second login step, after AuthLogin accepted the password
+func (h *Handler) AuthTwoFactor(c *gin.Context) {
+	code := strings.TrimSpace(c.PostForm("code"))
+	clientIP := c.ClientIP()
+
+	accountID, ok := middleware.PendingTwoFactorAccount(c)
+	if !ok {
+		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
+			[]byte(`<p>Your login has expired. Please <a href="/login">start again</a>.</p>`))
+		return
+	}
+
+	account, err := h.accountRepo.FindByID(accountID)
+	if err != nil {
+		logging.LogError("LOGIN FAILED", fmt.Sprintf("Pending two-factor account %d not found: %v", accountID, err))
+		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
+			[]byte(`<p>Your login has expired. Please <a href="/login">start again</a>.</p>`))
+		return
+	}
+
+	// Codes are guessed against the same limits as passwords
+	if wait := h.loginThrottle.Check(account.Username, clientIP); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.Data(http.StatusTooManyRequests, "text/html; charset=utf-8",
+			[]byte(`<p>Too many failed login attempts. Please try again in `+formatWait(wait)+`.</p>`))
+		return
+	}
+
+	verified, usedRecoveryCode := h.verifySecondFactor(account.ID, code, true)
+	if !verified {
+		logging.LogError("LOGIN FAILED", fmt.Sprintf("Invalid two-factor code for user '%s'", account.Username))
+		lockout := h.loginThrottle.RecordFailure(account.Username, clientIP)
+		h.logAuthEvent("2fa-failed", account.ID, clientIP, 0)
+		if lockout > 0 {
+			h.logAuthEvent("login-locked", account.ID, clientIP, int(lockout.Seconds()))
+		}
+		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
+			[]byte(`<p>Invalid code</p>`))
+		return
+	}
+
+	h.loginThrottle.RecordSuccess(account.Username)
+	if usedRecoveryCode {
+		logging.LogWarning("LOGIN 2FA", fmt.Sprintf("User %s logged in with a recovery code", account.Username))
+		h.logAuthEvent("recovery-code-used", account.ID, clientIP, 0)
+	}
+	logging.LogSuccess("LOGIN SUCCESS", fmt.Sprintf("User authenticated with two factors: %s", account.Username))
+
+	if err := middleware.CompleteTwoFactorLogin(c, account); err != nil {
+		logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to create session for user %s: %v", account.Username, err))
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8",
+			[]byte(`<p>Failed to login. Please try again.</p>`))
+		return
+	}
+
+	loginSucceeded(c, account)
+}
+
+// GetTwoFactor returns the two-factor section of the profile card (requires auth)
+func (h *Handler) GetTwoFactor(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID, "")))
+}
+
+// SetupTwoFactor starts an enrollment and shows the secret to add to an authenticator app
+func (h *Handler) SetupTwoFactor(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !h.requireSessionForTwoFactor(c) {
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err == nil {
+		err = h.twoFactorRepo.StartEnrollment(user.ID, secret)
+	}
+	if err != nil {
+		logging.LogError("2FA ERROR", fmt.Sprintf("Failed to start two-factor enrollment for %s: %v", user.Username, err))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Failed to start two-factor setup.</p></section>`)))
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(renderTwoFactorSetupHTML(user.Username, secret, "")))
+}
+
+// ConfirmTwoFactor enables two-factor authentication once a code from the new secret is entered
+func (h *Handler) ConfirmTwoFactor(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !h.requireSessionForTwoFactor(c) {
+		return
+	}
+
+	totp, err := h.twoFactorRepo.GetForAccount(user.ID)
+	if err != nil || totp.IsEnabled() {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID, "")))
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, c.PostForm("code"), time.Now())
+	if !ok {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(renderTwoFactorSetupHTML(user.Username, totp.Secret,
+			`<section aria-live="polite"><p>That code is not correct. Check the time on your phone and try again.</p></section>`)))
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = h.twoFactorRepo.Confirm(user.ID, step, normalizeRecoveryCodes(codes))
+	}
+	if err != nil {
+		logging.LogError("2FA ERROR", fmt.Sprintf("Failed to enable two-factor authentication for %s: %v", user.Username, err))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Failed to enable two-factor authentication.</p></section>`)))
+		return
+	}
+
+	// The member just proved they have the second factor
+	if err := middleware.SetTwoFactorVerified(c); err != nil {
+		logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to mark session as verified: %v", err))
+	}
+
+	logging.LogSuccess("2FA", fmt.Sprintf("Two-factor authentication enabled by %s", user.Username))
+	h.logAuthEvent("2fa-enabled", user.ID, "", 0)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+		`<section aria-live="polite"><p>Two-factor authentication is enabled.</p></section>`+renderRecoveryCodesHTML(codes))))
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, requires a current authenticator code
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !h.requireSessionForTwoFactor(c) {
+		return
+	}
+
+	if verified, _ := h.verifySecondFactor(user.ID, c.PostForm("code"), false); !verified {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Invalid authenticator code.</p></section>`)))
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = h.twoFactorRepo.ReplaceRecoveryCodes(user.ID, normalizeRecoveryCodes(codes))
+	}
+	if err != nil {
+		logging.LogError("2FA ERROR", fmt.Sprintf("Failed to replace recovery codes for %s: %v", user.Username, err))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Failed to create new recovery codes.</p></section>`)))
+		return
+	}
+
+	logging.LogSuccess("2FA", fmt.Sprintf("Recovery codes replaced by %s", user.Username))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID, renderRecoveryCodesHTML(codes))))
+}
+
+// DisableTwoFactor turns two-factor authentication off, requires a current code or recovery code
+func (h *Handler) DisableTwoFactor(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !h.requireSessionForTwoFactor(c) {
+		return
+	}
+
+	if verified, _ := h.verifySecondFactor(user.ID, c.PostForm("code"), true); !verified {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Invalid code.</p></section>`)))
+		return
+	}
+
+	if err := h.twoFactorRepo.Disable(user.ID); err != nil {
+		logging.LogError("2FA ERROR", fmt.Sprintf("Failed to disable two-factor authentication for %s: %v", user.Username, err))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+			`<section aria-live="polite"><p>Failed to disable two-factor authentication.</p></section>`)))
+		return
+	}
+
+	if err := middleware.ClearTwoFactorVerified(c); err != nil {
+		logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to clear two-factor mark for %s: %v", user.Username, err))
+	}
+
+	logging.LogSuccess("2FA", fmt.Sprintf("Two-factor authentication disabled by %s", user.Username))
+	h.logAuthEvent("2fa-disabled", user.ID, "", 0)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(h.renderTwoFactorSectionHTML(user.ID,
+		`<section aria-live="polite"><p>Two-factor authentication is disabled.</p></section>`)))
+}
+
+// requireSessionForTwoFactor refuses two-factor changes through API tokens
+func (h *Handler) requireSessionForTwoFactor(c *gin.Context) bool {
+	if middleware.IsTokenAuthenticated(c) {
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "message": "Two-factor authentication can only be changed from a logged in session"})
+		return false
+	}
+	return true
+}
+
+// verifySecondFactor checks an authenticator code, or a recovery code if allowRecovery is set.
+// Each authenticator code and recovery code is only accepted once.
+func (h *Handler) verifySecondFactor(accountID int, code string, allowRecovery bool) (verified bool, usedRecoveryCode bool) {
+	totp, err := h.twoFactorRepo.GetForAccount(accountID)
+	if err != nil || !totp.IsEnabled() {
+		return false, false
+	}
+
+	if step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		used, err := h.twoFactorRepo.UseStep(accountID, step)
+		if err != nil {
+			logging.LogError("2FA ERROR", fmt.Sprintf("Failed to record used code for account %d: %v", accountID, err))
+		}
+		return used, false
+	}
+
+	if !allowRecovery {
+		return false, false
+	}
+
+	used, err := h.twoFactorRepo.UseRecoveryCode(accountID, auth.NormalizeRecoveryCode(code))
+	if err != nil {
+		logging.LogError("2FA ERROR", fmt.Sprintf("Failed to check recovery code for account %d: %v", accountID, err))
+	}
+	return used, used
+}
+
+func normalizeRecoveryCodes(codes []string) []string {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = auth.NormalizeRecoveryCode(code)
+	}
+	return normalized
+}
+
+// renderTwoFactorLoginHTML replaces the login form with the code form
+func renderTwoFactorLoginHTML(next string) string {
+	return `
+		<div id="login-form" hx-swap-oob="true"></div>
+		<section aria-live="polite">
+			<p>Enter the 6-digit code from your authenticator app, or one of your recovery codes.</p>
+			<form hx-post="/api/auth/2fa" hx-target="#two-factor-result">
+				<div class="mb-3">
+					<label for="code" class="form-label">Authentication code</label>
+					<input type="text" class="form-control" id="code" name="code" autocomplete="one-time-code" autocapitalize="off" required autofocus>
+				</div>
+				<input type="hidden" name="next" value="` + escapeHTML(middleware.SafeRedirectPath(next)) + `">
+				<div class="d-grid">
+					<button type="submit" class="btn btn-primary">Verify</button>
+				</div>
+			</form>
+			<div id="two-factor-result" class="mt-3"></div>
+		</section>`
+}
+
+// renderTwoFactorSectionHTML shows the two-factor status with the actions available
+func (h *Handler) renderTwoFactorSectionHTML(accountID int, notice string) string {
+	html := `
+<section id="two-factor" aria-labelledby="two-factor-title">
+	<header><h2 id="two-factor-title">Two-Factor Authentication</h2></header>` + notice
+
+	totp, err := h.twoFactorRepo.GetForAccount(accountID)
+	if err != nil || !totp.IsEnabled() {
+		return html + `
+	<p>Protect your account with a code from an authenticator app in addition to your password.</p>
+	<button hx-post="/api/profile/2fa/setup" hx-target="#two-factor" hx-swap="outerHTML">Enable Two-Factor Authentication</button>
+</section>`
+	}
+
+	remaining, _ := h.twoFactorRepo.CountUnusedRecoveryCodes(accountID)
+	return html + `
+	<p>Two-factor authentication is enabled since ` + totp.ConfirmedAt.Time.Format("2006-01-02") + `. You have ` + strconv.Itoa(remaining) + ` unused recovery codes.</p>
+	<form hx-post="/api/profile/2fa/recovery-codes" hx-target="#two-factor" hx-swap="outerHTML">
+		<div>
+			<label for="recovery-code-totp">Authenticator code</label>
+			<input type="text" id="recovery-code-totp" name="code" autocomplete="one-time-code" required>
+		</div>
+		<button type="submit">New Recovery Codes</button>
+	</form>
+	<form hx-post="/api/profile/2fa/disable" hx-target="#two-factor" hx-swap="outerHTML"
+		hx-confirm="Turn off two-factor authentication?">
+		<div>
+			<label for="disable-totp">Authenticator or recovery code</label>
+			<input type="text" id="disable-totp" name="code" autocomplete="one-time-code" required>
+		</div>
+		<button type="submit">Disable Two-Factor Authentication</button>
+	</form>
+</section>`
+}
+
+// renderTwoFactorSetupHTML shows the QR code and secret for a pending enrollment
+func renderTwoFactorSetupHTML(username, secret, notice string) string {
+	uri := auth.TOTPProvisioningURI(username, secret)
+
+	// Group the secret in fours so it is easier to type in by hand
+	var grouped []string
+	for i := 0; i < len(secret); i += 4 {
+		end := i + 4
+		if end > len(secret) {
+			end = len(secret)
+		}
+		grouped = append(grouped, secret[i:end])
+	}
+
+	return `
+<section id="two-factor" aria-labelledby="two-factor-title">
+	<header><h2 id="two-factor-title">Two-Factor Authentication</h2></header>` + notice + `
+	<p>Scan the QR code with an authenticator app, or enter the key by hand. Then enter the code the app shows.</p>
+	<div id="totp-qr" data-uri="` + escapeHTML(uri) + `"></div>
+	<p><a href="` + escapeHTML(uri) + `">Open in authenticator app</a></p>
+	<p>Key: <code>` + strings.Join(grouped, " ") + `</code></p>
+	<form hx-post="/api/profile/2fa/confirm" hx-target="#two-factor" hx-swap="outerHTML">
+		<div>
+			<label for="confirm-totp">Code from the app</label>
+			<input type="text" id="confirm-totp" name="code" autocomplete="one-time-code" inputmode="numeric" required>
+		</div>
+		<button type="submit">Enable</button>
+		<button type="button" hx-get="/api/profile/2fa" hx-target="#two-factor" hx-swap="outerHTML">Cancel</button>
+	</form>
+	<script>
+		(function () {
+			var el = document.getElementById('totp-qr');
+			var render = function () {
+				var qr = qrcode(0, 'M');
+				qr.addData(el.dataset.uri);
+				qr.make();
+				el.innerHTML = qr.createSvgTag(4);
+			};
+			if (window.qrcode) {
+				render();
+				return;
+			}
+			var script = document.createElement('script');
+			script.src = 'https://unpkg.com/qrcode-generator@1.4.4/qrcode.js';
+			script.onload = render;
+			document.head.appendChild(script);
+		})();
+	</script>
+</section>`
+}
+
+// renderRecoveryCodesHTML shows freshly generated recovery codes, only ever shown once
+func renderRecoveryCodesHTML(codes []string) string {
+	html := `
+	<section aria-live="polite">
+		<p>Save these recovery codes somewhere safe. Each can be used once to log in if you lose your phone. They will not be shown again.</p>
+		<ul>`
+	for _, code := range codes {
+		html += `
+			<li><code>` + code + `</code></li>`
+	}
+	return html + `
+		</ul>
+	</section>`
+}
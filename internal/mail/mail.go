@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/smtp"
+	"strings"
+
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// Templates are ported from web/src/p2k16/core/mail so both systems send the same emails
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+// Config holds the SMTP settings, matching SMTP_HOST/SMTP_PORT in the legacy config
+type Config struct {
+	Host         string
+	Port         int
+	From         string
+	MembershipCC string // Bcc'ed on membership emails, legacy MEMBERSHIP_CC
+}
+
+// Mailer sends emails to members. Without an SMTP host it only logs the messages.
+type Mailer struct {
+	config Config
+}
+
+// NewMailer creates a new mailer
+func NewMailer(config Config) *Mailer {
+	return &Mailer{config: config}
+}
+
+// IsConfigured reports whether an SMTP host has been configured
+func (m *Mailer) IsConfigured() bool {
+	return m.config.Host != ""
+}
+
+// SendPasswordRecovery sends the reset password link to the account's email
+func (m *Mailer) SendPasswordRecovery(account *models.Account, url string) error {
+	logging.LogInfo("MAIL", fmt.Sprintf("Sending password recovery email to %s", account.Email))
+
+	return m.send(account.Email, "Reset password for Bitraf", "send_password_recovery.html", map[string]interface{}{
+		"Account": account,
+		"URL":     url,
+	})
+}
+
+// SendNewMember sends the welcome email to a newly registered account
+func (m *Mailer) SendNewMember(account *models.Account) error {
+	logging.LogInfo("MAIL", fmt.Sprintf("Sending new member email to %s", account.Email))
+
+	var bcc []string
+	if m.config.MembershipCC != "" {
+		bcc = append(bcc, m.config.MembershipCC)
+	}
+
+	return m.send(account.Email, "Welcome to Bitraf", "new_member.html", map[string]interface{}{
+		"Account": account,
+	}, bcc...)
+}
+
+// SendCircleMembershipRequest tells an administrator of a circle that someone asked to join it
+func (m *Mailer) SendCircleMembershipRequest(admin, requester *models.Account, circle *models.Circle, motivation, url string) error {
+	logging.LogInfo("MAIL", fmt.Sprintf("Sending circle membership request for %s to %s", circle.Name, admin.Email))
+
+	return m.send(admin.Email, requester.Username+" wants to join "+circle.Name, "circle_membership_request.html", map[string]interface{}{
+		"Admin":      admin,
+		"Requester":  requester,
+		"Circle":     circle,
+		"Motivation": motivation,
+		"URL":        url,
+	})
+}
+
+// SendBadgeExpiring reminds the holder of a badge that it expires soon and has to be renewed
+func (m *Mailer) SendBadgeExpiring(account *models.Account, badge *models.AccountBadge, url string) error {
+	logging.LogInfo("MAIL", fmt.Sprintf("Sending badge expiry reminder for %s to %s", badge.BadgeDescription.Title, account.Email))
+
+	return m.send(account.Email, "Your badge "+badge.BadgeDescription.Title+" expires soon", "badge_expiring.html", map[string]interface{}{
+		"Account": account,
+		"Badge":   badge,
+		"Expires": badge.ExpiresAt.Time.Format("2006-01-02"),
+		"URL":     url,
+	})
+}
+
+// send renders the named template and delivers it as an HTML email
+func (m *Mailer) send(to, subject, templateName string, data interface{}, bcc ...string) error {
+	var body bytes.Buffer
+	if err := templates.ExecuteTemplate(&body, templateName, data); err != nil {
+		return fmt.Errorf("failed to render %s: %w", templateName, err)
+	}
+
+	if !m.IsConfigured() {
+		logging.LogWarning("MAIL", fmt.Sprintf("SMTP not configured, not sending '%s' to %s:\n%s", subject, to, body.String()))
+		return nil
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + m.config.From + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	recipients := append([]string{to}, bcc...)
+	addr := fmt.Sprintf("%s:%d", m.config.Host, m.config.Port)
+	if err := smtp.SendMail(addr, nil, envelopeAddress(m.config.From), recipients, msg.Bytes()); err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+
+	return nil
+}
+
+// envelopeAddress extracts the bare address from "Name <address>"
+func envelopeAddress(from string) string {
+	if start := strings.Index(from, "<"); start >= 0 {
+		if end := strings.Index(from[start:], ">"); end > 0 {
+			return from[start+1 : start+end]
+		}
+	}
+	return from
+}
@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/sessions"
@@ -16,6 +18,11 @@ const (
 	LastActivityKey  = "last_activity"
 	SessionCreatedKey = "session_created"
 	SessionTimeout   = 24 * time.Hour // 24 hours
+	SessionAbsoluteTimeout = 7 * 24 * time.Hour // 7 days
+	SessionExpiredKey = "session_expired"
+	AuthMethodKey    = "auth_method"
+	AuthMethodSession = "session"
+	AuthMethodToken   = "token"
 )
 
 // AuthenticatedUser represents the currently logged-in user
@@ -25,76 +32,147 @@ type AuthenticatedUser struct {
 	Account  *models.Account `json:"account,omitempty"`
 }
 
-// SessionValidationMiddleware validates session and updates activity
-func SessionValidationMiddleware() gin.HandlerFunc {
+// SessionTimeouts configures how long a login session lasts
+type SessionTimeouts struct {
+	Idle       time.Duration // Session ends after this long without requests
+	Absolute   time.Duration // Session ends this long after login, however active
+	RenewAfter time.Duration // Minimum time between activity updates, to avoid a session write per request
+}
+
+// DefaultSessionTimeouts returns the timeouts used when nothing is configured
+func DefaultSessionTimeouts() SessionTimeouts {
+	return SessionTimeouts{
+		Idle:       SessionTimeout,
+		Absolute:   SessionAbsoluteTimeout,
+		RenewAfter: 1 * time.Minute,
+	}
+}
+
+// SessionValidationMiddleware ends sessions past their idle or absolute timeout and
+// slides the idle timeout forward on activity. Expired sessions are treated as logged out,
+// RequireAuth then sends the user to the login page.
+func SessionValidationMiddleware(timeouts SessionTimeouts) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		session := sessions.Default(c)
-		userID := session.Get(UserIDKey)
-		
-		if userID != nil {
-			// Check session expiration
-			lastActivity := session.Get(LastActivityKey)
-			if lastActivity != nil {
-				var lastTime time.Time
-				
-				// Handle different time formats
-				switch v := lastActivity.(type) {
-				case time.Time:
-					lastTime = v
-				case string:
-					if t, err := time.Parse(time.RFC3339, v); err == nil {
-						lastTime = t
-					} else {
-						// Invalid time format, treat as expired
-						session.Clear()
-						session.Save()
-						c.Next()
-						return
-					}
-				default:
-					// Unknown format, treat as expired
-					session.Clear()
-					session.Save()
-					c.Next()
-					return
-				}
-				
-				// Check if session is expired
-				if time.Since(lastTime) > SessionTimeout {
-					session.Clear()
-					session.Save()
-					c.Next()
-					return
-				}
+		if session.Get(UserIDKey) == nil {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		lastActivity, lastOK := sessionTime(session, LastActivityKey)
+		created, createdOK := sessionTime(session, SessionCreatedKey)
+
+		// Sessions without valid timestamps can't be checked, treat them as expired
+		expired := !lastOK || !createdOK ||
+			now.Sub(lastActivity) > timeouts.Idle ||
+			now.Sub(created) > timeouts.Absolute
+		if expired {
+			// Keep the CSRF token so forms on open pages lead to the login page, not a CSRF error
+			csrfToken := session.Get(CSRFTokenKey)
+			session.Clear()
+			if csrfToken != nil {
+				session.Set(CSRFTokenKey, csrfToken)
 			}
-			
-			// Update last activity
-			session.Set(LastActivityKey, time.Now().Format(time.RFC3339))
 			session.Save()
+			c.Set(SessionExpiredKey, true)
+			c.Next()
+			return
 		}
-		
+
+		// Sliding renewal, saving also extends the stored session and its cookie
+		if now.Sub(lastActivity) > timeouts.RenewAfter {
+			session.Set(LastActivityKey, now.Format(time.RFC3339))
+			session.Save()
+		}
+
 		c.Next()
 	}
 }
 
-// RequireAuth middleware that requires authentication
-func RequireAuth(accountRepo *models.AccountRepository) gin.HandlerFunc {
+// sessionTime reads a timestamp stored in the session
+func sessionTime(session sessions.Session, key string) (time.Time, bool) {
+	switch v := session.Get(key).(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// loginURL builds the login page URL that returns the user to where they were.
+// For HTMX requests that is the page the request came from, not the fragment URL.
+func loginURL(c *gin.Context) string {
+	next := c.Request.URL.RequestURI()
+	if current := c.GetHeader("HX-Current-URL"); current != "" {
+		if u, err := url.Parse(current); err == nil {
+			next = u.RequestURI()
+		}
+	}
+
+	query := url.Values{}
+	if next != "/" && next != "" {
+		query.Set("next", next)
+	}
+	if c.GetBool(SessionExpiredKey) {
+		query.Set("show_message", "session-expired")
+	}
+
+	if len(query) == 0 {
+		return "/login"
+	}
+	return "/login?" + query.Encode()
+}
+
+// redirectToLogin sends unauthenticated requests to the login page. HTMX requests
+// get an HX-Redirect so the whole page navigates instead of swapping in the login page.
+func redirectToLogin(c *gin.Context, message string) {
+	location := loginURL(c)
+	if c.GetHeader("HX-Request") == "true" {
+		c.Header("HX-Redirect", location)
+		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-warning">`+strings.TrimSpace(message+` Please <a href="`+location+`">log in</a> to continue.`)+`</div>`))
+		c.Abort()
+		return
+	}
+
+	c.Redirect(http.StatusFound, location)
+	c.Abort()
+}
+
+// SafeRedirectPath returns next if it is a path on this site, otherwise "/".
+// Guards the login redirect against being used to send users to other sites.
+func SafeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	if u, err := url.Parse(next); err != nil || u.Host != "" || u.Scheme != "" {
+		return "/"
+	}
+	return next
+}
+
+// RequireAuth middleware that requires authentication, either through the session cookie
+// or an "Authorization: Bearer <token>" header carrying a personal API token
+func RequireAuth(accountRepo *models.AccountRepository, tokenRepo *models.ApiTokenRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if token, ok := bearerToken(c); ok {
+			authenticateToken(c, token, accountRepo, tokenRepo)
+			return
+		}
+
 		session := sessions.Default(c)
 		userID := session.Get(UserIDKey)
 
 		if userID == nil {
-			// For HTMX requests, return HTML error
-			if c.GetHeader("HX-Request") == "true" {
-				c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
-					[]byte(`<div class="alert alert-warning">Please <a href="/login">log in</a> to continue.</div>`))
-				c.Abort()
-				return
+			message := ""
+			if c.GetBool(SessionExpiredKey) {
+				message = "Your session has expired."
 			}
-
-			// For regular requests, redirect to login
-			c.Redirect(http.StatusFound, "/login")
-			c.Abort()
+			redirectToLogin(c, message)
 			return
 		}
 
@@ -123,16 +201,7 @@ func RequireAuth(accountRepo *models.AccountRepository) gin.HandlerFunc {
 			// User ID in session but account doesn't exist - clear session
 			session.Clear()
 			session.Save()
-
-			if c.GetHeader("HX-Request") == "true" {
-				c.Data(http.StatusUnauthorized, "text/html; charset=utf-8",
-					[]byte(`<div class="alert alert-danger">Session invalid. Please <a href="/login">log in again</a>.</div>`))
-				c.Abort()
-				return
-			}
-
-			c.Redirect(http.StatusFound, "/login")
-			c.Abort()
+			redirectToLogin(c, "Session invalid.")
 			return
 		}
 
@@ -143,10 +212,55 @@ func RequireAuth(accountRepo *models.AccountRepository) gin.HandlerFunc {
 			Account:  account,
 		}
 		c.Set("user", user)
+		c.Set(AuthMethodKey, AuthMethodSession)
 		c.Next()
 	}
 }
 
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// authenticateToken loads the account owning an API token. Token clients are scripts,
+// so failures are always answered with JSON rather than a login redirect.
+func authenticateToken(c *gin.Context, token string, accountRepo *models.AccountRepository, tokenRepo *models.ApiTokenRepository) {
+	if tokenRepo == nil || accountRepo == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "API tokens are not supported"})
+		return
+	}
+
+	accountID, err := tokenRepo.Authenticate(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "Invalid API token"})
+		return
+	}
+
+	account, err := accountRepo.FindByID(accountID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "message": "Invalid API token"})
+		return
+	}
+
+	c.Set("user", &AuthenticatedUser{
+		ID:       account.ID,
+		Username: account.Username,
+		Account:  account,
+	})
+	c.Set(AuthMethodKey, AuthMethodToken)
+	c.Next()
+}
+
+// IsTokenAuthenticated reports whether the request was authenticated with an API token
+func IsTokenAuthenticated(c *gin.Context) bool {
+	return c.GetString(AuthMethodKey) == AuthMethodToken
+}
+
 // OptionalAuth middleware that loads user if authenticated but doesn't require it
 func OptionalAuth(accountRepo *models.AccountRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -209,6 +323,9 @@ func LoginUser(c *gin.Context, account *models.Account) error {
 	session.Set(UsernameKey, account.Username)
 	session.Set(LastActivityKey, now.Format(time.RFC3339))
 	session.Set(SessionCreatedKey, now.Format(time.RFC3339))
+	session.Delete(PendingTwoFactorAccountKey)
+	session.Delete(PendingTwoFactorStartedKey)
+	session.Delete(TwoFactorVerifiedKey)
 	
 	return session.Save()
 }
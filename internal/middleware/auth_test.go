@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSafeRedirectPath(t *testing.T) {
+	cases := map[string]string{
+		"":                      "/",
+		"/profile":              "/profile",
+		"/admin/users?offset=5": "/admin/users?offset=5",
+		"//evil.example":        "/",
+		"/\\evil.example":       "/",
+		"https://evil.example":  "/",
+		"profile":               "/",
+	}
+	for next, want := range cases {
+		if got := SafeRedirectPath(next); got != want {
+			t.Errorf("SafeRedirectPath(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+// sessionTestRouter sets up a session with the given timestamps and a protected page
+func sessionTestRouter(lastActivity, created time.Time) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions(SessionName, cookie.NewStore([]byte("test-secret"))))
+
+	// Fakes an earlier login, since LoginUser always uses the current time
+	r.Use(func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set(UserIDKey, 1)
+		session.Set(UsernameKey, "alice")
+		session.Set(LastActivityKey, lastActivity.Format(time.RFC3339))
+		session.Set(SessionCreatedKey, created.Format(time.RFC3339))
+		c.Next()
+	})
+	r.Use(SessionValidationMiddleware(DefaultSessionTimeouts()))
+	r.GET("/profile", RequireAuth(nil, nil), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return r
+}
+
+func TestSessionValidationTimeouts(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name         string
+		lastActivity time.Time
+		created      time.Time
+		wantStatus   int
+	}{
+		{"active", now.Add(-time.Minute), now.Add(-time.Hour), http.StatusOK},
+		{"idle", now.Add(-25 * time.Hour), now.Add(-26 * time.Hour), http.StatusFound},
+		{"absolute", now.Add(-time.Minute), now.Add(-8 * 24 * time.Hour), http.StatusFound},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		sessionTestRouter(tc.lastActivity, tc.created).ServeHTTP(w, req)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, w.Code)
+		}
+		if tc.wantStatus == http.StatusFound {
+			if location := w.Header().Get("Location"); location != "/login?next=%2Fprofile&show_message=session-expired" {
+				t.Errorf("%s: unexpected redirect %q", tc.name, location)
+			}
+		}
+	}
+}
+
+func TestExpiredSessionHTMXRedirect(t *testing.T) {
+	now := time.Now()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("HX-Current-URL", "http://localhost:8080/admin/users")
+	sessionTestRouter(now.Add(-25*time.Hour), now.Add(-26*time.Hour)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", w.Code)
+	}
+	if redirect := w.Header().Get("HX-Redirect"); redirect != "/login?next=%2Fadmin%2Fusers&show_message=session-expired" {
+		t.Errorf("Unexpected HX-Redirect %q", redirect)
+	}
+}
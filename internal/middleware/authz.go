@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// AdminCircle is the circle whose members may use the admin console
+const AdminCircle = "admin"
+
+// RequireCircle middleware that requires the current user to be a member of at least one
+// of the named circles. Must be registered after RequireAuth.
+func RequireCircle(circleRepo *models.CircleRepository, circleNames ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := GetCurrentUser(c)
+		if user == nil {
+			Forbidden(c, "You must be logged in to access this page.")
+			return
+		}
+
+		for _, name := range circleNames {
+			isMember, err := circleRepo.IsAccountInCircleByName(user.ID, name)
+			if err != nil {
+				logging.LogError("AUTHZ ERROR", "Failed to check circle membership: "+err.Error())
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if isMember {
+				c.Next()
+				return
+			}
+		}
+
+		logging.LogWarning("ACCESS DENIED", user.Username+" is not in any of the circles: "+strings.Join(circleNames, ", "))
+		Forbidden(c, "You need to be a member of the "+strings.Join(circleNames, " or ")+" circle to access this page.")
+	}
+}
+
+// Forbidden aborts with 403, as an HTML fragment for HTMX, JSON for API clients and a page otherwise
+func Forbidden(c *gin.Context, message string) {
+	if c.GetHeader("HX-Request") == "true" {
+		c.Data(http.StatusForbidden, "text/html; charset=utf-8",
+			[]byte(`<div class="alert alert-danger">`+message+`</div>`))
+		c.Abort()
+		return
+	}
+
+	if IsAPIRequest(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"status":  "error",
+			"message": message,
+		})
+		return
+	}
+
+	c.Data(http.StatusForbidden, "text/html; charset=utf-8", []byte(`<!DOCTYPE html>
+<html>
+<head>
+	<title>Access Denied - P2K16</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link href="https://cdn.jsdelivr.net/npm/bootstrap@5.1.3/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+	<main class="container mt-4">
+		<h1>Access Denied</h1>
+		<div class="alert alert-danger">`+message+`</div>
+		<p><a href="/">Back to the front page</a></p>
+	</main>
+</body>
+</html>`))
+	c.Abort()
+}
+
+// IsAPIRequest reports whether the client expects JSON rather than a page
+func IsAPIRequest(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/api/") ||
+		strings.Contains(c.GetHeader("Accept"), "application/json") ||
+		IsTokenAuthenticated(c)
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func csrfTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions(SessionName, cookie.NewStore([]byte("test-secret"))))
+	r.Use(CSRF())
+	r.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, CSRFToken(c))
+	})
+	r.GET("/login", func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Set(UserIDKey, 1)
+		session.Save()
+		c.String(http.StatusOK, CSRFToken(c))
+	})
+	r.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return r
+}
+
+func TestCSRF(t *testing.T) {
+	r := csrfTestRouter()
+
+	// Load a page to get a token, visitors who aren't logged in get it in a cookie instead of a session
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/form", nil))
+	token := w.Body.String()
+	sessionCookie := w.Header().Get("Set-Cookie")
+	if token == "" || !strings.HasPrefix(sessionCookie, CSRFCookieName+"=") {
+		t.Fatalf("Expected a token and CSRF cookie, got %q and %q", token, sessionCookie)
+	}
+	if cookies := w.Header().Values("Set-Cookie"); len(cookies) != 1 {
+		t.Errorf("Expected no session to be saved, got cookies %q", cookies)
+	}
+
+	cases := []struct {
+		name       string
+		prepare    func(req *http.Request)
+		wantStatus int
+	}{
+		{"no token", func(req *http.Request) {}, http.StatusForbidden},
+		{"wrong token", func(req *http.Request) { req.Header.Set(CSRFHeaderName, "wrong") }, http.StatusForbidden},
+		{"header token", func(req *http.Request) { req.Header.Set(CSRFHeaderName, token) }, http.StatusOK},
+		{"bearer token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer p2k16_abc") }, http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/submit", nil)
+		req.Header.Set("Cookie", sessionCookie)
+		tc.prepare(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, w.Code)
+		}
+	}
+
+	// Plain form posts carry the token in a field
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(CSRFFormField+"="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", sessionCookie)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("form field: expected status 200, got %d", w.Code)
+	}
+}
+
+func TestCSRFLoggedInUsesSession(t *testing.T) {
+	r := csrfTestRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	token := w.Body.String()
+	// The cookie store sets the cookie again on each save, the last one has the token
+	cookies := w.Header().Values("Set-Cookie")
+	if token == "" || len(cookies) == 0 || !strings.HasPrefix(cookies[len(cookies)-1], SessionName+"=") {
+		t.Fatalf("Expected a token and session cookie, got %q and %q", token, cookies)
+	}
+	sessionCookie := cookies[len(cookies)-1]
+
+	req := httptest.NewRequest(http.MethodPost, "/submit", nil)
+	req.Header.Set("Cookie", sessionCookie)
+	req.Header.Set(CSRFHeaderName, token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the session token to be accepted, got %d", w.Code)
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CORS([]string{"https://bitraf.no"}))
+	r.GET("/api/test", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for origin, want := range map[string]string{
+		"https://bitraf.no":    "https://bitraf.no",
+		"https://evil.example": "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("Origin %s: expected Allow-Origin %q, got %q", origin, want, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+const (
+	TwoFactorVerifiedKey       = "2fa_verified"
+	PendingTwoFactorAccountKey = "2fa_pending_account"
+	PendingTwoFactorStartedKey = "2fa_pending_started"
+	// PendingTwoFactorTimeout is how long the code can be entered after the password was accepted
+	PendingTwoFactorTimeout = 5 * time.Minute
+)
+
+// StartTwoFactorLogin remembers that the password for account was correct and a code is due.
+// The user is not logged in until CompleteTwoFactorLogin.
+func StartTwoFactorLogin(c *gin.Context, account *models.Account) error {
+	session := sessions.Default(c)
+	session.Set(PendingTwoFactorAccountKey, account.ID)
+	session.Set(PendingTwoFactorStartedKey, time.Now().Format(time.RFC3339))
+	return session.Save()
+}
+
+// PendingTwoFactorAccount returns the account waiting for its second factor, if the
+// password step was recent enough
+func PendingTwoFactorAccount(c *gin.Context) (int, bool) {
+	session := sessions.Default(c)
+	accountID, ok := session.Get(PendingTwoFactorAccountKey).(int)
+	if !ok {
+		return 0, false
+	}
+
+	started, ok := sessionTime(session, PendingTwoFactorStartedKey)
+	if !ok || time.Since(started) > PendingTwoFactorTimeout {
+		return 0, false
+	}
+	return accountID, true
+}
+
+// CompleteTwoFactorLogin logs in the account and marks the session as verified with a second factor
+func CompleteTwoFactorLogin(c *gin.Context, account *models.Account) error {
+	if err := LoginUser(c, account); err != nil {
+		return err
+	}
+	return SetTwoFactorVerified(c)
+}
+
+// SetTwoFactorVerified marks the current session as verified, used right after enrollment
+func SetTwoFactorVerified(c *gin.Context) error {
+	session := sessions.Default(c)
+	session.Set(TwoFactorVerifiedKey, true)
+	return session.Save()
+}
+
+// ClearTwoFactorVerified removes the verified mark, used when two-factor authentication is disabled
+func ClearTwoFactorVerified(c *gin.Context) error {
+	session := sessions.Default(c)
+	session.Delete(TwoFactorVerifiedKey)
+	return session.Save()
+}
+
+// IsTwoFactorVerified reports whether the current session passed a second factor
+func IsTwoFactorVerified(c *gin.Context) bool {
+	verified, _ := sessions.Default(c).Get(TwoFactorVerifiedKey).(bool)
+	return verified
+}
+
+// RequireTwoFactor middleware that requires the session to have passed two-factor authentication.
+// API tokens are refused, as they may have been created before 2FA was enabled or from a session
+// that never passed it. Sessions verified before 2FA was disabled, e.g. on another device, don't
+// count either. Must be registered after RequireAuth.
+func RequireTwoFactor(twoFactorRepo *models.TwoFactorRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := GetCurrentUser(c)
+		if user == nil {
+			Forbidden(c, "You must be logged in to access this page.")
+			return
+		}
+
+		if IsTokenAuthenticated(c) {
+			logging.LogWarning("ACCESS DENIED", user.Username+" used an API token where two-factor authentication is required")
+			Forbidden(c, "This page requires two-factor authentication, API tokens can't be used for it.")
+			return
+		}
+
+		enabled, err := twoFactorRepo.IsEnabled(user.ID)
+		if err != nil {
+			logging.LogError("AUTHZ ERROR", "Failed to check two-factor status: "+err.Error())
+		}
+		if enabled && IsTwoFactorVerified(c) {
+			c.Next()
+			return
+		}
+
+		logging.LogWarning("ACCESS DENIED", user.Username+" has not passed two-factor authentication")
+		if enabled {
+			Forbidden(c, "This page requires two-factor authentication. Please log out and log in again with your authenticator code.")
+			return
+		}
+		Forbidden(c, "This page requires two-factor authentication. Enable it on your profile first.")
+	}
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireTwoFactorRefusesTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/accounts", func(c *gin.Context) {
+		c.Set("user", &AuthenticatedUser{ID: 1, Username: "admin"})
+		c.Set(AuthMethodKey, AuthMethodToken)
+	}, RequireTwoFactor(nil), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/accounts", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a token request, got %d", w.Code)
+	}
+}
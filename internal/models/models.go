@@ -22,30 +22,129 @@ type Account struct {
 	UpdatedBy          sql.NullInt64  `json:"updated_by"`
 }
 
+// ApiToken represents a personal API token used as a Bearer credential
+type ApiToken struct {
+	ID         int           `json:"id"`
+	AccountID  int           `json:"account_id"`
+	Name       string        `json:"name"`
+	TokenHash  string        `json:"-"` // Only the hash is stored, the token is shown once
+	LastUsedAt sql.NullTime  `json:"last_used_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	CreatedBy  sql.NullInt64 `json:"created_by"`
+	UpdatedBy  sql.NullInt64 `json:"updated_by"`
+}
+
+// Session is a server side login session. The cookie only holds a random key.
+type Session struct {
+	ID             int           `json:"id"`
+	AccountID      sql.NullInt64 `json:"account_id"`
+	KeyHash        string        `json:"-"`
+	Data           []byte        `json:"-"` // Encoded session values
+	UserAgent      string        `json:"user_agent"`
+	IPAddress      string        `json:"ip_address"`
+	LastActivityAt time.Time     `json:"last_activity_at"`
+	ExpiresAt      time.Time     `json:"expires_at"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// AccountTOTP is an account's TOTP two-factor enrollment
+type AccountTOTP struct {
+	ID           int           `json:"id"`
+	AccountID    int           `json:"account_id"`
+	Secret       string        `json:"-"`
+	ConfirmedAt  sql.NullTime  `json:"confirmed_at"` // Not set until the first code was verified
+	LastUsedStep sql.NullInt64 `json:"-"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	CreatedBy    sql.NullInt64 `json:"created_by"`
+	UpdatedBy    sql.NullInt64 `json:"updated_by"`
+}
+
+// IsEnabled reports whether the enrollment has been confirmed
+func (t *AccountTOTP) IsEnabled() bool {
+	return t.ConfirmedAt.Valid
+}
+
+// Circle management styles, decide who may add and remove members
+const (
+	ManagementStyleAdminCircle = "ADMIN_CIRCLE" // Managed by the members of AdminCircleID
+	ManagementStyleSelfAdmin   = "SELF_ADMIN"   // Managed by its own members
+)
+
+// CircleNameMaxLength is the length of the circle name and description columns
+const CircleNameMaxLength = 50
+
 // Circle represents a group/circle in the system
 type Circle struct {
-	ID          int           `json:"id"`
-	Name        string        `json:"name"`
-	Description string        `json:"description"`
-	CreatedAt   time.Time     `json:"created_at"`
-	UpdatedAt   time.Time     `json:"updated_at"`
-	CreatedBy   sql.NullInt64 `json:"created_by"`
-	UpdatedBy   sql.NullInt64 `json:"updated_by"`
+	ID                           int           `json:"id"`
+	Name                         string        `json:"name"`
+	Description                  string        `json:"description"`
+	ManagementStyle              string        `json:"management_style"`
+	AdminCircleID                sql.NullInt64 `json:"admin_circle_id"`
+	CommentRequiredForMembership bool          `json:"comment_required_for_membership"`
+	CreatedAt                    time.Time     `json:"created_at"`
+	UpdatedAt                    time.Time     `json:"updated_at"`
+	CreatedBy                    sql.NullInt64 `json:"created_by"`
+	UpdatedBy                    sql.NullInt64 `json:"updated_by"`
 }
 
 // CircleMember represents membership in a circle
 type CircleMember struct {
-	ID        int            `json:"id"`
-	CircleID  int            `json:"circle_id"`
-	AccountID int            `json:"account_id"`
-	IssuerID  int            `json:"issuer_id"`
-	Comment   sql.NullString `json:"comment"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	CreatedBy sql.NullInt64  `json:"created_by"`
-	UpdatedBy sql.NullInt64  `json:"updated_by"`
+	ID             int            `json:"id"`
+	CircleID       int            `json:"circle_id"`
+	AccountID      int            `json:"account_id"`
+	IssuerID       int            `json:"issuer_id"` // Account that added the member, stored as created_by
+	Comment        sql.NullString `json:"comment"`
+	ExpiresAt      sql.NullTime   `json:"expires_at"`       // Membership ends at this time, if set
+	AccountBadgeID sql.NullInt64  `json:"account_badge_id"` // Awarded badge that granted the membership, if any
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	CreatedBy      sql.NullInt64  `json:"created_by"`
+	UpdatedBy      sql.NullInt64  `json:"updated_by"`
+
+	// Relationships
+	Account *Account `json:"account,omitempty"`
+	Issuer  *Account `json:"issuer,omitempty"`
+}
+
+// IsExpired reports whether the membership has ended and only waits to be removed
+func (m *CircleMember) IsExpired(now time.Time) bool {
+	return m.ExpiresAt.Valid && !m.ExpiresAt.Time.After(now)
+}
+
+// Circle membership request statuses
+const (
+	RequestStatusPending  = "PENDING"
+	RequestStatusApproved = "APPROVED"
+	RequestStatusRejected = "REJECTED"
+)
+
+// CircleMembershipRequest is a member asking the administrators of a circle to be added to it
+type CircleMembershipRequest struct {
+	ID         int           `json:"id"`
+	CircleID   int           `json:"circle_id"`
+	AccountID  int           `json:"account_id"`
+	Motivation string        `json:"motivation"` // Becomes the membership comment when approved
+	Status     string        `json:"status"`
+	DecidedBy  sql.NullInt64 `json:"decided_by"`
+	DecidedAt  sql.NullTime  `json:"decided_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	CreatedBy  sql.NullInt64 `json:"created_by"`
+	UpdatedBy  sql.NullInt64 `json:"updated_by"`
+
+	// Relationships
+	Account *Account `json:"account,omitempty"`
 }
 
+// BadgeTitleMaxLength limits badge titles, which are shown in lists and on membership cards
+const BadgeTitleMaxLength = 50
+
+// ReservedBadgeSlugs are pages under /badges that a badge slug would hide
+var ReservedBadgeSlugs = []string{"award", "new", "assertions"}
+
 // BadgeDescription represents a badge type/template
 type BadgeDescription struct {
 	ID                    int            `json:"id"`
@@ -55,27 +154,50 @@ type BadgeDescription struct {
 	Slug                  sql.NullString `json:"slug"`
 	Icon                  sql.NullString `json:"icon"`
 	Color                 sql.NullString `json:"color"`
+	ValidityDays          sql.NullInt64  `json:"validity_days"` // How long an awarded badge is valid, NULL if it doesn't expire
 	CreatedAt             time.Time      `json:"created_at"`
 	UpdatedAt             time.Time      `json:"updated_at"`
 	CreatedBy             sql.NullInt64  `json:"created_by"`
 	UpdatedBy             sql.NullInt64  `json:"updated_by"`
+
+	// Relationships (populated when needed)
+	GrantedCircles []Circle `json:"granted_circles,omitempty"` // Circles the receivers of the badge are added to
 }
 
 // AccountBadge represents a badge awarded to an account
 type AccountBadge struct {
-	ID                 int           `json:"id"`
-	AccountID          int           `json:"account_id"`
-	BadgeDescriptionID int           `json:"badge_description_id"`
-	AwardedByID        sql.NullInt64 `json:"awarded_by_id"`
-	CreatedAt          time.Time     `json:"created_at"`
-	UpdatedAt          time.Time     `json:"updated_at"`
-	CreatedBy          sql.NullInt64 `json:"created_by"`
-	UpdatedBy          sql.NullInt64 `json:"updated_by"`
+	ID                 int            `json:"id"`
+	AccountID          int            `json:"account_id"`
+	BadgeDescriptionID int            `json:"badge_description_id"`
+	AwardedByID        sql.NullInt64  `json:"awarded_by_id"`
+	RevokedAt          sql.NullTime   `json:"revoked_at"` // Set when the badge was revoked, revoked badges are kept as history
+	RevokedByID        sql.NullInt64  `json:"revoked_by_id"`
+	RevokedReason      sql.NullString `json:"revoked_reason"`
+	ExpiresAt          sql.NullTime   `json:"expires_at"` // Expired badges have to be renewed to count again
+	ReminderSentAt     sql.NullTime   `json:"reminder_sent_at"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	CreatedBy          sql.NullInt64  `json:"created_by"`
+	UpdatedBy          sql.NullInt64  `json:"updated_by"`
 
 	// Relationships (populated when needed)
 	Account          *Account          `json:"account,omitempty"`
 	BadgeDescription *BadgeDescription `json:"badge_description,omitempty"`
 	AwardedBy        *Account          `json:"awarded_by,omitempty"`
+	RevokedBy        *Account          `json:"revoked_by,omitempty"`
+
+	// Circle memberships added when the badge was awarded, or removed when it was revoked
+	GrantedMemberships []CircleMember `json:"granted_memberships,omitempty"`
+}
+
+// IsRevoked reports whether the badge has been revoked
+func (b *AccountBadge) IsRevoked() bool {
+	return b.RevokedAt.Valid
+}
+
+// IsExpired reports whether the badge has expired and needs to be renewed
+func (b *AccountBadge) IsExpired(now time.Time) bool {
+	return b.ExpiresAt.Valid && !b.ExpiresAt.Time.After(now)
 }
 
 // Badge represents a competency badge
@@ -103,16 +225,15 @@ type BadgeRequest struct {
 
 // Membership represents a membership record
 type Membership struct {
-	ID               int           `json:"id"`
-	AccountID        int           `json:"account_id"`
-	FirstMembership  time.Time     `json:"first_membership"`
-	StartMembership  time.Time     `json:"start_membership"`
-	Fee              int           `json:"fee"`
-	MembershipNumber sql.NullInt64 `json:"membership_number"`
-	CreatedAt        time.Time     `json:"created_at"`
-	UpdatedAt        time.Time     `json:"updated_at"`
-	CreatedBy        sql.NullInt64 `json:"created_by"`
-	UpdatedBy        sql.NullInt64 `json:"updated_by"`
+	ID              int           `json:"id"`
+	AccountID       int           `json:"account_id"`
+	FirstMembership time.Time     `json:"first_membership"`
+	StartMembership time.Time     `json:"start_membership"`
+	Fee             int           `json:"fee"`
+	CreatedAt       time.Time     `json:"created_at"`
+	UpdatedAt       time.Time     `json:"updated_at"`
+	CreatedBy       sql.NullInt64 `json:"created_by"`
+	UpdatedBy       sql.NullInt64 `json:"updated_by"`
 }
 
 // StripePayment represents a payment made through Stripe
@@ -144,21 +265,24 @@ type ToolDescription struct {
 	Circle      *Circle        `json:"circle,omitempty"`
 }
 
-// ToolCheckout represents a tool checkout record
+// ToolCheckout represents a tool that is checked out. The checkout is deleted when the tool is
+// checked in, so a tool has at most one.
 type ToolCheckout struct {
-	ID         int            `json:"id"`
-	ToolID     int            `json:"tool_id"`
-	AccountID  int            `json:"account_id"`
-	CheckoutAt time.Time      `json:"checkout_at"`
-	CheckinAt  sql.NullTime   `json:"checkin_at"`
-	CreatedAt  time.Time      `json:"created_at"`
-	UpdatedAt  time.Time      `json:"updated_at"`
-	CreatedBy  sql.NullInt64  `json:"created_by"`
-	UpdatedBy  sql.NullInt64  `json:"updated_by"`
+	ID         int           `json:"id"`
+	ToolID     int           `json:"tool_id"`
+	AccountID  int           `json:"account_id"`
+	CheckoutAt time.Time     `json:"checkout_at"` // The started column
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	CreatedBy  sql.NullInt64 `json:"created_by"`
+	UpdatedBy  sql.NullInt64 `json:"updated_by"`
 
 	// Relationships
 	Tool    *ToolDescription `json:"tool,omitempty"`
 	Account *Account         `json:"account,omitempty"`
+
+	// Checkout of another member that was checked in to make room for this one
+	TakenOver *ToolCheckout `json:"taken_over,omitempty"`
 }
 
 // Event represents a system event
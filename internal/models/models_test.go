@@ -1,7 +1,15 @@
 package models
 
 import (
+	"database/sql"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TestAccount_JSONSerialization tests that the Account struct can be properly serialized to JSON
@@ -58,4 +66,142 @@ func TestModelsExist(t *testing.T) {
 	if membership.ID != 0 {
 		t.Error("Membership zero value should have ID = 0")
 	}
-}
\ No newline at end of file
+}
+
+// TestAccount_NeedsRehash tests that weaker hashes are upgraded and current ones left alone
+func TestAccount_NeedsRehash(t *testing.T) {
+	weak, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+
+	account := Account{Password: string(weak)}
+	if !account.NeedsRehash() {
+		t.Error("Expected a low cost hash to need a rehash")
+	}
+
+	if err := account.SetPassword("secret"); err != nil {
+		t.Fatalf("SetPassword failed: %v", err)
+	}
+	if account.NeedsRehash() {
+		t.Error("Expected a hash with the configured cost not to need a rehash")
+	}
+	if !account.ValidatePassword("secret") {
+		t.Error("Expected the new hash to validate")
+	}
+
+	legacy := Account{Password: "pbkdf2:sha256:150000$abc$def"}
+	if !legacy.NeedsRehash() {
+		t.Error("Expected a non-bcrypt hash to need a rehash")
+	}
+}
+
+// TestCircle_Validate tests the management style rules from the legacy create_circle
+func TestCircle_Validate(t *testing.T) {
+	adminCircle := sql.NullInt64{Int64: 1, Valid: true}
+	tests := []struct {
+		name   string
+		circle Circle
+		valid  bool
+	}{
+		{"admin circle", Circle{Name: "laser", ManagementStyle: ManagementStyleAdminCircle, AdminCircleID: adminCircle}, true},
+		{"self admin", Circle{Name: "laser", ManagementStyle: ManagementStyleSelfAdmin}, true},
+		{"missing admin circle", Circle{Name: "laser", ManagementStyle: ManagementStyleAdminCircle}, false},
+		{"own admin circle", Circle{ID: 1, Name: "laser", ManagementStyle: ManagementStyleAdminCircle, AdminCircleID: adminCircle}, false},
+		{"unknown style", Circle{Name: "laser", ManagementStyle: "ANYONE"}, false},
+		{"missing name", Circle{Name: " ", ManagementStyle: ManagementStyleSelfAdmin}, false},
+		{"long name", Circle{Name: strings.Repeat("x", CircleNameMaxLength+1), ManagementStyle: ManagementStyleSelfAdmin}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.circle.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidCircle) {
+			t.Errorf("%s: expected ErrInvalidCircle, got %v", tt.name, err)
+		}
+	}
+}
+
+// TestBadgeDescription_Validate tests the title, slug, color, icon and validity rules for badges
+func TestBadgeDescription_Validate(t *testing.T) {
+	text := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	tests := []struct {
+		name  string
+		badge BadgeDescription
+		valid bool
+	}{
+		{"title only", BadgeDescription{Title: "Laser certified"}, true},
+		{"all fields", BadgeDescription{Title: "Laser certified", Slug: text("laser-certified"), Color: text("#ff8800"), Icon: text("/static/laser.png")}, true},
+		{"short color", BadgeDescription{Title: "Laser certified", Color: text("#f80")}, true},
+		{"missing title", BadgeDescription{Title: " "}, false},
+		{"long title", BadgeDescription{Title: strings.Repeat("x", BadgeTitleMaxLength+1)}, false},
+		{"uppercase slug", BadgeDescription{Title: "Laser", Slug: text("Laser")}, false},
+		{"slug with slash", BadgeDescription{Title: "Laser", Slug: text("laser/cutter")}, false},
+		{"reserved slug", BadgeDescription{Title: "Laser", Slug: text("award")}, false},
+		{"named color", BadgeDescription{Title: "Laser", Color: text("red;background:url(x)")}, false},
+		{"script icon", BadgeDescription{Title: "Laser", Icon: text("javascript:alert(1)")}, false},
+		{"protocol relative icon", BadgeDescription{Title: "Laser", Icon: text("//example.com/x.png")}, false},
+		{"yearly renewal", BadgeDescription{Title: "First aid", ValidityDays: sql.NullInt64{Int64: 365, Valid: true}}, true},
+		{"zero validity", BadgeDescription{Title: "First aid", ValidityDays: sql.NullInt64{Int64: 0, Valid: true}}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.badge.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidBadge) {
+			t.Errorf("%s: expected ErrInvalidBadge, got %v", tt.name, err)
+		}
+	}
+}
+
+// TestCircleMember_IsExpired tests that memberships end at their expiry time
+func TestCircleMember_IsExpired(t *testing.T) {
+	now := time.Now()
+
+	permanent := CircleMember{}
+	if permanent.IsExpired(now) {
+		t.Error("Expected a membership without expiry never to expire")
+	}
+
+	trial := CircleMember{ExpiresAt: sql.NullTime{Time: now.Add(time.Hour), Valid: true}}
+	if trial.IsExpired(now) {
+		t.Error("Expected a membership expiring later to be active")
+	}
+	if !trial.IsExpired(now.Add(time.Hour)) {
+		t.Error("Expected a membership to be expired at its expiry time")
+	}
+}
+
+// TestMembershipByAccountQuery tests that the membership query only uses columns of the membership
+// table, which hasn't changed since V001.006
+func TestMembershipByAccountQuery(t *testing.T) {
+	schema, err := os.ReadFile("../../migrations/V001.006__baseline.sql")
+	if err != nil {
+		t.Fatalf("Failed to read schema: %v", err)
+	}
+	table := regexp.MustCompile(`(?s)CREATE TABLE membership\s*\((.*?)\n\);`).FindSubmatch(schema)
+	if table == nil {
+		t.Fatal("Expected the schema to create the membership table")
+	}
+	columns := map[string]bool{}
+	for _, line := range strings.Split(string(table[1]), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			columns[fields[0]] = true
+		}
+	}
+
+	query := regexp.MustCompile(`(?s)SELECT(.*)FROM membership WHERE (\w+) =`).FindStringSubmatch(membershipByAccountQuery)
+	if query == nil {
+		t.Fatalf("Unexpected query: %s", membershipByAccountQuery)
+	}
+	used := append(strings.Split(query[1], ","), query[2])
+	for _, column := range used {
+		if column = strings.TrimSpace(column); !columns[column] {
+			t.Errorf("Expected membership to have a %s column", column)
+		}
+	}
+}
@@ -1,12 +1,23 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrDuplicateAccount is returned when a username or email is already registered
+var ErrDuplicateAccount = errors.New("username or email is already registered")
+
 // AccountRepository handles database operations for accounts
 type AccountRepository struct {
 	db *sql.DB
@@ -58,15 +69,63 @@ func (r *AccountRepository) FindByUsername(username string) (*Account, error) {
 	return account, nil
 }
 
+// Create registers a new, non-system account with an already hashed password
+func (r *AccountRepository) Create(username, email, name, phone, hashedPassword string) (*Account, error) {
+	query := `
+		INSERT INTO account (username, email, name, phone, password, system, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, false, now(), now())
+		RETURNING id, created_at, updated_at`
+
+	account := &Account{
+		Username: username,
+		Email:    email,
+		Password: hashedPassword,
+		System:   sql.NullBool{Bool: false, Valid: true},
+	}
+	if name != "" {
+		account.Name = sql.NullString{String: name, Valid: true}
+	}
+	if phone != "" {
+		account.Phone = sql.NullString{String: phone, Valid: true}
+	}
+
+	err := r.db.QueryRow(query, username, email, account.Name, account.Phone, hashedPassword).Scan(
+		&account.ID, &account.CreatedAt, &account.UpdatedAt,
+	)
+	if err != nil {
+		// Unique violation, someone registered the same username or email in the meantime
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return nil, ErrDuplicateAccount
+		}
+		return nil, err
+	}
+
+	return account, nil
+}
+
 // ValidatePassword checks if the provided password matches the account's password
 func (a *Account) ValidatePassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(password))
 	return err == nil
 }
 
+// PasswordCost is the bcrypt cost for new hashes. Defaults to the cost of the hashes
+// migrated from the Python app ("$2b$12$"), main can override it from the environment.
+var PasswordCost = 12
+
+// NeedsRehash reports whether the stored hash is weaker than a new one would be, either a
+// lower bcrypt cost or not bcrypt at all. Only call after ValidatePassword succeeded.
+func (a *Account) NeedsRehash() bool {
+	if !strings.HasPrefix(a.Password, "$2a$") && !strings.HasPrefix(a.Password, "$2b$") && !strings.HasPrefix(a.Password, "$2y$") {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(a.Password))
+	return err != nil || cost < PasswordCost
+}
+
 // HashPassword generates a bcrypt hash of the password
 func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
 	if err != nil {
 		return "", fmt.Errorf("failed to hash password: %w", err)
 	}
@@ -75,7 +134,7 @@ func HashPassword(password string) (string, error) {
 
 // SetPassword hashes and sets a new password for the account
 func (a *Account) SetPassword(password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
 	if err != nil {
 		return err
 	}
@@ -83,6 +142,51 @@ func (a *Account) SetPassword(password string) error {
 	return nil
 }
 
+// Circle errors, their messages are shown to users
+var (
+	ErrInvalidCircle   = errors.New("invalid circle")
+	ErrDuplicateCircle = errors.New("a circle with that name already exists")
+	ErrCircleInUse     = errors.New("the circle is still in use")
+	ErrCircleNotEmpty  = errors.New("the circle has to be empty to be removed")
+	ErrNotCircleAdmin  = errors.New("not allowed to administer the circle")
+	ErrCommentRequired = errors.New("a comment is required to add members to this circle")
+	ErrAlreadyMember   = errors.New("account is already a member of the circle")
+	ErrNotMember       = errors.New("account isn't a member of the circle")
+	ErrLastCircleAdmin = errors.New("the last member of a self-administrated circle can't be removed, remove the circle instead")
+	ErrExpiryInPast    = errors.New("the membership would already be expired")
+
+	ErrMotivationRequired = errors.New("please explain why you want to join the circle")
+	ErrRequestPending     = errors.New("there is already a pending request to join the circle")
+	ErrRequestNotPending  = errors.New("the request has already been handled")
+)
+
+// Validate checks the fields against the same rules as the legacy create_circle and
+// the circle_management_style constraint. The message is meant for users.
+func (c *Circle) Validate() error {
+	switch {
+	case strings.TrimSpace(c.Name) == "":
+		return fmt.Errorf("%w: a name is required", ErrInvalidCircle)
+	case len(c.Name) > CircleNameMaxLength:
+		return fmt.Errorf("%w: the name can be at most %d characters", ErrInvalidCircle, CircleNameMaxLength)
+	case len(c.Description) > CircleNameMaxLength:
+		return fmt.Errorf("%w: the description can be at most %d characters", ErrInvalidCircle, CircleNameMaxLength)
+	}
+
+	switch c.ManagementStyle {
+	case ManagementStyleAdminCircle:
+		if !c.AdminCircleID.Valid {
+			return fmt.Errorf("%w: an admin circle is required when management style is set to ADMIN_CIRCLE", ErrInvalidCircle)
+		}
+		if c.ID != 0 && c.AdminCircleID.Int64 == int64(c.ID) {
+			return fmt.Errorf("%w: a circle can't be its own admin circle, use SELF_ADMIN instead", ErrInvalidCircle)
+		}
+	case ManagementStyleSelfAdmin:
+	default:
+		return fmt.Errorf("%w: unknown management style %q", ErrInvalidCircle, c.ManagementStyle)
+	}
+	return nil
+}
+
 // CircleRepository handles database operations for circles
 type CircleRepository struct {
 	db *sql.DB
@@ -92,11 +196,21 @@ func NewCircleRepository(db *sql.DB) *CircleRepository {
 	return &CircleRepository{db: db}
 }
 
+// circleColumns are the columns scanned by scanCircle. The description column is nullable
+// since V001.024, but the legacy app always stored a string.
+const circleColumns = `id, name, COALESCE(description, ''), management_style, admin_circle,
+		COALESCE(comment_required_for_membership, false), created_at, updated_at, created_by, updated_by`
+
+func scanCircle(row interface{ Scan(...interface{}) error }, circle *Circle) error {
+	return row.Scan(
+		&circle.ID, &circle.Name, &circle.Description, &circle.ManagementStyle, &circle.AdminCircleID,
+		&circle.CommentRequiredForMembership, &circle.CreatedAt, &circle.UpdatedAt, &circle.CreatedBy, &circle.UpdatedBy,
+	)
+}
+
 // GetAll retrieves all circles
 func (r *CircleRepository) GetAll() ([]Circle, error) {
-	query := `
-		SELECT id, name, description, created_at, updated_at, created_by, updated_by
-		FROM circle ORDER BY name`
+	query := `SELECT ` + circleColumns + ` FROM circle ORDER BY name`
 
 	rows, err := r.db.Query(query)
 	if err != nil {
@@ -107,920 +221,2793 @@ func (r *CircleRepository) GetAll() ([]Circle, error) {
 	var circles []Circle
 	for rows.Next() {
 		var circle Circle
-		err := rows.Scan(
-			&circle.ID, &circle.Name, &circle.Description,
-			&circle.CreatedAt, &circle.UpdatedAt, &circle.CreatedBy, &circle.UpdatedBy,
-		)
-		if err != nil {
+		if err := scanCircle(rows, &circle); err != nil {
 			return nil, err
 		}
 		circles = append(circles, circle)
 	}
 
-	return circles, nil
+	return circles, rows.Err()
 }
 
-// BadgeRepository handles database operations for badges
-type BadgeRepository struct {
-	db *sql.DB
-}
+// FindByID retrieves a circle by ID
+func (r *CircleRepository) FindByID(id int) (*Circle, error) {
+	query := `SELECT ` + circleColumns + ` FROM circle WHERE id = $1`
 
-func NewBadgeRepository(db *sql.DB) *BadgeRepository {
-	return &BadgeRepository{db: db}
+	circle := &Circle{}
+	if err := scanCircle(r.db.QueryRow(query, id), circle); err != nil {
+		return nil, err
+	}
+	return circle, nil
 }
 
-// GetAllDescriptions retrieves all badge descriptions
-func (r *BadgeRepository) GetAllDescriptions() ([]BadgeDescription, error) {
-	query := `
-		SELECT id, title, description, certification_circle, slug, icon, color,
-		       created_at, updated_at, created_by, updated_by
-		FROM badge_description ORDER BY title`
+// FindByName retrieves a circle by name
+func (r *CircleRepository) FindByName(name string) (*Circle, error) {
+	query := `SELECT ` + circleColumns + ` FROM circle WHERE name = $1`
 
-	rows, err := r.db.Query(query)
-	if err != nil {
+	circle := &Circle{}
+	if err := scanCircle(r.db.QueryRow(query, name), circle); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return circle, nil
+}
 
-	var descriptions []BadgeDescription
-	for rows.Next() {
-		var desc BadgeDescription
-		err := rows.Scan(
-			&desc.ID, &desc.Title, &desc.Description, &desc.CertificationCircleID,
-			&desc.Slug, &desc.Icon, &desc.Color,
-			&desc.CreatedAt, &desc.UpdatedAt, &desc.CreatedBy, &desc.UpdatedBy,
-		)
-		if err != nil {
-			return nil, err
-		}
-		descriptions = append(descriptions, desc)
+// Create stores a new circle. A SELF_ADMIN circle is administered by its own members, so like
+// the legacy create_circle it needs an initial member, who is added in the same transaction.
+// initialMemberID and comment are ignored for ADMIN_CIRCLE circles.
+func (r *CircleRepository) Create(circle *Circle, initialMemberID int, comment string, createdBy int) error {
+	if err := circle.Validate(); err != nil {
+		return err
+	}
+	if circle.ManagementStyle == ManagementStyleSelfAdmin && initialMemberID == 0 {
+		return fmt.Errorf("%w: an initial member is required when management style is set to SELF_ADMIN", ErrInvalidCircle)
 	}
 
-	return descriptions, nil
-}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-// GetBadgesForAccount retrieves all badges for a specific account
-func (r *BadgeRepository) GetBadgesForAccount(accountID int) ([]AccountBadge, error) {
 	query := `
-		SELECT ab.id, ab.account, ab.badge_description, ab.awarded_by,
-		       ab.created_at, ab.updated_at, ab.created_by, ab.updated_by,
-		       bd.title, bd.description, bd.icon, bd.color
-		FROM account_badge ab
-		JOIN badge_description bd ON ab.badge_description = bd.id
-		WHERE ab.account = $1
-		ORDER BY ab.created_at DESC`
+		INSERT INTO circle (name, description, management_style, admin_circle, comment_required_for_membership,
+		                    created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW(), $6, $6)
+		RETURNING id, created_at, updated_at`
 
-	rows, err := r.db.Query(query, accountID)
+	if circle.ManagementStyle == ManagementStyleSelfAdmin {
+		circle.AdminCircleID = sql.NullInt64{}
+	}
+	circle.CreatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+	circle.UpdatedBy = circle.CreatedBy
+
+	err = tx.QueryRow(query, circle.Name, circle.Description, circle.ManagementStyle, circle.AdminCircleID,
+		circle.CommentRequiredForMembership, createdBy).Scan(&circle.ID, &circle.CreatedAt, &circle.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return circleWriteError(err)
 	}
-	defer rows.Close()
 
-	var badges []AccountBadge
-	for rows.Next() {
-		var badge AccountBadge
-		var desc BadgeDescription
-		err := rows.Scan(
-			&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID,
-			&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
-			&desc.Title, &desc.Description, &desc.Icon, &desc.Color,
-		)
+	if circle.ManagementStyle == ManagementStyleSelfAdmin {
+		_, err = tx.Exec(`
+			INSERT INTO circle_member (circle, account, comment, created_at, updated_at, created_by, updated_by)
+			VALUES ($1, $2, $3, NOW(), NOW(), $4, $4)`,
+			circle.ID, initialMemberID, comment, createdBy)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		desc.ID = badge.BadgeDescriptionID
-		badge.BadgeDescription = &desc
-		badges = append(badges, badge)
 	}
 
-	return badges, nil
+	return tx.Commit()
 }
 
-// CreateBadgeDescription creates a new badge description
-func (r *BadgeRepository) CreateBadgeDescription(title string, createdBy int) (*BadgeDescription, error) {
-	query := `
-		INSERT INTO badge_description (title, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, NOW(), NOW(), $2, $2)
-		RETURNING id, created_at, updated_at`
-
-	var desc BadgeDescription
-	desc.Title = title
-	desc.CreatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
-	desc.UpdatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+// Update saves the name, description and management settings of a circle. A circle can
+// only become SELF_ADMIN while it has members, or nobody could administer it.
+func (r *CircleRepository) Update(circle *Circle, updatedBy int) error {
+	if err := circle.Validate(); err != nil {
+		return err
+	}
+	if circle.ManagementStyle == ManagementStyleSelfAdmin {
+		circle.AdminCircleID = sql.NullInt64{}
+	}
 
-	err := r.db.QueryRow(query, title, createdBy).Scan(
-		&desc.ID, &desc.CreatedAt, &desc.UpdatedAt,
-	)
+	query := `
+		UPDATE circle
+		SET name = $2, description = $3, management_style = $4, admin_circle = $5,
+		    comment_required_for_membership = $6, updated_at = NOW(), updated_by = $7
+		WHERE id = $1
+		  AND ($4 <> 'SELF_ADMIN' OR EXISTS (SELECT 1 FROM circle_member cm WHERE cm.circle = $1 AND ` + activeCircleMember + `))
+		RETURNING updated_at`
+
+	err := r.db.QueryRow(query, circle.ID, circle.Name, circle.Description, circle.ManagementStyle,
+		circle.AdminCircleID, circle.CommentRequiredForMembership, updatedBy).Scan(&circle.UpdatedAt)
+	if err == sql.ErrNoRows {
+		if _, findErr := r.FindByID(circle.ID); findErr != nil {
+			return findErr
+		}
+		return fmt.Errorf("%w: a SELF_ADMIN circle needs at least one member to administer it", ErrInvalidCircle)
+	}
 	if err != nil {
-		return nil, err
+		return circleWriteError(err)
 	}
 
-	return &desc, nil
+	circle.UpdatedBy = sql.NullInt64{Int64: int64(updatedBy), Valid: true}
+	return nil
 }
 
-// AwardBadge awards a badge to an account
-func (r *BadgeRepository) AwardBadge(accountID int, badgeDescriptionID int, awardedBy int) (*AccountBadge, error) {
-	query := `
-		INSERT INTO account_badge (account, badge_description, awarded_by, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, $2, $3, NOW(), NOW(), $3, $3)
-		RETURNING id, created_at, updated_at`
+// Delete removes a circle following the legacy remove_circle rules: an ADMIN_CIRCLE circle
+// has to be empty, a SELF_ADMIN circle may only contain the account removing it. Circles that
+// tools, badges or other circles refer to are kept, removing them would break those.
+func (r *CircleRepository) Delete(circleID int, removedBy int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	var badge AccountBadge
-	badge.AccountID = accountID
-	badge.BadgeDescriptionID = badgeDescriptionID
-	badge.AwardedByID = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
-	badge.CreatedBy = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
-	badge.UpdatedBy = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
+	var style string
+	if err := tx.QueryRow(`SELECT management_style FROM circle WHERE id = $1 FOR UPDATE`, circleID).Scan(&style); err != nil {
+		return err
+	}
 
-	err := r.db.QueryRow(query, accountID, badgeDescriptionID, awardedBy).Scan(
-		&badge.ID, &badge.CreatedAt, &badge.UpdatedAt,
-	)
+	var tools, badges, circles int
+	err = tx.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM tool_description WHERE circle = $1),
+		       (SELECT COUNT(*) FROM badge_description WHERE certification_circle = $1) +
+		       (SELECT COUNT(*) FROM badge_description_circle WHERE circle = $1),
+		       (SELECT COUNT(*) FROM circle WHERE admin_circle = $1 AND id <> $1)`,
+		circleID).Scan(&tools, &badges, &circles)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if tools+badges+circles > 0 {
+		var users []string
+		if tools > 0 {
+			users = append(users, fmt.Sprintf("%d tool(s)", tools))
+		}
+		if badges > 0 {
+			users = append(users, fmt.Sprintf("%d badge(s)", badges))
+		}
+		if circles > 0 {
+			users = append(users, fmt.Sprintf("%d circle(s) as their admin circle", circles))
+		}
+		return fmt.Errorf("%w by %s", ErrCircleInUse, strings.Join(users, ", "))
 	}
 
-	return &badge, nil
+	var members, others int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE cm.account <> $2)
+		FROM circle_member cm WHERE cm.circle = $1 AND `+activeCircleMember, circleID, removedBy).Scan(&members, &others)
+	if err != nil {
+		return err
+	}
+	switch style {
+	case ManagementStyleSelfAdmin:
+		if members != 1 || others != 0 {
+			return fmt.Errorf("%w: a self-administrated circle must only contain the remover", ErrCircleNotEmpty)
+		}
+	default:
+		if members != 0 {
+			return ErrCircleNotEmpty
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM circle_member WHERE circle = $1`, circleID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM circle_membership_request WHERE circle = $1`, circleID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM circle WHERE id = $1`, circleID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// FindBadgeDescriptionByTitle finds a badge description by title
-func (r *BadgeRepository) FindBadgeDescriptionByTitle(title string) (*BadgeDescription, error) {
-	query := `
-		SELECT id, title, description, certification_circle, slug, icon, color,
-		       created_at, updated_at, created_by, updated_by
-		FROM badge_description WHERE title = $1`
+// circleWriteError turns constraint violations into errors users can act on
+func circleWriteError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505": // unique_violation, only the name is unique
+			return ErrDuplicateCircle
+		case "23503": // foreign_key_violation, the admin circle was removed meanwhile
+			return fmt.Errorf("%w: the admin circle doesn't exist", ErrInvalidCircle)
+		}
+	}
+	return err
+}
 
-	var desc BadgeDescription
-	err := r.db.QueryRow(query, title).Scan(
-		&desc.ID, &desc.Title, &desc.Description, &desc.CertificationCircleID,
-		&desc.Slug, &desc.Icon, &desc.Color,
-		&desc.CreatedAt, &desc.UpdatedAt, &desc.CreatedBy, &desc.UpdatedBy,
-	)
+// activeCircleMember is the condition for circle_member rows, aliased cm, that still grant
+// membership. Expired rows are ignored right away, before the expiry job removes them.
+const activeCircleMember = `(cm.expires_at IS NULL OR cm.expires_at > NOW())`
+
+// IsAccountInCircle checks if an account is a member of a circle
+func (r *CircleRepository) IsAccountInCircle(accountID int, circleID int) (bool, error) {
+	query := `SELECT COUNT(*) FROM circle_member cm WHERE cm.account = $1 AND cm.circle = $2 AND ` + activeCircleMember
 
+	var count int
+	err := r.db.QueryRow(query, accountID, circleID).Scan(&count)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return &desc, nil
+	return count > 0, nil
 }
 
-// AccountHasBadge checks if an account has a specific badge
-func (r *BadgeRepository) AccountHasBadge(accountID int, badgeDescriptionID int) (bool, error) {
+// IsAccountInCircleByName checks if an account is a member of the named circle.
+// A circle that does not exist has no members.
+func (r *CircleRepository) IsAccountInCircleByName(accountID int, name string) (bool, error) {
 	query := `
-		SELECT COUNT(*) > 0 
-		FROM account_badge 
-		WHERE account = $1 AND badge_description = $2`
-	
-	var has bool
-	err := r.db.QueryRow(query, accountID, badgeDescriptionID).Scan(&has)
+		SELECT COUNT(*) FROM circle_member cm
+		JOIN circle c ON cm.circle = c.id
+		WHERE cm.account = $1 AND c.name = $2 AND ` + activeCircleMember
+
+	var count int
+	err := r.db.QueryRow(query, accountID, name).Scan(&count)
 	if err != nil {
 		return false, err
 	}
-	
-	return has, nil
+
+	return count > 0, nil
 }
 
-// DeleteAccountBadge removes a badge from an account
-func (r *BadgeRepository) DeleteAccountBadge(accountBadgeID int, accountID int) error {
-	query := `
-		DELETE FROM account_badge 
-		WHERE id = $1 AND account = $2`
-	
-	result, err := r.db.Exec(query, accountBadgeID, accountID)
-	if err != nil {
-		return err
-	}
-	
-	rowsAffected, err := result.RowsAffected()
+// canAdminCircleQuery counts the memberships giving account $2 admin rights on circle $1
+const canAdminCircleQuery = `
+		SELECT COUNT(*) FROM circle c
+		JOIN circle_member cm ON cm.circle = CASE
+			WHEN c.management_style = 'SELF_ADMIN' THEN c.id
+			ELSE c.admin_circle
+		END
+		WHERE c.id = $1 AND cm.account = $2 AND ` + activeCircleMember
+
+// CanAdminCircle checks if an account may administer a circle according to its management style:
+// SELF_ADMIN circles are administered by their own members, ADMIN_CIRCLE circles by the members of admin_circle
+func (r *CircleRepository) CanAdminCircle(accountID int, circleID int) (bool, error) {
+	var count int
+	err := r.db.QueryRow(canAdminCircleQuery, circleID, accountID).Scan(&count)
 	if err != nil {
-		return err
-	}
-	
-	if rowsAffected == 0 {
-		return fmt.Errorf("no badge found with id %d for account %d", accountBadgeID, accountID)
+		return false, err
 	}
-	
-	return nil
-}
-
-// ToolRepository handles database operations for tools
-type ToolRepository struct {
-	db *sql.DB
-}
 
-func NewToolRepository(db *sql.DB) *ToolRepository {
-	return &ToolRepository{db: db}
+	return count > 0, nil
 }
 
-// GetAllTools retrieves all tool descriptions
-func (r *ToolRepository) GetAllTools() ([]ToolDescription, error) {
+// GetMembers lists the members of a circle with their account and the account that added them.
+// Expired memberships are included until the expiry job removes them, see CircleMember.IsExpired.
+func (r *CircleRepository) GetMembers(circleID int) ([]CircleMember, error) {
 	query := `
-		SELECT td.id, td.name, td.description, td.circle, td.created_at, td.updated_at, td.created_by, td.updated_by,
-		       c.id, c.name, c.description
-		FROM tool_description td
-		LEFT JOIN circle c ON td.circle = c.id
-		ORDER BY td.name`
+		SELECT cm.id, cm.circle, cm.account, cm.created_by, cm.comment, cm.expires_at, cm.created_at, cm.updated_at,
+		       cm.created_by, cm.updated_by,
+		       a.username, a.name, i.username, i.name
+		FROM circle_member cm
+		JOIN account a ON a.id = cm.account
+		JOIN account i ON i.id = cm.created_by
+		WHERE cm.circle = $1
+		ORDER BY a.username`
 
-	rows, err := r.db.Query(query)
+	rows, err := r.db.Query(query, circleID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var tools []ToolDescription
+	var members []CircleMember
 	for rows.Next() {
-		var tool ToolDescription
-		var circle Circle
-		var circleID sql.NullInt64
-		var circleName sql.NullString
-		var circleDesc sql.NullString
-
+		var member CircleMember
+		account := &Account{}
+		issuer := &Account{}
 		err := rows.Scan(
-			&tool.ID, &tool.Name, &tool.Description, &tool.CircleID,
-			&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy, &tool.UpdatedBy,
-			&circleID, &circleName, &circleDesc,
+			&member.ID, &member.CircleID, &member.AccountID, &member.IssuerID, &member.Comment, &member.ExpiresAt,
+			&member.CreatedAt, &member.UpdatedAt, &member.CreatedBy, &member.UpdatedBy,
+			&account.Username, &account.Name, &issuer.Username, &issuer.Name,
 		)
 		if err != nil {
 			return nil, err
 		}
+		account.ID = member.AccountID
+		issuer.ID = member.IssuerID
+		member.Account = account
+		member.Issuer = issuer
+		members = append(members, member)
+	}
 
-		// Set the circle relationship if it exists
-		if circleID.Valid {
-			circle.ID = int(circleID.Int64)
-			circle.Name = circleName.String
-			circle.Description = circleDesc.String
-			tool.Circle = &circle
-		}
+	return members, rows.Err()
+}
 
-		tools = append(tools, tool)
+// AddMember adds an account to a circle on behalf of issuerID, who has to be able to administer
+// the circle. Like the legacy add_account_to_circle, adding an existing member is an error, but an
+// expired membership is replaced. expiresAt is optional, the zero time means no expiry.
+func (r *CircleRepository) AddMember(circleID, accountID, issuerID int, comment string, expiresAt time.Time) (*CircleMember, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	return tools, nil
+	member, err := addCircleMember(tx, circleID, accountID, issuerID, comment, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return member, tx.Commit()
 }
 
-// FindToolByID retrieves a tool by ID
-func (r *ToolRepository) FindToolByID(id int) (*ToolDescription, error) {
-	query := `
-		SELECT td.id, td.name, td.description, td.circle, td.created_at, td.updated_at, td.created_by, td.updated_by,
-		       c.id, c.name, c.description
-		FROM tool_description td
-		LEFT JOIN circle c ON td.circle = c.id
-		WHERE td.id = $1`
-
-	var tool ToolDescription
-	var circle Circle
-	var circleID sql.NullInt64
-	var circleName sql.NullString
-	var circleDesc sql.NullString
-
-	err := r.db.QueryRow(query, id).Scan(
-		&tool.ID, &tool.Name, &tool.Description, &tool.CircleID,
-		&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy, &tool.UpdatedBy,
-		&circleID, &circleName, &circleDesc,
-	)
-
+// addCircleMember is AddMember inside a transaction
+func addCircleMember(tx *sql.Tx, circleID, accountID, issuerID int, comment string, expiresAt time.Time) (*CircleMember, error) {
+	var commentRequired bool
+	err := tx.QueryRow(`SELECT COALESCE(comment_required_for_membership, false) FROM circle WHERE id = $1 FOR UPDATE`,
+		circleID).Scan(&commentRequired)
 	if err != nil {
 		return nil, err
 	}
-
-	// Set the circle relationship if it exists
-	if circleID.Valid {
-		circle.ID = int(circleID.Int64)
-		circle.Name = circleName.String
-		circle.Description = circleDesc.String
-		tool.Circle = &circle
+	if err := assertCanAdminCircle(tx, issuerID, circleID); err != nil {
+		return nil, err
+	}
+	comment = strings.TrimSpace(comment)
+	if commentRequired && comment == "" {
+		return nil, ErrCommentRequired
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return nil, ErrExpiryInPast
 	}
 
-	return &tool, nil
-}
-
-// CheckoutTool creates a tool checkout record
-func (r *ToolRepository) CheckoutTool(toolID int, accountID int) (*ToolCheckout, error) {
+	// An expired membership is replaced, unlinked from the badge that granted it so revoking that
+	// badge doesn't remove the new one
 	query := `
-		INSERT INTO tool_checkout (tool, account, checkout_at, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, $2, NOW(), NOW(), NOW(), $2, $2)
-		RETURNING id, checkout_at, created_at, updated_at`
-
-	var checkout ToolCheckout
-	checkout.ToolID = toolID
-	checkout.AccountID = accountID
-	checkout.CreatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
-	checkout.UpdatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+		INSERT INTO circle_member (circle, account, comment, expires_at, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, NOW(), NOW(), $5, $5)
+		ON CONFLICT (circle, account) DO UPDATE
+		SET comment = EXCLUDED.comment, expires_at = EXCLUDED.expires_at, created_at = NOW(), updated_at = NOW(),
+		    created_by = EXCLUDED.created_by, updated_by = EXCLUDED.updated_by, account_badge = NULL
+		WHERE circle_member.expires_at <= NOW()
+		RETURNING id, created_at, updated_at`
 
-	err := r.db.QueryRow(query, toolID, accountID).Scan(
-		&checkout.ID, &checkout.CheckoutAt, &checkout.CreatedAt, &checkout.UpdatedAt,
-	)
+	member := &CircleMember{
+		CircleID:  circleID,
+		AccountID: accountID,
+		IssuerID:  issuerID,
+		Comment:   sql.NullString{String: comment, Valid: comment != ""},
+		ExpiresAt: sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()},
+		CreatedBy: sql.NullInt64{Int64: int64(issuerID), Valid: true},
+		UpdatedBy: sql.NullInt64{Int64: int64(issuerID), Valid: true},
+	}
+	err = tx.QueryRow(query, circleID, accountID, member.Comment, member.ExpiresAt, issuerID).Scan(&member.ID, &member.CreatedAt, &member.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlreadyMember
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &checkout, nil
+	return member, nil
 }
 
-// CheckinTool updates a tool checkout record with checkin time
-func (r *ToolRepository) CheckinTool(checkoutID int) error {
-	query := `
-		UPDATE tool_checkout 
-		SET checkin_at = NOW(), updated_at = NOW()
-		WHERE id = $1 AND checkin_at IS NULL`
-
-	result, err := r.db.Exec(query, checkoutID)
+// RemoveMember removes an account from a circle on behalf of removedBy, who has to be able to
+// administer the circle. The last member of a SELF_ADMIN circle stays, nobody could manage it otherwise.
+func (r *CircleRepository) RemoveMember(circleID, accountID, removedBy int) error {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+	var style string
+	if err := tx.QueryRow(`SELECT management_style FROM circle WHERE id = $1 FOR UPDATE`, circleID).Scan(&style); err != nil {
+		return err
+	}
+	if err := assertCanAdminCircle(tx, removedBy, circleID); err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("tool checkout not found or already checked in")
+	if style == ManagementStyleSelfAdmin {
+		var others int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM circle_member cm WHERE cm.circle = $1 AND cm.account <> $2 AND `+
+			activeCircleMember, circleID, accountID).Scan(&others)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastCircleAdmin
+		}
 	}
 
-	return nil
+	result, err := tx.Exec(`DELETE FROM circle_member WHERE circle = $1 AND account = $2`, circleID, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotMember
+	}
+
+	return tx.Commit()
 }
 
-// GetActiveCheckouts retrieves all currently checked out tools
-func (r *ToolRepository) GetActiveCheckouts() ([]ToolCheckout, error) {
+// GetAdmins lists the accounts that may administer a circle: its own members for SELF_ADMIN
+// circles, the members of the admin circle for ADMIN_CIRCLE circles
+func (r *CircleRepository) GetAdmins(circleID int) ([]Account, error) {
 	query := `
-		SELECT tc.id, tc.tool, tc.account, tc.checkout_at, tc.checkin_at,
-		       tc.created_at, tc.updated_at, tc.created_by, tc.updated_by,
-		       td.name, td.description,
-		       a.username, a.name
-		FROM tool_checkout tc
-		JOIN tool_description td ON tc.tool = td.id
-		JOIN account a ON tc.account = a.id
-		WHERE tc.checkin_at IS NULL
-		ORDER BY tc.checkout_at DESC`
+		SELECT a.id, a.username, a.email, a.name
+		FROM circle c
+		JOIN circle_member cm ON cm.circle = CASE
+			WHEN c.management_style = 'SELF_ADMIN' THEN c.id
+			ELSE c.admin_circle
+		END
+		JOIN account a ON a.id = cm.account
+		WHERE c.id = $1 AND ` + activeCircleMember + `
+		ORDER BY a.username`
 
-	rows, err := r.db.Query(query)
+	rows, err := r.db.Query(query, circleID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var checkouts []ToolCheckout
+	var admins []Account
 	for rows.Next() {
-		var checkout ToolCheckout
-		var tool ToolDescription
 		var account Account
-		err := rows.Scan(
-			&checkout.ID, &checkout.ToolID, &checkout.AccountID, &checkout.CheckoutAt, &checkout.CheckinAt,
-			&checkout.CreatedAt, &checkout.UpdatedAt, &checkout.CreatedBy, &checkout.UpdatedBy,
-			&tool.Name, &tool.Description,
-			&account.Username, &account.Name,
-		)
-		if err != nil {
+		if err := rows.Scan(&account.ID, &account.Username, &account.Email, &account.Name); err != nil {
 			return nil, err
 		}
-
-		checkout.Tool = &tool
-		checkout.Account = &account
-		checkouts = append(checkouts, checkout)
+		admins = append(admins, account)
 	}
 
-	return checkouts, nil
+	return admins, rows.Err()
 }
 
-// CreateTool creates a new tool description
-func (r *ToolRepository) CreateTool(name, description string, circleID *int, userID int) (*ToolDescription, error) {
-	query := `
-		INSERT INTO tool_description (name, description, circle, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, $2, $3, NOW(), NOW(), $4, $4)
-		RETURNING id, created_at, updated_at`
+// CreateMembershipRequest asks to add accountID to a circle. Members can't ask again, and
+// there is only one pending request per member and circle.
+func (r *CircleRepository) CreateMembershipRequest(circleID, accountID int, motivation string) (*CircleMembershipRequest, error) {
+	motivation = strings.TrimSpace(motivation)
+	if motivation == "" {
+		return nil, ErrMotivationRequired
+	}
 
-	var tool ToolDescription
-	tool.Name = name
-	if description != "" {
-		tool.Description = sql.NullString{String: description, Valid: true}
+	isMember, err := r.IsAccountInCircle(accountID, circleID)
+	if err != nil {
+		return nil, err
 	}
-	if circleID != nil {
-		tool.CircleID = sql.NullInt64{Int64: int64(*circleID), Valid: true}
+	if isMember {
+		return nil, ErrAlreadyMember
 	}
-	tool.CreatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
-	tool.UpdatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
 
-	err := r.db.QueryRow(query, name, description, circleID, userID).Scan(
-		&tool.ID, &tool.CreatedAt, &tool.UpdatedAt,
-	)
+	query := `
+		INSERT INTO circle_membership_request (circle, account, motivation, status, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, 'PENDING', NOW(), NOW(), $2, $2)
+		RETURNING id, created_at, updated_at`
+
+	request := &CircleMembershipRequest{
+		CircleID:   circleID,
+		AccountID:  accountID,
+		Motivation: motivation,
+		Status:     RequestStatusPending,
+		CreatedBy:  sql.NullInt64{Int64: int64(accountID), Valid: true},
+		UpdatedBy:  sql.NullInt64{Int64: int64(accountID), Valid: true},
+	}
+	err = r.db.QueryRow(query, circleID, accountID, motivation).Scan(&request.ID, &request.CreatedAt, &request.UpdatedAt)
 	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return nil, ErrRequestPending
+		}
 		return nil, err
 	}
 
-	return &tool, nil
+	return request, nil
 }
 
-// UpdateTool updates an existing tool description
-func (r *ToolRepository) UpdateTool(id int, name, description string, circleID *int, userID int) (*ToolDescription, error) {
+// FindPendingRequest returns the account's pending request to join a circle, sql.ErrNoRows if none
+func (r *CircleRepository) FindPendingRequest(circleID, accountID int) (*CircleMembershipRequest, error) {
 	query := `
-		UPDATE tool_description 
-		SET name = $2, description = $3, circle = $4, updated_at = NOW(), updated_by = $5
-		WHERE id = $1
-		RETURNING created_at, updated_at, created_by`
-
-	var tool ToolDescription
-	tool.ID = id
-	tool.Name = name
-	if description != "" {
-		tool.Description = sql.NullString{String: description, Valid: true}
-	}
-	if circleID != nil {
-		tool.CircleID = sql.NullInt64{Int64: int64(*circleID), Valid: true}
+		SELECT id, circle, account, motivation, status, decided_by, decided_at, created_at, updated_at, created_by, updated_by
+		FROM circle_membership_request
+		WHERE circle = $1 AND account = $2 AND status = 'PENDING'`
+
+	request := &CircleMembershipRequest{}
+	err := r.db.QueryRow(query, circleID, accountID).Scan(
+		&request.ID, &request.CircleID, &request.AccountID, &request.Motivation, &request.Status,
+		&request.DecidedBy, &request.DecidedAt, &request.CreatedAt, &request.UpdatedAt, &request.CreatedBy, &request.UpdatedBy,
+	)
+	if err != nil {
+		return nil, err
 	}
-	tool.UpdatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
+	return request, nil
+}
 
-	err := r.db.QueryRow(query, id, name, description, circleID, userID).Scan(
-		&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy,
-	)
+// GetPendingRequests lists the pending requests to join a circle, oldest first
+func (r *CircleRepository) GetPendingRequests(circleID int) ([]CircleMembershipRequest, error) {
+	query := `
+		SELECT r.id, r.circle, r.account, r.motivation, r.status, r.decided_by, r.decided_at,
+		       r.created_at, r.updated_at, r.created_by, r.updated_by, a.username, a.name
+		FROM circle_membership_request r
+		JOIN account a ON a.id = r.account
+		WHERE r.circle = $1 AND r.status = 'PENDING'
+		ORDER BY r.created_at`
+
+	rows, err := r.db.Query(query, circleID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &tool, nil
+	var requests []CircleMembershipRequest
+	for rows.Next() {
+		var request CircleMembershipRequest
+		account := &Account{}
+		err := rows.Scan(
+			&request.ID, &request.CircleID, &request.AccountID, &request.Motivation, &request.Status,
+			&request.DecidedBy, &request.DecidedAt, &request.CreatedAt, &request.UpdatedAt, &request.CreatedBy, &request.UpdatedBy,
+			&account.Username, &account.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		account.ID = request.AccountID
+		request.Account = account
+		requests = append(requests, request)
+	}
+
+	return requests, rows.Err()
 }
 
-// DeleteTool deletes a tool description
-func (r *ToolRepository) DeleteTool(id int) error {
-	// First check if there are any active checkouts for this tool
-	checkQuery := `
-		SELECT COUNT(*) FROM tool_checkout 
-		WHERE tool = $1 AND checkin_at IS NULL`
+// ApproveMembershipRequest adds the requesting account to the circle with the motivation as
+// comment, on behalf of approverID who has to be able to administer the circle
+func (r *CircleRepository) ApproveMembershipRequest(circleID, requestID, approverID int) (*CircleMembershipRequest, error) {
+	return r.decideMembershipRequest(circleID, requestID, approverID, RequestStatusApproved)
+}
 
-	var count int
-	err := r.db.QueryRow(checkQuery, id).Scan(&count)
+// RejectMembershipRequest turns down a request, on behalf of an administrator of the circle
+func (r *CircleRepository) RejectMembershipRequest(circleID, requestID, deciderID int) (*CircleMembershipRequest, error) {
+	return r.decideMembershipRequest(circleID, requestID, deciderID, RequestStatusRejected)
+}
+
+func (r *CircleRepository) decideMembershipRequest(circleID, requestID, deciderID int, status string) (*CircleMembershipRequest, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if count > 0 {
-		return fmt.Errorf("cannot delete tool: it has active checkouts")
+	request := &CircleMembershipRequest{ID: requestID, CircleID: circleID}
+	err = tx.QueryRow(`
+		SELECT account, motivation, status FROM circle_membership_request
+		WHERE id = $1 AND circle = $2 FOR UPDATE`, requestID, circleID).Scan(
+		&request.AccountID, &request.Motivation, &request.Status)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != RequestStatusPending {
+		return nil, ErrRequestNotPending
 	}
 
-	deleteQuery := `DELETE FROM tool_description WHERE id = $1`
-	result, err := r.db.Exec(deleteQuery, id)
+	if status == RequestStatusApproved {
+		if _, err := addCircleMember(tx, circleID, request.AccountID, deciderID, request.Motivation, time.Time{}); err != nil {
+			return nil, err
+		}
+	} else if err := assertCanAdminCircle(tx, deciderID, circleID); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE circle_membership_request
+		SET status = $2, decided_by = $3, decided_at = NOW(), updated_at = NOW(), updated_by = $3
+		WHERE id = $1
+		RETURNING decided_at, updated_at`, requestID, status, deciderID).Scan(&request.DecidedAt, &request.UpdatedAt)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	request.Status = status
+	request.DecidedBy = sql.NullInt64{Int64: int64(deciderID), Valid: true}
+	request.UpdatedBy = request.DecidedBy
 
-	rowsAffected, err := result.RowsAffected()
+	return request, tx.Commit()
+}
+
+// DeleteExpiredMembers removes expired memberships and returns them, so they can be logged
+func (r *CircleRepository) DeleteExpiredMembers() ([]CircleMember, error) {
+	query := `
+		DELETE FROM circle_member
+		WHERE expires_at <= NOW()
+		RETURNING id, circle, account, created_by, comment, expires_at, created_at, updated_at, created_by, updated_by`
+
+	rows, err := r.db.Query(query)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("tool not found")
+	var members []CircleMember
+	for rows.Next() {
+		var member CircleMember
+		err := rows.Scan(
+			&member.ID, &member.CircleID, &member.AccountID, &member.IssuerID, &member.Comment, &member.ExpiresAt,
+			&member.CreatedAt, &member.UpdatedAt, &member.CreatedBy, &member.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
 	}
 
-	return nil
+	return members, rows.Err()
 }
 
-// EventRepository handles database operations for events
-type EventRepository struct {
-	db *sql.DB
+// assertCanAdminCircle is CanAdminCircle inside a transaction, returning ErrNotCircleAdmin if not allowed
+func assertCanAdminCircle(tx *sql.Tx, accountID, circleID int) error {
+	var count int
+	if err := tx.QueryRow(canAdminCircleQuery, circleID, accountID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotCircleAdmin
+	}
+	return nil
 }
 
-func NewEventRepository(db *sql.DB) *EventRepository {
-	return &EventRepository{db: db}
-}
+var (
+	ErrNotCertifier        = errors.New("only members of the certification circle can award this badge")
+	ErrInvalidBadge        = errors.New("invalid badge")
+	ErrDuplicateBadgeTitle = errors.New("a badge with that title already exists")
+	ErrDuplicateBadgeSlug  = errors.New("another badge already uses that slug")
 
-// CreateEvent creates a new event record
-func (r *EventRepository) CreateEvent(domain, key string, createdBy int) (*Event, error) {
-	query := `
-		INSERT INTO event (domain, key, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, $2, NOW(), NOW(), $3, $3)
-		RETURNING id, created_at, updated_at`
+	ErrRevocationReasonRequired = errors.New("please give a reason for revoking the badge")
+	ErrBadgeRevoked             = errors.New("the badge has already been revoked")
+	ErrBadgeDoesNotExpire       = errors.New("the badge doesn't expire, so it can't be renewed")
 
-	var event Event
-	event.Domain = domain
-	event.Key = key
-	event.CreatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
-	event.UpdatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+	// Anyone can award a badge without a certification circle to themselves, so such badges
+	// must not hand out circle memberships
+	ErrGrantsNeedCertification = errors.New("only badges with a certification circle can grant circle memberships")
+	ErrSelfAwardGrantsCircles  = errors.New("badges that grant circle memberships can't be awarded to yourself")
+)
 
-	err := r.db.QueryRow(query, domain, key, createdBy).Scan(
-		&event.ID, &event.CreatedAt, &event.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
+var (
+	badgeSlugPattern  = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	badgeColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
 
-	return &event, nil
+// IsValidBadgeColor reports whether color is a hex color like #ff8800 or #f80
+func IsValidBadgeColor(color string) bool {
+	return badgeColorPattern.MatchString(color)
 }
 
-// MembershipRepository handles database operations for memberships
-type MembershipRepository struct {
+// IsValidBadgeIcon reports whether icon is an http(s) URL or a path on this site
+func IsValidBadgeIcon(icon string) bool {
+	return strings.HasPrefix(icon, "https://") || strings.HasPrefix(icon, "http://") ||
+		(strings.HasPrefix(icon, "/") && !strings.HasPrefix(icon, "//"))
+}
+
+// Validate checks the fields of a badge description. Slugs are used in URLs, colors in
+// style attributes and icons as image sources, so they are restricted. The message is meant for users.
+func (d *BadgeDescription) Validate() error {
+	switch {
+	case strings.TrimSpace(d.Title) == "":
+		return fmt.Errorf("%w: a title is required", ErrInvalidBadge)
+	case len(d.Title) > BadgeTitleMaxLength:
+		return fmt.Errorf("%w: the title can be at most %d characters", ErrInvalidBadge, BadgeTitleMaxLength)
+	case d.Slug.Valid && !badgeSlugPattern.MatchString(d.Slug.String):
+		return fmt.Errorf("%w: the slug can only contain lowercase letters, digits and single dashes", ErrInvalidBadge)
+	case d.Color.Valid && !IsValidBadgeColor(d.Color.String):
+		return fmt.Errorf("%w: the color must be written like #ff8800", ErrInvalidBadge)
+	case d.Icon.Valid && !IsValidBadgeIcon(d.Icon.String):
+		return fmt.Errorf("%w: the icon must be an image URL", ErrInvalidBadge)
+	case d.ValidityDays.Valid && d.ValidityDays.Int64 <= 0:
+		return fmt.Errorf("%w: the validity must be a positive number of days", ErrInvalidBadge)
+	}
+	for _, reserved := range ReservedBadgeSlugs {
+		if d.Slug.Valid && d.Slug.String == reserved {
+			return fmt.Errorf("%w: %q can't be used as slug", ErrInvalidBadge, reserved)
+		}
+	}
+	return nil
+}
+
+// BadgeRepository handles database operations for badges
+type BadgeRepository struct {
 	db *sql.DB
 }
 
-func NewMembershipRepository(db *sql.DB) *MembershipRepository {
-	return &MembershipRepository{db: db}
+func NewBadgeRepository(db *sql.DB) *BadgeRepository {
+	return &BadgeRepository{db: db}
 }
 
-// GetMembershipByAccount retrieves membership info for an account
-func (r *MembershipRepository) GetMembershipByAccount(accountID int) (*Membership, error) {
-	query := `
-		SELECT id, account, first_membership, start_membership, fee, membership_number,
-		       created_at, updated_at, created_by, updated_by
-		FROM membership WHERE account = $1`
+// badgeDescriptionColumns are the columns scanned by scanBadgeDescription
+const badgeDescriptionColumns = `id, title, description, certification_circle, slug, icon, color, validity_days,
+		created_at, updated_at, created_by, updated_by`
 
-	var membership Membership
-	err := r.db.QueryRow(query, accountID).Scan(
-		&membership.ID, &membership.AccountID, &membership.FirstMembership, &membership.StartMembership,
-		&membership.Fee, &membership.MembershipNumber,
-		&membership.CreatedAt, &membership.UpdatedAt, &membership.CreatedBy, &membership.UpdatedBy,
+func scanBadgeDescription(row interface{ Scan(...interface{}) error }, desc *BadgeDescription) error {
+	return row.Scan(
+		&desc.ID, &desc.Title, &desc.Description, &desc.CertificationCircleID,
+		&desc.Slug, &desc.Icon, &desc.Color, &desc.ValidityDays,
+		&desc.CreatedAt, &desc.UpdatedAt, &desc.CreatedBy, &desc.UpdatedBy,
 	)
+}
+
+// GetAllDescriptions retrieves all badge descriptions
+func (r *BadgeRepository) GetAllDescriptions() ([]BadgeDescription, error) {
+	query := `
+		SELECT ` + badgeDescriptionColumns + `
+		FROM badge_description ORDER BY title`
 
+	rows, err := r.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &membership, nil
-}
-
-// IsAccountPayingMember checks if an account has an active Stripe payment
-func (r *MembershipRepository) IsAccountPayingMember(accountID int) (bool, error) {
+	var descriptions []BadgeDescription
+	for rows.Next() {
+		var desc BadgeDescription
+		if err := scanBadgeDescription(rows, &desc); err != nil {
+			return nil, err
+		}
+		descriptions = append(descriptions, desc)
+	}
+
+	return descriptions, nil
+}
+
+// FindBadgeDescriptionBySlug finds the badge shown on /badges/<slug>
+func (r *BadgeRepository) FindBadgeDescriptionBySlug(slug string) (*BadgeDescription, error) {
 	query := `
-		SELECT COUNT(*) FROM stripe_payment 
-		WHERE created_by = $1 AND end_date >= NOW() - INTERVAL '1 day'`
+		SELECT ` + badgeDescriptionColumns + `
+		FROM badge_description WHERE slug = $1`
 
-	var count int
-	err := r.db.QueryRow(query, accountID).Scan(&count)
-	if err != nil {
-		return false, err
+	var desc BadgeDescription
+	if err := scanBadgeDescription(r.db.QueryRow(query, slug), &desc); err != nil {
+		return nil, err
 	}
 
-	return count > 0, nil
+	return &desc, nil
 }
 
-// IsAccountCompanyEmployee checks if an account is employed by an active company
-func (r *MembershipRepository) IsAccountCompanyEmployee(accountID int) (bool, error) {
-	query := `
-		SELECT COUNT(*) FROM company_employee ce
-		JOIN company c ON ce.company = c.id
-		WHERE ce.account = $1 AND c.active = true`
+// UpdateBadgeDescription saves all fields of a badge description. Titles and slugs have to be unique.
+func (r *BadgeRepository) UpdateBadgeDescription(desc *BadgeDescription, updatedBy int) error {
+	if err := desc.Validate(); err != nil {
+		return err
+	}
 
-	var count int
-	err := r.db.QueryRow(query, accountID).Scan(&count)
+	tx, err := r.db.Begin()
 	if err != nil {
-		return false, err
+		return err
 	}
+	defer tx.Rollback()
 
-	return count > 0, nil
-}
+	// Locked so circles can't be granted while the certification circle is removed
+	if _, err := tx.Exec(`SELECT 1 FROM badge_description WHERE id = $1 FOR UPDATE`, desc.ID); err != nil {
+		return err
+	}
 
-// IsActiveMember checks if an account is an active member (paying or company employee)
-func (r *MembershipRepository) IsActiveMember(accountID int) (bool, error) {
-	// Check if paying member
-	isPaying, err := r.IsAccountPayingMember(accountID)
+	var titleTaken, slugTaken, grantsCircles bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM badge_description WHERE title = $2 AND id <> $1),
+		       EXISTS (SELECT 1 FROM badge_description WHERE slug = $3 AND id <> $1),
+		       EXISTS (SELECT 1 FROM badge_description_circle WHERE badge_description = $1)`,
+		desc.ID, desc.Title, desc.Slug).Scan(&titleTaken, &slugTaken, &grantsCircles)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if isPaying {
-		return true, nil
+	if titleTaken {
+		return ErrDuplicateBadgeTitle
+	}
+	if slugTaken {
+		return ErrDuplicateBadgeSlug
+	}
+	if grantsCircles && !desc.CertificationCircleID.Valid {
+		return ErrGrantsNeedCertification
 	}
 
-	// Check if company employee
-	isEmployee, err := r.IsAccountCompanyEmployee(accountID)
+	err = tx.QueryRow(`
+		UPDATE badge_description
+		SET title = $2, description = $3, certification_circle = $4, slug = $5, icon = $6, color = $7,
+		    validity_days = $8, updated_at = NOW(), updated_by = $9
+		WHERE id = $1
+		RETURNING updated_at`,
+		desc.ID, desc.Title, desc.Description, desc.CertificationCircleID, desc.Slug, desc.Icon, desc.Color,
+		desc.ValidityDays, updatedBy,
+	).Scan(&desc.UpdatedAt)
 	if err != nil {
-		return false, err
+		// Only the slug is unique, a title taken at the same time isn't caught here
+		if pqErr, ok := err.(*pq.Error); ok {
+			switch pqErr.Constraint {
+			case "badge_description_slug":
+				return ErrDuplicateBadgeSlug
+			case "badge_description_certification_circle_fkey":
+				return fmt.Errorf("%w: the certification circle doesn't exist", ErrInvalidBadge)
+			}
+		}
+		return err
 	}
+	desc.UpdatedBy = sql.NullInt64{Int64: int64(updatedBy), Valid: true}
 
-	return isEmployee, nil
+	return tx.Commit()
 }
 
-// GetActivePayingMembers retrieves all accounts with active payments
-func (r *MembershipRepository) GetActivePayingMembers() ([]Account, error) {
+// GetHolders lists the awarded copies of a badge with their receivers and awarders, oldest first.
+// Revoked badges are left out, expired badges are included. With publishedOnly only members
+// who publish their badges are listed.
+func (r *BadgeRepository) GetHolders(badgeDescriptionID int, publishedOnly bool) ([]AccountBadge, error) {
 	query := `
-		SELECT DISTINCT a.id, a.username, a.email, a.password, a.name, a.phone, 
-		       a.reset_token, a.reset_token_validity, a.system,
-		       a.created_at, a.updated_at, a.created_by, a.updated_by
-		FROM account a
-		JOIN stripe_payment sp ON sp.created_by = a.id
-		WHERE sp.end_date >= NOW() - INTERVAL '1 day'
-		ORDER BY a.username`
+		SELECT ab.id, ab.account, ab.badge_description, ab.awarded_by, ab.expires_at,
+		       ab.created_at, ab.updated_at, ab.created_by, ab.updated_by,
+		       a.username, COALESCE(aw.username, '')
+		FROM account_badge ab
+		JOIN account a ON a.id = ab.account
+		LEFT JOIN account aw ON aw.id = ab.awarded_by
+		WHERE ab.badge_description = $1 AND ab.revoked_at IS NULL AND (NOT $2 OR a.publish_badges)
+		ORDER BY ab.created_at`
 
-	rows, err := r.db.Query(query)
+	rows, err := r.db.Query(query, badgeDescriptionID, publishedOnly)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var accounts []Account
+	var badges []AccountBadge
 	for rows.Next() {
-		var account Account
+		var badge AccountBadge
+		account, awardedBy := &Account{}, &Account{}
 		err := rows.Scan(
-			&account.ID, &account.Username, &account.Email, &account.Password,
-			&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
-			&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
+			&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.ExpiresAt,
+			&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
+			&account.Username, &awardedBy.Username,
 		)
 		if err != nil {
 			return nil, err
 		}
-		accounts = append(accounts, account)
+		account.ID = badge.AccountID
+		awardedBy.ID = int(badge.AwardedByID.Int64)
+		badge.Account, badge.AwardedBy = account, awardedBy
+		badges = append(badges, badge)
 	}
 
-	return accounts, nil
+	return badges, rows.Err()
 }
 
-// GetActiveCompanies retrieves all active companies
-func (r *MembershipRepository) GetActiveCompanies() ([]Company, error) {
+// GetBadgesForAccount retrieves the badges an account holds, revoked badges are left out.
+// Expired badges are included so they can be shown as such.
+func (r *BadgeRepository) GetBadgesForAccount(accountID int) ([]AccountBadge, error) {
 	query := `
-		SELECT c.id, c.name, c.active, c.contact,
-		       c.created_at, c.updated_at, c.created_by, c.updated_by,
-		       a.username, a.name
-		FROM company c
-		JOIN account a ON c.contact = a.id
-		WHERE c.active = true
-		ORDER BY c.name`
+		SELECT ab.id, ab.account, ab.badge_description, ab.awarded_by, ab.expires_at,
+		       ab.created_at, ab.updated_at, ab.created_by, ab.updated_by,
+		       bd.title, bd.description, bd.slug, bd.icon, bd.color, bd.certification_circle, bd.validity_days
+		FROM account_badge ab
+		JOIN badge_description bd ON ab.badge_description = bd.id
+		WHERE ab.account = $1 AND ab.revoked_at IS NULL
+		ORDER BY ab.created_at DESC`
 
-	rows, err := r.db.Query(query)
+	rows, err := r.db.Query(query, accountID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var companies []Company
+	var badges []AccountBadge
 	for rows.Next() {
-		var company Company
-		var contact Account
+		var badge AccountBadge
+		var desc BadgeDescription
 		err := rows.Scan(
-			&company.ID, &company.Name, &company.Active, &company.ContactID,
-			&company.CreatedAt, &company.UpdatedAt, &company.CreatedBy, &company.UpdatedBy,
-			&contact.Username, &contact.Name,
+			&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.ExpiresAt,
+			&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
+			&desc.Title, &desc.Description, &desc.Slug, &desc.Icon, &desc.Color, &desc.CertificationCircleID, &desc.ValidityDays,
 		)
 		if err != nil {
 			return nil, err
 		}
-		contact.ID = company.ContactID
-		company.Contact = &contact
-		companies = append(companies, company)
+		desc.ID = badge.BadgeDescriptionID
+		badge.BadgeDescription = &desc
+		badges = append(badges, badge)
 	}
 
-	return companies, nil
+	return badges, nil
 }
 
-// GetRecentEvents retrieves recent events for a domain
-func (r *EventRepository) GetRecentEvents(domain string, limit int) ([]Event, error) {
+// GetBadgeHistoryForAccount lists every badge awarded to an account, newest first, including
+// revoked badges with who revoked them and why
+func (r *BadgeRepository) GetBadgeHistoryForAccount(accountID int) ([]AccountBadge, error) {
 	query := `
-		SELECT id, domain, key, text1, text2, text3, int1, int2, int3,
-		       created_at, updated_at, created_by, updated_by
-		FROM event 
-		WHERE domain = $1 
-		ORDER BY created_at DESC 
-		LIMIT $2`
+		SELECT ab.id, ab.account, ab.badge_description, ab.awarded_by,
+		       ab.revoked_at, ab.revoked_by, ab.revoked_reason,
+		       ab.created_at, ab.updated_at, ab.created_by, ab.updated_by,
+		       bd.title, bd.description, bd.slug, bd.icon, bd.color,
+		       COALESCE(aw.username, ''), COALESCE(rv.username, '')
+		FROM account_badge ab
+		JOIN badge_description bd ON ab.badge_description = bd.id
+		LEFT JOIN account aw ON aw.id = ab.awarded_by
+		LEFT JOIN account rv ON rv.id = ab.revoked_by
+		WHERE ab.account = $1
+		ORDER BY ab.created_at DESC`
 
-	rows, err := r.db.Query(query, domain, limit)
+	rows, err := r.db.Query(query, accountID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var events []Event
+	var badges []AccountBadge
 	for rows.Next() {
-		var event Event
+		var badge AccountBadge
+		var desc BadgeDescription
+		awardedBy, revokedBy := &Account{}, &Account{}
 		err := rows.Scan(
-			&event.ID, &event.Domain, &event.Key, &event.Text1, &event.Text2, &event.Text3,
-			&event.Int1, &event.Int2, &event.Int3,
-			&event.CreatedAt, &event.UpdatedAt, &event.CreatedBy, &event.UpdatedBy,
+			&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID,
+			&badge.RevokedAt, &badge.RevokedByID, &badge.RevokedReason,
+			&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
+			&desc.Title, &desc.Description, &desc.Slug, &desc.Icon, &desc.Color,
+			&awardedBy.Username, &revokedBy.Username,
 		)
 		if err != nil {
 			return nil, err
 		}
-		events = append(events, event)
+		desc.ID = badge.BadgeDescriptionID
+		awardedBy.ID = int(badge.AwardedByID.Int64)
+		badge.BadgeDescription, badge.AwardedBy = &desc, awardedBy
+		if badge.RevokedByID.Valid {
+			revokedBy.ID = int(badge.RevokedByID.Int64)
+			badge.RevokedBy = revokedBy
+		}
+		badges = append(badges, badge)
 	}
 
-	return events, nil
+	return badges, rows.Err()
 }
 
-// DoorRepository handles database operations for doors and access
-type DoorRepository struct {
-	db *sql.DB
-}
+// CreateBadgeDescription creates a new badge description
+func (r *BadgeRepository) CreateBadgeDescription(title string, createdBy int) (*BadgeDescription, error) {
+	query := `
+		INSERT INTO badge_description (title, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, NOW(), NOW(), $2, $2)
+		RETURNING id, created_at, updated_at`
 
-func NewDoorRepository(db *sql.DB) *DoorRepository {
-	return &DoorRepository{db: db}
-}
+	var desc BadgeDescription
+	desc.Title = title
+	desc.CreatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+	desc.UpdatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
 
-// GetConfiguredDoors returns hardcoded door configurations
-// In a real implementation, this would come from a config file or database
-func (r *DoorRepository) GetConfiguredDoors() []Door {
-	return []Door{
-		{
-			Key:       "main",
-			Name:      "Main Door",
-			OpenTime:  5,
-			Type:      "mqtt",
-			Topic:     "bitraf/door/main",
-			CircleIDs: []int{1}, // Admin circle
-		},
-		{
-			Key:       "workshop",
-			Name:      "Workshop Door",
-			OpenTime:  5,
-			Type:      "mqtt",
-			Topic:     "bitraf/door/workshop",
-			CircleIDs: []int{1, 2}, // Admin and member circles
-		},
-		{
-			Key:       "storage",
-			Name:      "Storage Room",
-			OpenTime:  3,
-			Type:      "dlock",
-			URL:       "http://storage-lock.local",
-			CircleIDs: []int{1}, // Admin only
-		},
+	err := r.db.QueryRow(query, title, createdBy).Scan(
+		&desc.ID, &desc.CreatedAt, &desc.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
 	}
+
+	return &desc, nil
 }
 
-// CanAccessDoor checks if an account can access a specific door
-func (r *DoorRepository) CanAccessDoor(accountID int, door Door, membershipRepo *MembershipRepository) (bool, error) {
-	// Check if account is company employee (has access to all doors)
-	isEmployee, err := membershipRepo.IsAccountCompanyEmployee(accountID)
+// AwardBadge awards a badge to an account. Badges with a certification circle can only be
+// awarded by its members, like the legacy badge_management.create_badge. Badges with a validity
+// expire after that many days. The receiver is added to the circles the badge grants, returned
+// in GrantedMemberships. Badges granting circles can't be awarded to oneself.
+func (r *BadgeRepository) AwardBadge(accountID int, badgeDescriptionID int, awardedBy int) (*AccountBadge, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return false, err
-	}
-	if isEmployee {
-		return true, nil
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Check if account is paying member
-	isPaying, err := membershipRepo.IsAccountPayingMember(accountID)
+	var badge AccountBadge
+	var certified, certifier, grantsCircles bool
+	err = tx.QueryRow(`
+		SELECT bd.certification_circle IS NOT NULL,
+		       bd.certification_circle IS NULL OR EXISTS (
+			SELECT 1 FROM circle_member cm
+			WHERE cm.circle = bd.certification_circle AND cm.account = $2 AND `+activeCircleMember+`),
+		       EXISTS (SELECT 1 FROM badge_description_circle bdc WHERE bdc.badge_description = bd.id),
+		       NOW() + bd.validity_days * INTERVAL '1 day'
+		FROM badge_description bd WHERE bd.id = $1`, badgeDescriptionID, awardedBy).Scan(&certified, &certifier, &grantsCircles, &badge.ExpiresAt)
 	if err != nil {
-		return false, err
-	}
-	if !isPaying {
-		return false, nil // Must be paying member for door access
+		return nil, err
 	}
-
-	// Check circle membership if required
-	if len(door.CircleIDs) > 0 {
-		for _, circleID := range door.CircleIDs {
-			isMember, err := r.IsAccountInCircle(accountID, circleID)
-			if err != nil {
-				return false, err
-			}
-			if isMember {
-				return true, nil
-			}
-		}
-		return false, nil // Not in any required circle
+	switch {
+	case !certifier:
+		return nil, ErrNotCertifier
+	case grantsCircles && !certified:
+		// Grants made before they required a certification circle
+		return nil, ErrGrantsNeedCertification
+	case grantsCircles && accountID == awardedBy:
+		return nil, ErrSelfAwardGrantsCircles
 	}
 
-	return true, nil // Paying member with no circle requirements
-}
+	query := `
+		INSERT INTO account_badge (account, badge_description, awarded_by, expires_at, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, NOW(), NOW(), $3, $3)
+		RETURNING id, created_at, updated_at`
 
-// IsAccountInCircle checks if an account is a member of a circle
-func (r *DoorRepository) IsAccountInCircle(accountID int, circleID int) (bool, error) {
-	query := `SELECT COUNT(*) FROM circle_member WHERE account = $1 AND circle = $2`
+	badge.AccountID = accountID
+	badge.BadgeDescriptionID = badgeDescriptionID
+	badge.AwardedByID = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
+	badge.CreatedBy = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
+	badge.UpdatedBy = sql.NullInt64{Int64: int64(awardedBy), Valid: true}
 
-	var count int
-	err := r.db.QueryRow(query, accountID, circleID).Scan(&count)
+	err = tx.QueryRow(query, accountID, badgeDescriptionID, awardedBy, badge.ExpiresAt).Scan(
+		&badge.ID, &badge.CreatedAt, &badge.UpdatedAt,
+	)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return count > 0, nil
+	if err := grantBadgeCircles(tx, &badge, awardedBy); err != nil {
+		return nil, err
+	}
+
+	return &badge, tx.Commit()
 }
 
-// GetAccessibleDoors returns doors that an account can access
-func (r *DoorRepository) GetAccessibleDoors(accountID int, membershipRepo *MembershipRepository) ([]Door, error) {
-	allDoors := r.GetConfiguredDoors()
-	var accessibleDoors []Door
+// RenewAccountBadge extends an expiring or expired badge by the validity of its description,
+// counted from now. Renewing takes a certifier, like awarding. The circle memberships the badge
+// grants are extended or added again, returned in GrantedMemberships.
+func (r *BadgeRepository) RenewAccountBadge(accountBadgeID int, renewedBy int) (*AccountBadge, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	for _, door := range allDoors {
+	badge := &AccountBadge{ID: accountBadgeID}
+	var certifier bool
+	err = tx.QueryRow(`
+		SELECT ab.account, ab.badge_description, ab.awarded_by, ab.revoked_at, ab.created_at, ab.created_by,
+		       NOW() + bd.validity_days * INTERVAL '1 day',
+		       bd.certification_circle IS NULL OR EXISTS (
+		           SELECT 1 FROM circle_member cm
+		           WHERE cm.circle = bd.certification_circle AND cm.account = $2 AND `+activeCircleMember+`)
+		FROM account_badge ab
+		JOIN badge_description bd ON bd.id = ab.badge_description
+		WHERE ab.id = $1
+		FOR UPDATE OF ab`, accountBadgeID, renewedBy).Scan(
+		&badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.RevokedAt, &badge.CreatedAt, &badge.CreatedBy,
+		&badge.ExpiresAt, &certifier)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !certifier:
+		return nil, ErrNotCertifier
+	case badge.IsRevoked():
+		return nil, ErrBadgeRevoked
+	case !badge.ExpiresAt.Valid:
+		return nil, ErrBadgeDoesNotExpire
+	}
+
+	err = tx.QueryRow(`
+		UPDATE account_badge
+		SET expires_at = $2, reminder_sent_at = NULL, updated_at = NOW(), updated_by = $3
+		WHERE id = $1
+		RETURNING updated_at`, accountBadgeID, badge.ExpiresAt, renewedBy).Scan(&badge.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	badge.UpdatedBy = sql.NullInt64{Int64: int64(renewedBy), Valid: true}
+
+	if err := grantBadgeCircles(tx, badge, renewedBy); err != nil {
+		return nil, err
+	}
+
+	return badge, tx.Commit()
+}
+
+// grantBadgeCircles adds the holder of an awarded badge to the circles the badge grants, with
+// actorID as the issuer. The memberships expire with the badge. Memberships without expiry are
+// kept as they are, memberships that end before the badge are taken over by it.
+func grantBadgeCircles(tx *sql.Tx, badge *AccountBadge, actorID int) error {
+	rows, err := tx.Query(`
+		INSERT INTO circle_member (circle, account, comment, account_badge, expires_at, created_at, updated_at, created_by, updated_by)
+		SELECT g.circle, ab.account, 'Granted by badge ' || bd.title, ab.id, ab.expires_at, NOW(), NOW(), $2, $2
+		FROM account_badge ab
+		JOIN badge_description bd ON bd.id = ab.badge_description
+		JOIN badge_description_circle g ON g.badge_description = bd.id
+		WHERE ab.id = $1
+		ON CONFLICT (circle, account) DO UPDATE
+		SET comment = EXCLUDED.comment, account_badge = EXCLUDED.account_badge, expires_at = EXCLUDED.expires_at,
+		    created_at = NOW(), updated_at = NOW(), created_by = EXCLUDED.created_by, updated_by = EXCLUDED.updated_by
+		WHERE circle_member.expires_at IS NOT NULL
+		  AND (EXCLUDED.expires_at IS NULL OR EXCLUDED.expires_at > circle_member.expires_at)
+		RETURNING id, circle, comment, expires_at, created_at, updated_at`, badge.ID, actorID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		member := CircleMember{
+			AccountID:      badge.AccountID,
+			IssuerID:       actorID,
+			AccountBadgeID: sql.NullInt64{Int64: int64(badge.ID), Valid: true},
+			CreatedBy:      sql.NullInt64{Int64: int64(actorID), Valid: true},
+			UpdatedBy:      sql.NullInt64{Int64: int64(actorID), Valid: true},
+		}
+		if err := rows.Scan(&member.ID, &member.CircleID, &member.Comment, &member.ExpiresAt, &member.CreatedAt, &member.UpdatedAt); err != nil {
+			return err
+		}
+		badge.GrantedMemberships = append(badge.GrantedMemberships, member)
+	}
+	return rows.Err()
+}
+
+// GetExpiringBadges lists badges that expire within the given time and whose holders haven't been
+// reminded yet, with the holder's account and the badge description
+func (r *BadgeRepository) GetExpiringBadges(within time.Duration) ([]AccountBadge, error) {
+	query := `
+		SELECT ab.id, ab.account, ab.badge_description, ab.expires_at,
+		       a.username, a.email, a.name, bd.title, bd.slug
+		FROM account_badge ab
+		JOIN account a ON a.id = ab.account
+		JOIN badge_description bd ON bd.id = ab.badge_description
+		WHERE ab.revoked_at IS NULL AND ab.reminder_sent_at IS NULL
+		  AND ab.expires_at > NOW() AND ab.expires_at <= NOW() + make_interval(secs => $1)
+		ORDER BY ab.expires_at`
+
+	rows, err := r.db.Query(query, int64(within.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var badges []AccountBadge
+	for rows.Next() {
+		var badge AccountBadge
+		account, desc := &Account{}, &BadgeDescription{}
+		err := rows.Scan(
+			&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.ExpiresAt,
+			&account.Username, &account.Email, &account.Name, &desc.Title, &desc.Slug,
+		)
+		if err != nil {
+			return nil, err
+		}
+		account.ID, desc.ID = badge.AccountID, badge.BadgeDescriptionID
+		badge.Account, badge.BadgeDescription = account, desc
+		badges = append(badges, badge)
+	}
+
+	return badges, rows.Err()
+}
+
+// MarkReminderSent records that the holder of a badge has been reminded that it expires
+func (r *BadgeRepository) MarkReminderSent(accountBadgeID int) error {
+	_, err := r.db.Exec(`UPDATE account_badge SET reminder_sent_at = NOW() WHERE id = $1`, accountBadgeID)
+	return err
+}
+
+// GetGrantedCircles lists the circles a badge grants
+func (r *BadgeRepository) GetGrantedCircles(badgeDescriptionID int) ([]Circle, error) {
+	query := `
+		SELECT ` + circleColumns + `
+		FROM circle
+		WHERE id IN (SELECT circle FROM badge_description_circle WHERE badge_description = $1)
+		ORDER BY name`
+
+	rows, err := r.db.Query(query, badgeDescriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var circles []Circle
+	for rows.Next() {
+		var circle Circle
+		if err := scanCircle(rows, &circle); err != nil {
+			return nil, err
+		}
+		circles = append(circles, circle)
+	}
+
+	return circles, rows.Err()
+}
+
+// SetGrantedCircles replaces the circles a badge grants. Only future awards are affected,
+// members who already have the badge keep their memberships as they are. Only badges with a
+// certification circle can grant circles.
+func (r *BadgeRepository) SetGrantedCircles(badgeDescriptionID int, circleIDs []int, updatedBy int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locked so the certification circle can't be removed at the same time
+	var certified bool
+	err = tx.QueryRow(`SELECT certification_circle IS NOT NULL FROM badge_description WHERE id = $1 FOR UPDATE`,
+		badgeDescriptionID).Scan(&certified)
+	if err != nil {
+		return err
+	}
+	if len(circleIDs) > 0 && !certified {
+		return ErrGrantsNeedCertification
+	}
+
+	ids := make([]int64, len(circleIDs))
+	for i, id := range circleIDs {
+		ids[i] = int64(id)
+	}
+
+	_, err = tx.Exec(`DELETE FROM badge_description_circle WHERE badge_description = $1 AND NOT (circle = ANY($2))`,
+		badgeDescriptionID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO badge_description_circle (badge_description, circle, created_at, updated_at, created_by, updated_by)
+		SELECT $1, c.id, NOW(), NOW(), $3, $3 FROM circle c WHERE c.id = ANY($2)
+		ON CONFLICT (badge_description, circle) DO NOTHING`, badgeDescriptionID, pq.Array(ids), updatedBy)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindBadgeDescriptionByID finds a badge description by id
+func (r *BadgeRepository) FindBadgeDescriptionByID(id int) (*BadgeDescription, error) {
+	query := `
+		SELECT ` + badgeDescriptionColumns + `
+		FROM badge_description WHERE id = $1`
+
+	var desc BadgeDescription
+	if err := scanBadgeDescription(r.db.QueryRow(query, id), &desc); err != nil {
+		return nil, err
+	}
+
+	return &desc, nil
+}
+
+// FindBadgeDescriptionByTitle finds a badge description by title
+func (r *BadgeRepository) FindBadgeDescriptionByTitle(title string) (*BadgeDescription, error) {
+	query := `
+		SELECT ` + badgeDescriptionColumns + `
+		FROM badge_description WHERE title = $1`
+
+	var desc BadgeDescription
+	if err := scanBadgeDescription(r.db.QueryRow(query, title), &desc); err != nil {
+		return nil, err
+	}
+
+	return &desc, nil
+}
+
+// AccountHasBadge checks if an account holds a specific badge, revoked and expired badges don't count
+func (r *BadgeRepository) AccountHasBadge(accountID int, badgeDescriptionID int) (bool, error) {
+	query := `
+		SELECT COUNT(*) > 0 
+		FROM account_badge 
+		WHERE account = $1 AND badge_description = $2 AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > NOW())`
+	
+	var has bool
+	err := r.db.QueryRow(query, accountID, badgeDescriptionID).Scan(&has)
+	if err != nil {
+		return false, err
+	}
+	
+	return has, nil
+}
+
+// FindAccountBadgeByID finds an awarded badge with its receiver and description, revoked or not
+func (r *BadgeRepository) FindAccountBadgeByID(id int) (*AccountBadge, error) {
+	query := `
+		SELECT ab.id, ab.account, ab.badge_description, ab.awarded_by, ab.expires_at,
+		       ab.revoked_at, ab.revoked_by, ab.revoked_reason,
+		       ab.created_at, ab.updated_at, ab.created_by, ab.updated_by,
+		       a.username, a.email
+		FROM account_badge ab
+		JOIN account a ON a.id = ab.account
+		WHERE ab.id = $1`
+
+	var badge AccountBadge
+	account := &Account{}
+	err := r.db.QueryRow(query, id).Scan(
+		&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.ExpiresAt,
+		&badge.RevokedAt, &badge.RevokedByID, &badge.RevokedReason,
+		&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
+		&account.Username, &account.Email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	account.ID = badge.AccountID
+	badge.Account = account
+
+	return &badge, nil
+}
+
+// FindHeldBadge finds the newest copy of a badge awarded to an account that hasn't been revoked,
+// expired or not. Expired badges are renewed rather than awarded again.
+func (r *BadgeRepository) FindHeldBadge(accountID int, badgeDescriptionID int) (*AccountBadge, error) {
+	query := `
+		SELECT id, account, badge_description, awarded_by, expires_at, created_at, updated_at, created_by, updated_by
+		FROM account_badge
+		WHERE account = $1 AND badge_description = $2 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1`
+
+	var badge AccountBadge
+	err := r.db.QueryRow(query, accountID, badgeDescriptionID).Scan(
+		&badge.ID, &badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.ExpiresAt,
+		&badge.CreatedAt, &badge.UpdatedAt, &badge.CreatedBy, &badge.UpdatedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &badge, nil
+}
+
+// CanRevokeBadge reports whether accountID may revoke an awarded badge: its awarder and members
+// of the badge's certification circle may. Admins may revoke any badge, which callers check.
+func (r *BadgeRepository) CanRevokeBadge(accountBadgeID int, accountID int) (bool, error) {
+	query := `
+		SELECT ab.awarded_by = $2 OR EXISTS (
+			SELECT 1 FROM circle_member cm
+			WHERE cm.circle = bd.certification_circle AND cm.account = $2 AND ` + activeCircleMember + `)
+		FROM account_badge ab
+		JOIN badge_description bd ON bd.id = ab.badge_description
+		WHERE ab.id = $1`
+
+	var can sql.NullBool
+	if err := r.db.QueryRow(query, accountBadgeID, accountID).Scan(&can); err != nil {
+		return false, err
+	}
+	return can.Valid && can.Bool, nil
+}
+
+// RevokeAccountBadge revokes an awarded badge on behalf of revokedBy, who has to give a reason.
+// The badge is kept in the member's history. Circle memberships the badge granted are removed,
+// unless another of the member's badges grants them too, then they are moved to that badge.
+// The removed memberships are returned in GrantedMemberships.
+func (r *BadgeRepository) RevokeAccountBadge(accountBadgeID int, revokedBy int, reason string) (*AccountBadge, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, ErrRevocationReasonRequired
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	badge := &AccountBadge{ID: accountBadgeID}
+	err = tx.QueryRow(`
+		SELECT account, badge_description, awarded_by, revoked_at, created_at, created_by
+		FROM account_badge WHERE id = $1 FOR UPDATE`, accountBadgeID).Scan(
+		&badge.AccountID, &badge.BadgeDescriptionID, &badge.AwardedByID, &badge.RevokedAt, &badge.CreatedAt, &badge.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+	if badge.IsRevoked() {
+		return nil, ErrBadgeRevoked
+	}
+
+	_, err = tx.Exec(`
+		UPDATE circle_member cm
+		SET account_badge = other.id, expires_at = other.expires_at, updated_at = NOW(), updated_by = $3
+		FROM (
+			SELECT DISTINCT ON (g.circle) g.circle, ab.id, ab.expires_at
+			FROM account_badge ab
+			JOIN badge_description_circle g ON g.badge_description = ab.badge_description
+			WHERE ab.account = $2 AND ab.id <> $1 AND ab.revoked_at IS NULL
+			  AND (ab.expires_at IS NULL OR ab.expires_at > NOW())
+			ORDER BY g.circle, ab.expires_at DESC NULLS FIRST, ab.id
+		) other
+		WHERE cm.account_badge = $1 AND cm.circle = other.circle`, accountBadgeID, badge.AccountID, revokedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		DELETE FROM circle_member WHERE account_badge = $1
+		RETURNING id, circle, account, created_by, comment, expires_at, account_badge, created_at, updated_at, created_by, updated_by`,
+		accountBadgeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member CircleMember
+		err := rows.Scan(
+			&member.ID, &member.CircleID, &member.AccountID, &member.IssuerID, &member.Comment, &member.ExpiresAt,
+			&member.AccountBadgeID, &member.CreatedAt, &member.UpdatedAt, &member.CreatedBy, &member.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		badge.GrantedMemberships = append(badge.GrantedMemberships, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE account_badge
+		SET revoked_at = NOW(), revoked_by = $2, revoked_reason = $3, updated_at = NOW(), updated_by = $2
+		WHERE id = $1
+		RETURNING revoked_at, updated_at`, accountBadgeID, revokedBy, reason).Scan(&badge.RevokedAt, &badge.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	badge.RevokedByID = sql.NullInt64{Int64: int64(revokedBy), Valid: true}
+	badge.RevokedReason = sql.NullString{String: reason, Valid: true}
+	badge.UpdatedBy = badge.RevokedByID
+
+	return badge, tx.Commit()
+}
+
+// ToolRepository handles database operations for tools
+type ToolRepository struct {
+	db *sql.DB
+}
+
+func NewToolRepository(db *sql.DB) *ToolRepository {
+	return &ToolRepository{db: db}
+}
+
+// GetAllTools retrieves all tool descriptions
+func (r *ToolRepository) GetAllTools() ([]ToolDescription, error) {
+	query := `
+		SELECT td.id, td.name, td.description, td.circle, td.created_at, td.updated_at, td.created_by, td.updated_by,
+		       c.id, c.name, c.description
+		FROM tool_description td
+		LEFT JOIN circle c ON td.circle = c.id
+		ORDER BY td.name`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tools []ToolDescription
+	for rows.Next() {
+		var tool ToolDescription
+		var circle Circle
+		var circleID sql.NullInt64
+		var circleName sql.NullString
+		var circleDesc sql.NullString
+
+		err := rows.Scan(
+			&tool.ID, &tool.Name, &tool.Description, &tool.CircleID,
+			&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy, &tool.UpdatedBy,
+			&circleID, &circleName, &circleDesc,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Set the circle relationship if it exists
+		if circleID.Valid {
+			circle.ID = int(circleID.Int64)
+			circle.Name = circleName.String
+			circle.Description = circleDesc.String
+			tool.Circle = &circle
+		}
+
+		tools = append(tools, tool)
+	}
+
+	return tools, nil
+}
+
+// FindToolByID retrieves a tool by ID
+func (r *ToolRepository) FindToolByID(id int) (*ToolDescription, error) {
+	query := `
+		SELECT td.id, td.name, td.description, td.circle, td.created_at, td.updated_at, td.created_by, td.updated_by,
+		       c.id, c.name, c.description
+		FROM tool_description td
+		LEFT JOIN circle c ON td.circle = c.id
+		WHERE td.id = $1`
+
+	var tool ToolDescription
+	var circle Circle
+	var circleID sql.NullInt64
+	var circleName sql.NullString
+	var circleDesc sql.NullString
+
+	err := r.db.QueryRow(query, id).Scan(
+		&tool.ID, &tool.Name, &tool.Description, &tool.CircleID,
+		&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy, &tool.UpdatedBy,
+		&circleID, &circleName, &circleDesc,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the circle relationship if it exists
+	if circleID.Valid {
+		circle.ID = int(circleID.Int64)
+		circle.Name = circleName.String
+		circle.Description = circleDesc.String
+		tool.Circle = &circle
+	}
+
+	return &tool, nil
+}
+
+var (
+	ErrToolAlreadyCheckedOut = errors.New("you have already checked out this tool")
+	ErrToolCheckoutConflict  = errors.New("someone else checked out the tool at the same time, please try again")
+	ErrToolNotCheckedOut     = errors.New("tool checkout not found or already checked in")
+)
+
+// CheckoutTool checks out a tool for an account, like the legacy ToolClient.checkout_tool. Checking
+// out a tool you already have is refused. A tool checked out by someone else is checked in first,
+// that checkout is returned in TakenOver.
+func (r *ToolRepository) CheckoutTool(toolID int, accountID int) (*ToolCheckout, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var checkout ToolCheckout
+	previous := &ToolCheckout{ToolID: toolID, Account: &Account{}}
+	err = tx.QueryRow(`
+		SELECT tc.id, tc.account, COALESCE(tc.started, tc.created_at), tc.created_at, a.username
+		FROM tool_checkout tc
+		JOIN account a ON a.id = tc.account
+		WHERE tc.tool_description = $1
+		FOR UPDATE OF tc`, toolID).Scan(
+		&previous.ID, &previous.AccountID, &previous.CheckoutAt, &previous.CreatedAt, &previous.Account.Username)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	case previous.AccountID == accountID:
+		return nil, ErrToolAlreadyCheckedOut
+	default:
+		if _, err := tx.Exec(`DELETE FROM tool_checkout WHERE id = $1`, previous.ID); err != nil {
+			return nil, err
+		}
+		previous.Account.ID = previous.AccountID
+		checkout.TakenOver = previous
+	}
+
+	query := `
+		INSERT INTO tool_checkout (tool_description, account, started, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, NOW(), NOW(), NOW(), $2, $2)
+		RETURNING id, started, created_at, updated_at`
+
+	checkout.ToolID = toolID
+	checkout.AccountID = accountID
+	checkout.CreatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+	checkout.UpdatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+
+	err = tx.QueryRow(query, toolID, accountID).Scan(
+		&checkout.ID, &checkout.CheckoutAt, &checkout.CreatedAt, &checkout.UpdatedAt,
+	)
+	if err != nil {
+		// Without a checkout to lock, two members can get here at once, the unique index stops the second
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return nil, ErrToolCheckoutConflict
+		}
+		return nil, err
+	}
+
+	return &checkout, tx.Commit()
+}
+
+// CheckinTool checks in a tool by deleting its checkout, which is returned with the tool
+func (r *ToolRepository) CheckinTool(checkoutID int) (*ToolCheckout, error) {
+	query := `
+		DELETE FROM tool_checkout tc
+		USING tool_description td
+		WHERE tc.id = $1 AND td.id = tc.tool_description
+		RETURNING tc.id, tc.tool_description, tc.account, COALESCE(tc.started, tc.created_at),
+		          tc.created_at, tc.updated_at, tc.created_by, tc.updated_by, td.name`
+
+	var checkout ToolCheckout
+	tool := &ToolDescription{}
+	err := r.db.QueryRow(query, checkoutID).Scan(
+		&checkout.ID, &checkout.ToolID, &checkout.AccountID, &checkout.CheckoutAt,
+		&checkout.CreatedAt, &checkout.UpdatedAt, &checkout.CreatedBy, &checkout.UpdatedBy, &tool.Name,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrToolNotCheckedOut
+	}
+	if err != nil {
+		return nil, err
+	}
+	tool.ID = checkout.ToolID
+	checkout.Tool = tool
+
+	return &checkout, nil
+}
+
+// GetActiveCheckouts retrieves all currently checked out tools
+func (r *ToolRepository) GetActiveCheckouts() ([]ToolCheckout, error) {
+	query := `
+		SELECT tc.id, tc.tool_description, tc.account, COALESCE(tc.started, tc.created_at),
+		       tc.created_at, tc.updated_at, tc.created_by, tc.updated_by,
+		       td.name, td.description,
+		       a.username, a.name
+		FROM tool_checkout tc
+		JOIN tool_description td ON tc.tool_description = td.id
+		JOIN account a ON tc.account = a.id
+		ORDER BY 4 DESC`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkouts []ToolCheckout
+	for rows.Next() {
+		var checkout ToolCheckout
+		var tool ToolDescription
+		var account Account
+		err := rows.Scan(
+			&checkout.ID, &checkout.ToolID, &checkout.AccountID, &checkout.CheckoutAt,
+			&checkout.CreatedAt, &checkout.UpdatedAt, &checkout.CreatedBy, &checkout.UpdatedBy,
+			&tool.Name, &tool.Description,
+			&account.Username, &account.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		checkout.Tool = &tool
+		checkout.Account = &account
+		checkouts = append(checkouts, checkout)
+	}
+
+	return checkouts, nil
+}
+
+// CreateTool creates a new tool description
+func (r *ToolRepository) CreateTool(name, description string, circleID *int, userID int) (*ToolDescription, error) {
+	query := `
+		INSERT INTO tool_description (name, description, circle, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, NOW(), NOW(), $4, $4)
+		RETURNING id, created_at, updated_at`
+
+	var tool ToolDescription
+	tool.Name = name
+	if description != "" {
+		tool.Description = sql.NullString{String: description, Valid: true}
+	}
+	if circleID != nil {
+		tool.CircleID = sql.NullInt64{Int64: int64(*circleID), Valid: true}
+	}
+	tool.CreatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
+	tool.UpdatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
+
+	err := r.db.QueryRow(query, name, description, circleID, userID).Scan(
+		&tool.ID, &tool.CreatedAt, &tool.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tool, nil
+}
+
+// UpdateTool updates an existing tool description
+func (r *ToolRepository) UpdateTool(id int, name, description string, circleID *int, userID int) (*ToolDescription, error) {
+	query := `
+		UPDATE tool_description 
+		SET name = $2, description = $3, circle = $4, updated_at = NOW(), updated_by = $5
+		WHERE id = $1
+		RETURNING created_at, updated_at, created_by`
+
+	var tool ToolDescription
+	tool.ID = id
+	tool.Name = name
+	if description != "" {
+		tool.Description = sql.NullString{String: description, Valid: true}
+	}
+	if circleID != nil {
+		tool.CircleID = sql.NullInt64{Int64: int64(*circleID), Valid: true}
+	}
+	tool.UpdatedBy = sql.NullInt64{Int64: int64(userID), Valid: true}
+
+	err := r.db.QueryRow(query, id, name, description, circleID, userID).Scan(
+		&tool.CreatedAt, &tool.UpdatedAt, &tool.CreatedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tool, nil
+}
+
+// DeleteTool deletes a tool description
+func (r *ToolRepository) DeleteTool(id int) error {
+	// First check if there are any active checkouts for this tool
+	checkQuery := `
+		SELECT COUNT(*) FROM tool_checkout 
+		WHERE tool = $1 AND checkin_at IS NULL`
+
+	var count int
+	err := r.db.QueryRow(checkQuery, id).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("cannot delete tool: it has active checkouts")
+	}
+
+	deleteQuery := `DELETE FROM tool_description WHERE id = $1`
+	result, err := r.db.Exec(deleteQuery, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("tool not found")
+	}
+
+	return nil
+}
+
+// EventRepository handles database operations for events
+type EventRepository struct {
+	db *sql.DB
+}
+
+func NewEventRepository(db *sql.DB) *EventRepository {
+	return &EventRepository{db: db}
+}
+
+// CreateEvent creates a new event record
+func (r *EventRepository) CreateEvent(domain, key string, createdBy int) (*Event, error) {
+	query := `
+		INSERT INTO event (domain, key, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, NOW(), NOW(), $3, $3)
+		RETURNING id, created_at, updated_at`
+
+	var event Event
+	event.Domain = domain
+	event.Key = key
+	event.CreatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+	event.UpdatedBy = sql.NullInt64{Int64: int64(createdBy), Valid: true}
+
+	err := r.db.QueryRow(query, domain, key, createdBy).Scan(
+		&event.ID, &event.CreatedAt, &event.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// CreateEventWithData creates an event record including its text and int fields
+func (r *EventRepository) CreateEventWithData(event *Event) error {
+	query := `
+		INSERT INTO event (domain, key, text1, text2, text3, int1, int2, int3, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW(), $9, $9)
+		RETURNING id, created_at, updated_at`
+
+	event.UpdatedBy = event.CreatedBy
+
+	return r.db.QueryRow(query,
+		event.Domain, event.Key, event.Text1, event.Text2, event.Text3,
+		event.Int1, event.Int2, event.Int3, event.CreatedBy,
+	).Scan(&event.ID, &event.CreatedAt, &event.UpdatedAt)
+}
+
+// MembershipRepository handles database operations for memberships
+type MembershipRepository struct {
+	db *sql.DB
+}
+
+func NewMembershipRepository(db *sql.DB) *MembershipRepository {
+	return &MembershipRepository{db: db}
+}
+
+// membershipByAccountQuery finds an account's membership, which like the legacy get_membership
+// is the one the account created
+const membershipByAccountQuery = `
+		SELECT id, created_by, first_membership, start_membership, fee,
+		       created_at, updated_at, updated_by
+		FROM membership WHERE created_by = $1`
+
+// GetMembershipByAccount retrieves membership info for an account
+func (r *MembershipRepository) GetMembershipByAccount(accountID int) (*Membership, error) {
+	var membership Membership
+	err := r.db.QueryRow(membershipByAccountQuery, accountID).Scan(
+		&membership.ID, &membership.AccountID, &membership.FirstMembership, &membership.StartMembership,
+		&membership.Fee, &membership.CreatedAt, &membership.UpdatedAt, &membership.UpdatedBy,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	membership.CreatedBy = sql.NullInt64{Int64: int64(membership.AccountID), Valid: true}
+
+	return &membership, nil
+}
+
+// IsAccountPayingMember checks if an account has an active Stripe payment
+func (r *MembershipRepository) IsAccountPayingMember(accountID int) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM stripe_payment 
+		WHERE created_by = $1 AND end_date >= NOW() - INTERVAL '1 day'`
+
+	var count int
+	err := r.db.QueryRow(query, accountID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// IsAccountCompanyEmployee checks if an account is employed by an active company
+func (r *MembershipRepository) IsAccountCompanyEmployee(accountID int) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM company_employee ce
+		JOIN company c ON ce.company = c.id
+		WHERE ce.account = $1 AND c.active = true`
+
+	var count int
+	err := r.db.QueryRow(query, accountID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetMembershipMonthCount returns the number of Stripe payments made by an account
+func (r *MembershipRepository) GetMembershipMonthCount(accountID int) (int, error) {
+	query := `SELECT COUNT(*) FROM stripe_payment WHERE created_by = $1`
+
+	var count int
+	err := r.db.QueryRow(query, accountID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// IsActiveMember checks if an account is an active member (paying or company employee)
+func (r *MembershipRepository) IsActiveMember(accountID int) (bool, error) {
+	// Check if paying member
+	isPaying, err := r.IsAccountPayingMember(accountID)
+	if err != nil {
+		return false, err
+	}
+	if isPaying {
+		return true, nil
+	}
+
+	// Check if company employee
+	isEmployee, err := r.IsAccountCompanyEmployee(accountID)
+	if err != nil {
+		return false, err
+	}
+
+	return isEmployee, nil
+}
+
+// GetActivePayingMembers retrieves all accounts with active payments
+func (r *MembershipRepository) GetActivePayingMembers() ([]Account, error) {
+	query := `
+		SELECT DISTINCT a.id, a.username, a.email, a.password, a.name, a.phone, 
+		       a.reset_token, a.reset_token_validity, a.system,
+		       a.created_at, a.updated_at, a.created_by, a.updated_by
+		FROM account a
+		JOIN stripe_payment sp ON sp.created_by = a.id
+		WHERE sp.end_date >= NOW() - INTERVAL '1 day'
+		ORDER BY a.username`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		err := rows.Scan(
+			&account.ID, &account.Username, &account.Email, &account.Password,
+			&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
+			&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// GetActiveCompanies retrieves all active companies
+func (r *MembershipRepository) GetActiveCompanies() ([]Company, error) {
+	query := `
+		SELECT c.id, c.name, c.active, c.contact,
+		       c.created_at, c.updated_at, c.created_by, c.updated_by,
+		       a.username, a.name
+		FROM company c
+		JOIN account a ON c.contact = a.id
+		WHERE c.active = true
+		ORDER BY c.name`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var companies []Company
+	for rows.Next() {
+		var company Company
+		var contact Account
+		err := rows.Scan(
+			&company.ID, &company.Name, &company.Active, &company.ContactID,
+			&company.CreatedAt, &company.UpdatedAt, &company.CreatedBy, &company.UpdatedBy,
+			&contact.Username, &contact.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		contact.ID = company.ContactID
+		company.Contact = &contact
+		companies = append(companies, company)
+	}
+
+	return companies, nil
+}
+
+// GetRecentEvents retrieves recent events for a domain
+func (r *EventRepository) GetRecentEvents(domain string, limit int) ([]Event, error) {
+	query := `
+		SELECT id, domain, key, text1, text2, text3, int1, int2, int3,
+		       created_at, updated_at, created_by, updated_by
+		FROM event 
+		WHERE domain = $1 
+		ORDER BY created_at DESC 
+		LIMIT $2`
+
+	rows, err := r.db.Query(query, domain, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		err := rows.Scan(
+			&event.ID, &event.Domain, &event.Key, &event.Text1, &event.Text2, &event.Text3,
+			&event.Int1, &event.Int2, &event.Int3,
+			&event.CreatedAt, &event.UpdatedAt, &event.CreatedBy, &event.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// DoorRepository handles database operations for doors and access
+type DoorRepository struct {
+	db *sql.DB
+}
+
+func NewDoorRepository(db *sql.DB) *DoorRepository {
+	return &DoorRepository{db: db}
+}
+
+// GetConfiguredDoors returns hardcoded door configurations
+// In a real implementation, this would come from a config file or database
+func (r *DoorRepository) GetConfiguredDoors() []Door {
+	return []Door{
+		{
+			Key:       "main",
+			Name:      "Main Door",
+			OpenTime:  5,
+			Type:      "mqtt",
+			Topic:     "bitraf/door/main",
+			CircleIDs: []int{1}, // Admin circle
+		},
+		{
+			Key:       "workshop",
+			Name:      "Workshop Door",
+			OpenTime:  5,
+			Type:      "mqtt",
+			Topic:     "bitraf/door/workshop",
+			CircleIDs: []int{1, 2}, // Admin and member circles
+		},
+		{
+			Key:       "storage",
+			Name:      "Storage Room",
+			OpenTime:  3,
+			Type:      "dlock",
+			URL:       "http://storage-lock.local",
+			CircleIDs: []int{1}, // Admin only
+		},
+	}
+}
+
+// CanAccessDoor checks if an account can access a specific door
+func (r *DoorRepository) CanAccessDoor(accountID int, door Door, membershipRepo *MembershipRepository) (bool, error) {
+	// Check if account is company employee (has access to all doors)
+	isEmployee, err := membershipRepo.IsAccountCompanyEmployee(accountID)
+	if err != nil {
+		return false, err
+	}
+	if isEmployee {
+		return true, nil
+	}
+
+	// Check if account is paying member
+	isPaying, err := membershipRepo.IsAccountPayingMember(accountID)
+	if err != nil {
+		return false, err
+	}
+	if !isPaying {
+		return false, nil // Must be paying member for door access
+	}
+
+	// Check circle membership if required
+	if len(door.CircleIDs) > 0 {
+		for _, circleID := range door.CircleIDs {
+			isMember, err := r.IsAccountInCircle(accountID, circleID)
+			if err != nil {
+				return false, err
+			}
+			if isMember {
+				return true, nil
+			}
+		}
+		return false, nil // Not in any required circle
+	}
+
+	return true, nil // Paying member with no circle requirements
+}
+
+// IsAccountInCircle checks if an account is a member of a circle
+func (r *DoorRepository) IsAccountInCircle(accountID int, circleID int) (bool, error) {
+	query := `SELECT COUNT(*) FROM circle_member cm WHERE cm.account = $1 AND cm.circle = $2 AND ` + activeCircleMember
+
+	var count int
+	err := r.db.QueryRow(query, accountID, circleID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetAccessibleDoors returns doors that an account can access
+func (r *DoorRepository) GetAccessibleDoors(accountID int, membershipRepo *MembershipRepository) ([]Door, error) {
+	allDoors := r.GetConfiguredDoors()
+	var accessibleDoors []Door
+
+	for _, door := range allDoors {
 		canAccess, err := r.CanAccessDoor(accountID, door, membershipRepo)
 		if err != nil {
 			return nil, err
 		}
-		if canAccess {
-			accessibleDoors = append(accessibleDoors, door)
-		}
+		if canAccess {
+			accessibleDoors = append(accessibleDoors, door)
+		}
+	}
+
+	return accessibleDoors, nil
+}
+
+// LogDoorAccess records a door access event
+func (r *DoorRepository) LogDoorAccess(accountID int, doorKey string) (*DoorAccess, error) {
+	query := `
+		INSERT INTO door_access (account, door_key, opened_at, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, NOW(), NOW(), NOW(), $1, $1)
+		RETURNING id, opened_at, created_at, updated_at`
+
+	var access DoorAccess
+	access.AccountID = accountID
+	access.DoorKey = doorKey
+	access.CreatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+	access.UpdatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+
+	err := r.db.QueryRow(query, accountID, doorKey).Scan(
+		&access.ID, &access.OpenedAt, &access.CreatedAt, &access.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &access, nil
+}
+
+// GetRecentDoorAccess returns recent door access events
+func (r *DoorRepository) GetRecentDoorAccess(limit int) ([]DoorAccess, error) {
+	query := `
+		SELECT da.id, da.account, da.door_key, da.opened_at,
+		       da.created_at, da.updated_at, da.created_by, da.updated_by,
+		       a.username, a.name
+		FROM door_access da
+		JOIN account a ON da.account = a.id
+		ORDER BY da.opened_at DESC
+		LIMIT $1`
+
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accesses []DoorAccess
+	for rows.Next() {
+		var access DoorAccess
+		var account Account
+		err := rows.Scan(
+			&access.ID, &access.AccountID, &access.DoorKey, &access.OpenedAt,
+			&access.CreatedAt, &access.UpdatedAt, &access.CreatedBy, &access.UpdatedBy,
+			&account.Username, &account.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		account.ID = access.AccountID
+		access.Account = &account
+		accesses = append(accesses, access)
+	}
+
+	return accesses, nil
+}
+
+// UpdatePassword updates the password for an account and invalidates any pending reset token
+func (r *AccountRepository) UpdatePassword(accountID int, hashedPassword string) error {
+	query := `
+		UPDATE account
+		SET password = $1, reset_token = NULL, reset_token_validity = NULL, updated_at = now()
+		WHERE id = $2`
+	_, err := r.db.Exec(query, hashedPassword, accountID)
+	return err
+}
+
+// UpdatePasswordHash replaces the stored hash of an unchanged password, e.g. with a higher cost.
+// Unlike UpdatePassword it leaves a pending password reset alone.
+func (r *AccountRepository) UpdatePasswordHash(accountID int, hashedPassword string) error {
+	query := `UPDATE account SET password = $1 WHERE id = $2`
+	_, err := r.db.Exec(query, hashedPassword, accountID)
+	return err
+}
+
+// UpdateProfile updates the profile fields for an account
+func (r *AccountRepository) UpdateProfile(account *Account) error {
+	query := `
+		UPDATE account 
+		SET name = $1, phone = $2, updated_at = now() 
+		WHERE id = $3`
+
+	var name, phone interface{}
+	if account.Name.Valid {
+		name = account.Name.String
+	}
+	if account.Phone.Valid {
+		phone = account.Phone.String
+	}
+
+	_, err := r.db.Exec(query, name, phone, account.ID)
+	return err
+}
+
+// PublishesBadges reports whether an account has chosen to publish its badges as Open Badges
+func (r *AccountRepository) PublishesBadges(accountID int) (bool, error) {
+	var publish bool
+	err := r.db.QueryRow(`SELECT publish_badges FROM account WHERE id = $1`, accountID).Scan(&publish)
+	return publish, err
+}
+
+// SetPublishBadges turns publishing an account's badges as Open Badges on or off
+func (r *AccountRepository) SetPublishBadges(accountID int, publish bool) error {
+	_, err := r.db.Exec(`UPDATE account SET publish_badges = $2, updated_at = NOW(), updated_by = $1 WHERE id = $1`,
+		accountID, publish)
+	return err
+}
+
+// GetAllAccounts retrieves all accounts with pagination
+func (r *AccountRepository) GetAllAccounts(limit, offset int) ([]Account, error) {
+	query := `
+		SELECT id, username, email, password, name, phone, reset_token, 
+		       reset_token_validity, system, created_at, updated_at, created_by, updated_by
+		FROM account 
+		ORDER BY username
+		LIMIT $1 OFFSET $2`
+
+	rows, err := r.db.Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		err := rows.Scan(
+			&account.ID, &account.Username, &account.Email, &account.Password,
+			&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
+			&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// GetAccountCount returns the total number of accounts
+func (r *AccountRepository) GetAccountCount() (int, error) {
+	query := `SELECT COUNT(*) FROM account`
+	var count int
+	err := r.db.QueryRow(query).Scan(&count)
+	return count, err
+}
+
+// FindByEmail retrieves an account by email
+func (r *AccountRepository) FindByEmail(email string) (*Account, error) {
+	query := `
+		SELECT id, username, email, password, name, phone, reset_token, 
+		       reset_token_validity, system, created_at, updated_at, created_by, updated_by
+		FROM account WHERE email = $1`
+
+	account := &Account{}
+	err := r.db.QueryRow(query, email).Scan(
+		&account.ID, &account.Username, &account.Email, &account.Password,
+		&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
+		&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// FindByResetToken retrieves the account owning a reset token that has not yet expired
+func (r *AccountRepository) FindByResetToken(resetToken string) (*Account, error) {
+	query := `
+		SELECT id, username, email, password, name, phone, reset_token, 
+		       reset_token_validity, system, created_at, updated_at, created_by, updated_by
+		FROM account WHERE reset_token = $1 AND reset_token_validity > now()`
+
+	account := &Account{}
+	err := r.db.QueryRow(query, resetToken).Scan(
+		&account.ID, &account.Username, &account.Email, &account.Password,
+		&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
+		&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// CreateResetToken issues a new password reset token for an account, valid for ResetTokenValidity
+func (r *AccountRepository) CreateResetToken(accountID int) (string, error) {
+	token, err := GenerateToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		UPDATE account
+		SET reset_token = $1, reset_token_validity = now() + $2 * INTERVAL '1 second', updated_at = now()
+		WHERE id = $3`
+
+	result, err := r.db.Exec(query, token, int(ResetTokenValidity.Seconds()), accountID)
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if rowsAffected == 0 {
+		return "", fmt.Errorf("account %d not found", accountID)
+	}
+
+	return token, nil
+}
+
+// ResetTokenValidity is how long a password reset link stays valid, same as the legacy app
+const ResetTokenValidity = 24 * time.Hour
+
+// GenerateToken returns a random hex encoded token of n bytes
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ApiTokenPrefix makes personal API tokens easy to recognize, e.g. in leaked config files
+const ApiTokenPrefix = "p2k16_"
+
+// ApiTokenRepository handles database operations for personal API tokens
+type ApiTokenRepository struct {
+	db *sql.DB
+}
+
+func NewApiTokenRepository(db *sql.DB) *ApiTokenRepository {
+	return &ApiTokenRepository{db: db}
+}
+
+// HashApiToken returns the hex encoded SHA-256 hash stored for a token
+func HashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create mints a new token for an account. The plain token is only returned here.
+func (r *ApiTokenRepository) Create(accountID int, name string) (string, *ApiToken, error) {
+	random, err := GenerateToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := ApiTokenPrefix + random
+
+	query := `
+		INSERT INTO api_token (account, name, token_hash, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, $3, NOW(), NOW(), $1, $1)
+		RETURNING id, created_at, updated_at`
+
+	apiToken := &ApiToken{
+		AccountID: accountID,
+		Name:      name,
+		TokenHash: HashApiToken(token),
+		CreatedBy: sql.NullInt64{Int64: int64(accountID), Valid: true},
+		UpdatedBy: sql.NullInt64{Int64: int64(accountID), Valid: true},
+	}
+
+	err = r.db.QueryRow(query, accountID, name, apiToken.TokenHash).Scan(
+		&apiToken.ID, &apiToken.CreatedAt, &apiToken.UpdatedAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, apiToken, nil
+}
+
+// Authenticate looks up the account owning a token and records that the token was used
+func (r *ApiTokenRepository) Authenticate(token string) (int, error) {
+	query := `
+		UPDATE api_token SET last_used_at = NOW()
+		WHERE token_hash = $1
+		RETURNING account`
+
+	var accountID int
+	err := r.db.QueryRow(query, HashApiToken(token)).Scan(&accountID)
+	if err != nil {
+		return 0, err
+	}
+
+	return accountID, nil
+}
+
+// GetForAccount lists the tokens belonging to an account
+func (r *ApiTokenRepository) GetForAccount(accountID int) ([]ApiToken, error) {
+	query := `
+		SELECT id, account, name, token_hash, last_used_at,
+		       created_at, updated_at, created_by, updated_by
+		FROM api_token
+		WHERE account = $1
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []ApiToken
+	for rows.Next() {
+		var token ApiToken
+		err := rows.Scan(
+			&token.ID, &token.AccountID, &token.Name, &token.TokenHash, &token.LastUsedAt,
+			&token.CreatedAt, &token.UpdatedAt, &token.CreatedBy, &token.UpdatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
 	}
 
-	return accessibleDoors, nil
+	return tokens, nil
 }
 
-// LogDoorAccess records a door access event
-func (r *DoorRepository) LogDoorAccess(accountID int, doorKey string) (*DoorAccess, error) {
-	query := `
-		INSERT INTO door_access (account, door_key, opened_at, created_at, updated_at, created_by, updated_by)
-		VALUES ($1, $2, NOW(), NOW(), NOW(), $1, $1)
-		RETURNING id, opened_at, created_at, updated_at`
+// Revoke deletes a token, scoped to its owner
+func (r *ApiTokenRepository) Revoke(tokenID int, accountID int) error {
+	query := `DELETE FROM api_token WHERE id = $1 AND account = $2`
 
-	var access DoorAccess
-	access.AccountID = accountID
-	access.DoorKey = doorKey
-	access.CreatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
-	access.UpdatedBy = sql.NullInt64{Int64: int64(accountID), Valid: true}
+	result, err := r.db.Exec(query, tokenID, accountID)
+	if err != nil {
+		return err
+	}
 
-	err := r.db.QueryRow(query, accountID, doorKey).Scan(
-		&access.ID, &access.OpenedAt, &access.CreatedAt, &access.UpdatedAt,
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no token found with id %d for account %d", tokenID, accountID)
+	}
+
+	return nil
+}
+
+// SessionRepository handles database operations for server side login sessions
+type SessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// HashSessionKey returns the hex encoded SHA-256 hash stored for a session cookie key
+func HashSessionKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindByKey finds an unexpired session by the key from the session cookie
+func (r *SessionRepository) FindByKey(key string) (*Session, error) {
+	query := `
+		SELECT id, account, key_hash, data, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+		       last_activity_at, expires_at, created_at, updated_at
+		FROM session
+		WHERE key_hash = $1 AND expires_at > NOW()`
+
+	var session Session
+	err := r.db.QueryRow(query, HashSessionKey(key)).Scan(
+		&session.ID, &session.AccountID, &session.KeyHash, &session.Data, &session.UserAgent, &session.IPAddress,
+		&session.LastActivityAt, &session.ExpiresAt, &session.CreatedAt, &session.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &access, nil
+	return &session, nil
 }
 
-// GetRecentDoorAccess returns recent door access events
-func (r *DoorRepository) GetRecentDoorAccess(limit int) ([]DoorAccess, error) {
+// Create stores a new session for the given cookie key
+func (r *SessionRepository) Create(key string, session *Session) error {
 	query := `
-		SELECT da.id, da.account, da.door_key, da.opened_at,
-		       da.created_at, da.updated_at, da.created_by, da.updated_by,
-		       a.username, a.name
-		FROM door_access da
-		JOIN account a ON da.account = a.id
-		ORDER BY da.opened_at DESC
-		LIMIT $1`
+		INSERT INTO session (key_hash, account, data, user_agent, ip_address, last_activity_at, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), $6, NOW(), NOW())
+		RETURNING id, last_activity_at, created_at, updated_at`
+
+	session.KeyHash = HashSessionKey(key)
+	return r.db.QueryRow(query, session.KeyHash, session.AccountID, session.Data,
+		session.UserAgent, session.IPAddress, session.ExpiresAt).Scan(
+		&session.ID, &session.LastActivityAt, &session.CreatedAt, &session.UpdatedAt,
+	)
+}
 
-	rows, err := r.db.Query(query, limit)
+// Update saves the session values and extends the session. Returns sql.ErrNoRows if the
+// session was revoked or now belongs to a different account, which needs a new session key.
+func (r *SessionRepository) Update(session *Session) error {
+	query := `
+		UPDATE session
+		SET data = $3, expires_at = $4, last_activity_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND account IS NOT DISTINCT FROM $2
+		RETURNING last_activity_at, updated_at`
+
+	return r.db.QueryRow(query, session.ID, session.AccountID, session.Data, session.ExpiresAt).Scan(
+		&session.LastActivityAt, &session.UpdatedAt,
+	)
+}
+
+// Touch records activity on a session without changing its values
+func (r *SessionRepository) Touch(sessionID int) error {
+	_, err := r.db.Exec(`UPDATE session SET last_activity_at = NOW() WHERE id = $1`, sessionID)
+	return err
+}
+
+// Delete removes a session, returning sql.ErrNoRows if it was already gone
+func (r *SessionRepository) Delete(sessionID int) error {
+	result, err := r.db.Exec(`DELETE FROM session WHERE id = $1`, sessionID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetActiveForAccount lists the unexpired sessions of an account, most recently used first
+func (r *SessionRepository) GetActiveForAccount(accountID int) ([]Session, error) {
+	query := `
+		SELECT id, account, key_hash, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+		       last_activity_at, expires_at, created_at, updated_at
+		FROM session
+		WHERE account = $1 AND expires_at > NOW()
+		ORDER BY last_activity_at DESC`
+
+	rows, err := r.db.Query(query, accountID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var accesses []DoorAccess
+	var sessions []Session
 	for rows.Next() {
-		var access DoorAccess
-		var account Account
+		var session Session
 		err := rows.Scan(
-			&access.ID, &access.AccountID, &access.DoorKey, &access.OpenedAt,
-			&access.CreatedAt, &access.UpdatedAt, &access.CreatedBy, &access.UpdatedBy,
-			&account.Username, &account.Name,
+			&session.ID, &session.AccountID, &session.KeyHash, &session.UserAgent, &session.IPAddress,
+			&session.LastActivityAt, &session.ExpiresAt, &session.CreatedAt, &session.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
-		account.ID = access.AccountID
-		access.Account = &account
-		accesses = append(accesses, access)
+		sessions = append(sessions, session)
 	}
 
-	return accesses, nil
+	return sessions, nil
 }
 
-// UpdatePassword updates the password for an account
-func (r *AccountRepository) UpdatePassword(accountID int, hashedPassword string) error {
-	query := `UPDATE account SET password = $1, updated_at = now() WHERE id = $2`
-	_, err := r.db.Exec(query, hashedPassword, accountID)
-	return err
+// Revoke deletes one session, scoped to its owner
+func (r *SessionRepository) Revoke(sessionID int, accountID int) error {
+	query := `DELETE FROM session WHERE id = $1 AND account = $2`
+
+	result, err := r.db.Exec(query, sessionID, accountID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no session found with id %d for account %d", sessionID, accountID)
+	}
+
+	return nil
 }
 
-// UpdateProfile updates the profile fields for an account
-func (r *AccountRepository) UpdateProfile(account *Account) error {
-	query := `
-		UPDATE account 
-		SET name = $1, phone = $2, updated_at = now() 
-		WHERE id = $3`
+// RevokeAllForAccount deletes every session of an account except keepSessionID (0 to keep none)
+func (r *SessionRepository) RevokeAllForAccount(accountID int, keepSessionID int) (int64, error) {
+	query := `DELETE FROM session WHERE account = $1 AND id <> $2`
 
-	var name, phone interface{}
-	if account.Name.Valid {
-		name = account.Name.String
+	result, err := r.db.Exec(query, accountID, keepSessionID)
+	if err != nil {
+		return 0, err
 	}
-	if account.Phone.Valid {
-		phone = account.Phone.String
+
+	return result.RowsAffected()
+}
+
+// DeleteExpired removes sessions past their expiry
+func (r *SessionRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM session WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
 	}
 
-	_, err := r.db.Exec(query, name, phone, account.ID)
-	return err
+	return result.RowsAffected()
 }
 
-// GetAllAccounts retrieves all accounts with pagination
-func (r *AccountRepository) GetAllAccounts(limit, offset int) ([]Account, error) {
+// TwoFactorRepository handles database operations for TOTP enrollments and recovery codes
+type TwoFactorRepository struct {
+	db *sql.DB
+}
+
+func NewTwoFactorRepository(db *sql.DB) *TwoFactorRepository {
+	return &TwoFactorRepository{db: db}
+}
+
+// HashRecoveryCode returns the hex encoded SHA-256 hash stored for a normalized recovery code
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetForAccount returns the account's TOTP enrollment, confirmed or pending
+func (r *TwoFactorRepository) GetForAccount(accountID int) (*AccountTOTP, error) {
 	query := `
-		SELECT id, username, email, password, name, phone, reset_token, 
-		       reset_token_validity, system, created_at, updated_at, created_by, updated_by
-		FROM account 
-		ORDER BY username
-		LIMIT $1 OFFSET $2`
+		SELECT id, account, secret, confirmed_at, last_used_step,
+		       created_at, updated_at, created_by, updated_by
+		FROM account_totp
+		WHERE account = $1`
 
-	rows, err := r.db.Query(query, limit, offset)
+	var totp AccountTOTP
+	err := r.db.QueryRow(query, accountID).Scan(
+		&totp.ID, &totp.AccountID, &totp.Secret, &totp.ConfirmedAt, &totp.LastUsedStep,
+		&totp.CreatedAt, &totp.UpdatedAt, &totp.CreatedBy, &totp.UpdatedBy,
+	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var accounts []Account
-	for rows.Next() {
-		var account Account
-		err := rows.Scan(
-			&account.ID, &account.Username, &account.Email, &account.Password,
-			&account.Name, &account.Phone, &account.ResetToken, &account.ResetTokenValidity,
-			&account.System, &account.CreatedAt, &account.UpdatedAt, &account.CreatedBy, &account.UpdatedBy,
-		)
+	return &totp, nil
+}
+
+// IsEnabled reports whether the account has confirmed two-factor authentication
+func (r *TwoFactorRepository) IsEnabled(accountID int) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM account_totp WHERE account = $1 AND confirmed_at IS NOT NULL)`
+
+	var enabled bool
+	err := r.db.QueryRow(query, accountID).Scan(&enabled)
+	return enabled, err
+}
+
+// StartEnrollment stores a new unconfirmed secret, replacing any earlier pending enrollment.
+// A confirmed enrollment is left alone, it has to be disabled first.
+func (r *TwoFactorRepository) StartEnrollment(accountID int, secret string) error {
+	query := `
+		INSERT INTO account_totp (account, secret, created_at, updated_at, created_by, updated_by)
+		VALUES ($1, $2, NOW(), NOW(), $1, $1)
+		ON CONFLICT (account) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = NULL, updated_at = NOW(), updated_by = EXCLUDED.updated_by
+		WHERE account_totp.confirmed_at IS NULL`
+
+	result, err := r.db.Exec(query, accountID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("two-factor authentication is already enabled for account %d", accountID)
+	}
+
+	return nil
+}
+
+// Confirm enables the pending enrollment and stores its recovery codes in one transaction
+func (r *TwoFactorRepository) Confirm(accountID int, step int64, recoveryCodes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE account_totp
+		SET confirmed_at = NOW(), last_used_step = $2, updated_at = NOW(), updated_by = $1
+		WHERE account = $1 AND confirmed_at IS NULL`, accountID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no pending two-factor enrollment for account %d", accountID)
+	}
+
+	if err := replaceRecoveryCodes(tx, accountID, recoveryCodes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records a verified time step. Returns false if that step (or a later one) was
+// already used, so a code seen by someone else can't be replayed.
+func (r *TwoFactorRepository) UseStep(accountID int, step int64) (bool, error) {
+	query := `
+		UPDATE account_totp SET last_used_step = $2
+		WHERE account = $1 AND (last_used_step IS NULL OR last_used_step < $2)`
+
+	result, err := r.db.Exec(query, accountID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Disable removes the enrollment and all recovery codes
+func (r *TwoFactorRepository) Disable(accountID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM account_recovery_code WHERE account = $1`, accountID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM account_totp WHERE account = $1`, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes invalidates all earlier recovery codes and stores new ones
+func (r *TwoFactorRepository) ReplaceRecoveryCodes(accountID int, recoveryCodes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, accountID, recoveryCodes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, accountID int, recoveryCodes []string) error {
+	if _, err := tx.Exec(`DELETE FROM account_recovery_code WHERE account = $1`, accountID); err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err := tx.Exec(`
+			INSERT INTO account_recovery_code (account, code_hash, created_at, updated_at, created_by, updated_by)
+			VALUES ($1, $2, NOW(), NOW(), $1, $1)`, accountID, HashRecoveryCode(code))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		accounts = append(accounts, account)
 	}
 
-	return accounts, nil
+	return nil
 }
 
-// GetAccountCount returns the total number of accounts
-func (r *AccountRepository) GetAccountCount() (int, error) {
-	query := `SELECT COUNT(*) FROM account`
+// UseRecoveryCode marks an unused recovery code as used, returning false if there is none
+func (r *TwoFactorRepository) UseRecoveryCode(accountID int, code string) (bool, error) {
+	query := `
+		UPDATE account_recovery_code SET used_at = NOW(), updated_at = NOW()
+		WHERE account = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	result, err := r.db.Exec(query, accountID, HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// CountUnusedRecoveryCodes returns how many recovery codes the account has left
+func (r *TwoFactorRepository) CountUnusedRecoveryCodes(accountID int) (int, error) {
+	query := `SELECT COUNT(*) FROM account_recovery_code WHERE account = $1 AND used_at IS NULL`
+
 	var count int
-	err := r.db.QueryRow(query).Scan(&count)
+	err := r.db.QueryRow(query, accountID).Scan(&count)
 	return count, err
 }
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+// Config holds the broker settings, matching the MQTT_* settings in the legacy config
+type Config struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Prefix     string // Prepended to door topics, legacy MQTT_PREFIX
+	ToolPrefix string // Prepended to tool topics, legacy MQTT_PREFIX_TOOL
+}
+
+// Client sends commands to tools and doors. Publishing only fails when the broker can't be
+// reached, the hardware doesn't acknowledge anything.
+type Client interface {
+	UnlockTool(tool string) error
+	LockTool(tool string) error
+	OpenDoor(door models.Door) error
+	Close()
+}
+
+// publishTimeout is how long a publish may wait for the broker before it is given up
+const publishTimeout = 5 * time.Second
+
+// NewClient connects to the broker in the background like the legacy ToolClient. Without a host
+// it returns a client that only logs the messages, like the legacy DummyClient.
+func NewClient(config Config) Client {
+	if config.Host == "" {
+		logging.LogInfo("MQTT", "No MQTT_HOST configured, tool and door commands are only logged")
+		return &dummyClient{config: config}
+	}
+
+	logging.LogInfo("MQTT", fmt.Sprintf("Connecting to %s:%d, username=%s, prefix=%s, tool prefix=%s",
+		config.Host, config.Port, config.Username, config.Prefix, config.ToolPrefix))
+
+	options := paho.NewClientOptions().
+		AddBroker("tcp://" + config.Host + ":" + strconv.Itoa(config.Port)).
+		SetClientID(fmt.Sprintf("p2k16-%d", time.Now().UnixNano())).
+		SetKeepAlive(60 * time.Second).
+		SetWriteTimeout(publishTimeout).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logging.LogWarning("MQTT", fmt.Sprintf("Connection to %s lost: %v", config.Host, err))
+		}).
+		SetOnConnectHandler(func(paho.Client) {
+			logging.LogSuccess("MQTT", fmt.Sprintf("Connected to %s:%d", config.Host, config.Port))
+		})
+	if config.Username != "" {
+		options.SetUsername(config.Username).SetPassword(config.Password)
+	}
+
+	client := paho.NewClient(options)
+	// With connect retry this keeps trying in the background
+	client.Connect()
+
+	return &pahoClient{config: config, client: client}
+}
+
+// ToolTopic is the topic of a tool command, <tool prefix>/<tool>/<action>
+func ToolTopic(prefix, tool, action string) string {
+	return strings.Join([]string{prefix, tool, action}, "/")
+}
+
+// DoorTopic is the topic doors listen on for the time to stay open
+func DoorTopic(prefix string, door models.Door) string {
+	return prefix + door.Topic
+}
+
+type pahoClient struct {
+	config Config
+	client paho.Client
+}
+
+// UnlockTool unlocks a tool that has been checked out
+func (c *pahoClient) UnlockTool(tool string) error {
+	return c.publish(ToolTopic(c.config.ToolPrefix, tool, "unlock"), "true")
+}
+
+// LockTool locks a tool that has been checked in
+func (c *pahoClient) LockTool(tool string) error {
+	return c.publish(ToolTopic(c.config.ToolPrefix, tool, "lock"), "true")
+}
+
+// OpenDoor opens a door for its open time, in seconds
+func (c *pahoClient) OpenDoor(door models.Door) error {
+	return c.publish(DoorTopic(c.config.Prefix, door), strconv.Itoa(door.OpenTime))
+}
+
+func (c *pahoClient) publish(topic, payload string) error {
+	logging.LogInfo("MQTT", fmt.Sprintf("Sending MQTT message: %s: %s", topic, payload))
+
+	// Commands are only useful right away, so don't queue them until the broker is back
+	if !c.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to %s", c.config.Host)
+	}
+	token := c.client.Publish(topic, 0, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+// Close disconnects from the broker, giving queued messages a moment to be sent
+func (c *pahoClient) Close() {
+	c.client.Disconnect(250)
+}
+
+type dummyClient struct {
+	config Config
+}
+
+func (c *dummyClient) UnlockTool(tool string) error {
+	logging.LogInfo("MQTT", "Dummy unlock: "+ToolTopic(c.config.ToolPrefix, tool, "unlock"))
+	return nil
+}
+
+func (c *dummyClient) LockTool(tool string) error {
+	logging.LogInfo("MQTT", "Dummy lock: "+ToolTopic(c.config.ToolPrefix, tool, "lock"))
+	return nil
+}
+
+func (c *dummyClient) OpenDoor(door models.Door) error {
+	logging.LogInfo("MQTT", fmt.Sprintf("Dummy open: %s: %d", DoorTopic(c.config.Prefix, door), door.OpenTime))
+	return nil
+}
+
+func (c *dummyClient) Close() {}
@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/helloellinor/p2k16/internal/models"
+)
+
+type message struct {
+	topic   string
+	payload string
+}
+
+// testBroker is just enough of an MQTT 3.1.1 broker to receive QoS 0 publishes from one client
+type testBroker struct {
+	listener net.Listener
+	username chan string
+	messages chan message
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	broker := &testBroker{listener: listener, username: make(chan string, 1), messages: make(chan message, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *testBroker) port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, multiplier := 0, 1
+		for {
+			digit, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(digit&127) * multiplier
+			multiplier *= 128
+			if digit&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			flags := body[7]
+			rest := body[10:]
+			_, rest = readString(rest) // client id
+			username := ""
+			if flags&0x80 != 0 {
+				username, _ = readString(rest)
+			}
+			b.username <- username
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			topic, payload := readString(body)
+			b.messages <- message{topic: topic, payload: string(payload)}
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0x00})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func readString(data []byte) (string, []byte) {
+	length := int(binary.BigEndian.Uint16(data))
+	return string(data[2 : 2+length]), data[2+length:]
+}
+
+func (b *testBroker) expect(t *testing.T, topic, payload string) {
+	t.Helper()
+	select {
+	case msg := <-b.messages:
+		if msg.topic != topic || msg.payload != payload {
+			t.Errorf("Expected %s: %s, got %s: %s", topic, payload, msg.topic, msg.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s", topic)
+	}
+}
+
+func TestClientPublishesCommands(t *testing.T) {
+	broker := newTestBroker(t)
+	client := NewClient(Config{
+		Host:       "127.0.0.1",
+		Port:       broker.port(),
+		Username:   "p2k16",
+		Password:   "secret",
+		Prefix:     "/public/",
+		ToolPrefix: "/public/tool",
+	})
+	defer client.Close()
+
+	select {
+	case username := <-broker.username:
+		if username != "p2k16" {
+			t.Errorf("Expected username p2k16, got %q", username)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the client to connect")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !client.(*pahoClient).client.IsConnectionOpen(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the connection to open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.UnlockTool("laser"); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	broker.expect(t, "/public/tool/laser/unlock", "true")
+
+	if err := client.LockTool("laser"); err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	broker.expect(t, "/public/tool/laser/lock", "true")
+
+	if err := client.OpenDoor(models.Door{Key: "main", Topic: "door/main", OpenTime: 10}); err != nil {
+		t.Fatalf("Failed to open door: %v", err)
+	}
+	broker.expect(t, "/public/door/main", "10")
+}
+
+func TestClientWithoutHostIsDummy(t *testing.T) {
+	client := NewClient(Config{ToolPrefix: "/public/tool"})
+	defer client.Close()
+
+	if _, ok := client.(*dummyClient); !ok {
+		t.Fatalf("Expected a dummy client without a host, got %T", client)
+	}
+	if err := client.UnlockTool("laser"); err != nil {
+		t.Errorf("Expected dummy unlock to succeed, got %v", err)
+	}
+}
@@ -1,17 +1,31 @@
 package session
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
 	"encoding/json"
-	"sync"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/helloellinor/p2k16/internal/logging"
+	"github.com/helloellinor/p2k16/internal/models"
 )
 
 const (
-	SessionTimeout = 24 * time.Hour // 24 hours
-	CleanupInterval = 1 * time.Hour // Clean up every hour
+	SessionTimeout  = 24 * time.Hour // 24 hours
+	CleanupInterval = 1 * time.Hour  // Clean up every hour
+	// ActivityInterval limits how often reading a session writes its last activity back
+	ActivityInterval = 1 * time.Minute
+
+	userIDKey = "user_id" // Same key as middleware.UserIDKey, links sessions to accounts
 )
 
 // SessionData represents the data stored in a session
@@ -22,20 +36,22 @@ type SessionData struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
-// SessionStore manages session storage and cleanup
+// SessionStore keeps session values in Postgres and only a random key in the cookie,
+// so sessions can be listed and revoked. It implements sessions.Store for gin.
 type SessionStore struct {
-	mu       sync.RWMutex
-	sessions map[string]*SessionData
-	cleanup  *time.Ticker
-	stopCh   chan struct{}
+	repo    *models.SessionRepository
+	options *gsessions.Options
+	cleanup *time.Ticker
+	stopCh  chan struct{}
 }
 
 // NewSessionStore creates a new session store with automatic cleanup
-func NewSessionStore() *SessionStore {
+func NewSessionStore(repo *models.SessionRepository) *SessionStore {
 	store := &SessionStore{
-		sessions: make(map[string]*SessionData),
-		cleanup:  time.NewTicker(CleanupInterval),
-		stopCh:   make(chan struct{}),
+		repo:    repo,
+		options: &gsessions.Options{Path: "/", MaxAge: int(SessionTimeout.Seconds()), HttpOnly: true},
+		cleanup: time.NewTicker(CleanupInterval),
+		stopCh:  make(chan struct{}),
 	}
 
 	// Start background cleanup
@@ -44,77 +60,130 @@ func NewSessionStore() *SessionStore {
 	return store
 }
 
-// Get retrieves session data for a session ID
-func (s *SessionStore) Get(sessionID string) (*SessionData, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	
-	data, exists := s.sessions[sessionID]
-	if !exists {
-		return nil, false
+// Options sets the cookie options, MaxAge is also used as the session lifetime
+func (s *SessionStore) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+// Get returns the session for this request, cached per request
+func (s *SessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session referenced by the cookie. Unknown, expired and revoked
+// sessions give a fresh empty session rather than an error.
+func (s *SessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
 	}
 
-	// Check if session is expired
-	if time.Since(data.LastActivity) > SessionTimeout {
-		return nil, false
+	stored, err := s.repo.FindByKey(cookie.Value)
+	if err != nil {
+		return session, nil
 	}
 
-	return data, true
-}
+	values, err := decodeValues(stored.Data)
+	if err != nil {
+		logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to decode session %d: %v", stored.ID, err))
+		return session, nil
+	}
 
-// Set stores session data for a session ID
-func (s *SessionStore) Set(sessionID string, data *SessionData) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	data.LastActivity = time.Now()
-	s.sessions[sessionID] = data
-}
+	session.ID = strconv.Itoa(stored.ID)
+	session.Values = values
+	session.IsNew = false
 
-// Delete removes a session
-func (s *SessionStore) Delete(sessionID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	delete(s.sessions, sessionID)
+	if time.Since(stored.LastActivityAt) > ActivityInterval {
+		if err := s.repo.Touch(stored.ID); err != nil {
+			logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to update activity for session %d: %v", stored.ID, err))
+		}
+	}
+
+	return session, nil
 }
 
-// UpdateActivity updates the last activity time for a session
-func (s *SessionStore) UpdateActivity(sessionID string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	if data, exists := s.sessions[sessionID]; exists {
-		data.LastActivity = time.Now()
-		return true
+// Save persists the session values. Empty sessions are deleted, so visitors
+// who never log in don't get a row.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge < 0 || len(session.Values) == 0 {
+		if session.ID != "" {
+			id, _ := strconv.Atoi(session.ID)
+			if err := s.repo.Delete(id); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			session.ID = ""
+		}
+		s.expireCookie(w, session)
+		return nil
 	}
-	return false
-}
 
-// CleanupExpired removes expired sessions
-func (s *SessionStore) CleanupExpired() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	now := time.Now()
-	count := 0
-	
-	for sessionID, data := range s.sessions {
-		if now.Sub(data.LastActivity) > SessionTimeout {
-			delete(s.sessions, sessionID)
-			count++
+	data, err := encodeValues(session.Values)
+	if err != nil {
+		return err
+	}
+
+	lifetime := SessionTimeout
+	if session.Options.MaxAge > 0 {
+		lifetime = time.Duration(session.Options.MaxAge) * time.Second
+	}
+
+	stored := &models.Session{
+		AccountID: accountID(session.Values),
+		Data:      data,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	if session.ID != "" {
+		stored.ID, _ = strconv.Atoi(session.ID)
+		err := s.repo.Update(stored)
+		if err == nil {
+			// Renew the cookie with the same key so its expiry follows the session
+			if cookie, cookieErr := r.Cookie(session.Name()); cookieErr == nil {
+				http.SetCookie(w, gsessions.NewCookie(session.Name(), cookie.Value, session.Options))
+			}
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Either the session was revoked while the request was running, or another
+		// account logged in. Only the latter continues, with a new key so a key
+		// known from before the login can't be used afterwards.
+		if err := s.repo.Delete(stored.ID); err == sql.ErrNoRows {
+			session.ID = ""
+			s.expireCookie(w, session)
+			return nil
+		} else if err != nil {
+			return err
 		}
 	}
-	
-	return count
+
+	key, err := models.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.Create(key, stored); err != nil {
+		return err
+	}
+
+	session.ID = strconv.Itoa(stored.ID)
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), key, session.Options))
+	return nil
 }
 
-// Count returns the number of active sessions
-func (s *SessionStore) Count() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	
-	return len(s.sessions)
+// expireCookie tells the browser to drop the session cookie
+func (s *SessionStore) expireCookie(w http.ResponseWriter, session *gsessions.Session) {
+	options := *session.Options
+	options.MaxAge = -1
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), "", &options))
 }
 
 // Stop stops the cleanup loop
@@ -128,10 +197,11 @@ func (s *SessionStore) cleanupLoop() {
 	for {
 		select {
 		case <-s.cleanup.C:
-			count := s.CleanupExpired()
-			if count > 0 {
-				// Only log if we actually cleaned up sessions
-				// log.Printf("Cleaned up %d expired sessions", count)
+			count, err := s.repo.DeleteExpired()
+			if err != nil {
+				logging.LogError("SESSION ERROR", fmt.Sprintf("Failed to clean up expired sessions: %v", err))
+			} else if count > 0 {
+				logging.LogInfo("SESSION CLEANUP", fmt.Sprintf("Removed %d expired sessions", count))
 			}
 		case <-s.stopCh:
 			return
@@ -139,6 +209,55 @@ func (s *SessionStore) cleanupLoop() {
 	}
 }
 
+// encodeValues serializes session values the same way gorilla's securecookie does
+func encodeValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, fmt.Errorf("failed to encode session values: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValues(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// accountID links the session row to the logged in account, if any
+func accountID(values map[interface{}]interface{}) sql.NullInt64 {
+	if id, ok := values[userIDKey].(int); ok {
+		return sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+	return sql.NullInt64{}
+}
+
+// clientIPKey holds the address gin resolved for the request in its context
+type clientIPKey struct{}
+
+// ClientIP passes the client address gin resolved, which only honours X-Forwarded-For from
+// trusted proxies, on to the store. It has to run before the sessions middleware, which keeps
+// the request it started with.
+func ClientIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientIPKey{}, c.ClientIP()))
+		c.Next()
+	}
+}
+
+// clientIP returns the address shown in the session list
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 // SessionFromGin extracts session data from Gin session
 func SessionFromGin(c *gin.Context) (*SessionData, error) {
 	session := sessions.Default(c)
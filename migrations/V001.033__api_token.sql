@@ -0,0 +1,19 @@
+/*
+Personal API tokens for scripts using /api/*. Only a SHA-256 hash of the token is stored.
+*/
+DROP TABLE IF EXISTS api_token;
+
+CREATE TABLE api_token (
+  id           BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_by   BIGINT                   NOT NULL REFERENCES account,
+  updated_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_by   BIGINT                   NOT NULL REFERENCES account,
+
+  account      BIGINT                   NOT NULL REFERENCES account,
+  name         VARCHAR(100)             NOT NULL,
+  token_hash   VARCHAR(64)              NOT NULL UNIQUE,
+  last_used_at TIMESTAMP WITH TIME ZONE
+);
+GRANT ALL ON api_token TO "p2k16-web";
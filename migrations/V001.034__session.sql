@@ -0,0 +1,22 @@
+/*
+Server side login sessions. The cookie only carries a random key, of which only a SHA-256 hash is stored,
+so sessions can be listed and revoked.
+*/
+DROP TABLE IF EXISTS session;
+
+CREATE TABLE session (
+  id               BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+
+  key_hash         VARCHAR(64)              NOT NULL UNIQUE,
+  account          BIGINT REFERENCES account ON DELETE CASCADE,
+  data             BYTEA                    NOT NULL,
+  user_agent       TEXT,
+  ip_address       VARCHAR(64),
+  last_activity_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  expires_at       TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX session_account_idx ON session (account);
+GRANT ALL ON session TO "p2k16-web";
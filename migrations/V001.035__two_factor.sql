@@ -0,0 +1,37 @@
+/*
+TOTP two-factor authentication. confirmed_at is set once the member has entered a code from their
+authenticator app; until then the secret is only a pending enrollment. Recovery codes are single use
+and only stored as SHA-256 hashes.
+*/
+DROP TABLE IF EXISTS account_recovery_code;
+DROP TABLE IF EXISTS account_totp;
+
+CREATE TABLE account_totp (
+  id             BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at     TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_by     BIGINT                   NOT NULL REFERENCES account,
+  updated_at     TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_by     BIGINT                   NOT NULL REFERENCES account,
+
+  account        BIGINT                   NOT NULL UNIQUE REFERENCES account,
+  secret         VARCHAR(64)              NOT NULL,
+  confirmed_at   TIMESTAMP WITH TIME ZONE,
+  last_used_step BIGINT
+);
+GRANT ALL ON account_totp TO "p2k16-web";
+
+CREATE TABLE account_recovery_code (
+  id         BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_by BIGINT                   NOT NULL REFERENCES account,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_by BIGINT                   NOT NULL REFERENCES account,
+
+  account    BIGINT                   NOT NULL REFERENCES account,
+  code_hash  VARCHAR(64)              NOT NULL,
+  used_at    TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX account_recovery_code_account_idx ON account_recovery_code (account);
+GRANT ALL ON account_recovery_code TO "p2k16-web";
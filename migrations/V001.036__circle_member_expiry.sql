@@ -0,0 +1,17 @@
+/*
+Optional expiry for circle memberships, for temporary access like trials or contractors. Expired rows
+no longer count as membership and are removed by a background job in the web app.
+*/
+ALTER TABLE circle_member
+  DROP COLUMN IF EXISTS expires_at;
+
+ALTER TABLE circle_member_version
+  DROP COLUMN IF EXISTS expires_at;
+
+ALTER TABLE circle_member
+  ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE circle_member_version
+  ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX circle_member_expires_at ON circle_member (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,28 @@
+/*
+Requests from members to join a circle. The circle's administrators approve or reject them, approving
+adds the circle_member row with the motivation as its comment. Only one pending request per member
+and circle.
+*/
+DROP TABLE IF EXISTS circle_membership_request;
+
+CREATE TABLE circle_membership_request (
+  id         BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_by BIGINT                   NOT NULL REFERENCES account,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_by BIGINT                   NOT NULL REFERENCES account,
+
+  circle     BIGINT                   NOT NULL REFERENCES circle,
+  account    BIGINT                   NOT NULL REFERENCES account,
+  motivation TEXT                     NOT NULL,
+  status     VARCHAR(20)              NOT NULL DEFAULT 'PENDING',
+  decided_by BIGINT REFERENCES account,
+  decided_at TIMESTAMP WITH TIME ZONE,
+
+  CONSTRAINT circle_membership_request_status CHECK (status IN ('PENDING', 'APPROVED', 'REJECTED'))
+);
+GRANT ALL ON circle_membership_request TO "p2k16-web";
+
+CREATE UNIQUE INDEX circle_membership_request_pending
+  ON circle_membership_request (circle, account) WHERE status = 'PENDING';
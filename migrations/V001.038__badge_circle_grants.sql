@@ -0,0 +1,35 @@
+/*
+Circles granted by a badge. Awarding the badge adds the receiver to these circles, and removing the
+badge takes the membership away again. circle_member.account_badge records which awarded badge a
+membership came from, memberships added by hand have none.
+*/
+DROP TABLE IF EXISTS badge_description_circle;
+
+CREATE TABLE badge_description_circle (
+  id                BIGINT                   NOT NULL PRIMARY KEY DEFAULT nextval('id_seq'),
+
+  created_at        TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_by        BIGINT                   NOT NULL REFERENCES account,
+  updated_at        TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_by        BIGINT                   NOT NULL REFERENCES account,
+
+  badge_description BIGINT                   NOT NULL REFERENCES badge_description,
+  circle            BIGINT                   NOT NULL REFERENCES circle,
+
+  CONSTRAINT badge_description_circle_uq UNIQUE (badge_description, circle)
+);
+GRANT ALL ON badge_description_circle TO "p2k16-web";
+
+ALTER TABLE circle_member
+  DROP COLUMN IF EXISTS account_badge;
+
+ALTER TABLE circle_member_version
+  DROP COLUMN IF EXISTS account_badge;
+
+ALTER TABLE circle_member
+  ADD COLUMN account_badge BIGINT REFERENCES account_badge;
+
+ALTER TABLE circle_member_version
+  ADD COLUMN account_badge BIGINT;
+
+CREATE INDEX circle_member_account_badge ON circle_member (account_badge) WHERE account_badge IS NOT NULL;
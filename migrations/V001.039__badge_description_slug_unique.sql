@@ -0,0 +1,11 @@
+/*
+Slugs name the public /badges/<slug> pages, so they have to be unique. Empty slugs stored by the
+legacy app are cleared first.
+*/
+UPDATE badge_description
+SET slug = NULL
+WHERE slug = '';
+
+DROP INDEX IF EXISTS badge_description_slug;
+
+CREATE UNIQUE INDEX badge_description_slug ON badge_description (slug) WHERE slug IS NOT NULL;
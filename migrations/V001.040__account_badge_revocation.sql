@@ -0,0 +1,29 @@
+/*
+Badges are revoked instead of deleted, so withdrawn or mistaken certifications stay in the member's
+badge history with who revoked them, when and why. Revoked badges don't count as held.
+*/
+ALTER TABLE account_badge
+  DROP COLUMN IF EXISTS revoked_at,
+  DROP COLUMN IF EXISTS revoked_by,
+  DROP COLUMN IF EXISTS revoked_reason;
+
+ALTER TABLE account_badge_version
+  DROP COLUMN IF EXISTS revoked_at,
+  DROP COLUMN IF EXISTS revoked_by,
+  DROP COLUMN IF EXISTS revoked_reason;
+
+ALTER TABLE account_badge
+  ADD COLUMN revoked_at     TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN revoked_by     BIGINT REFERENCES account,
+  ADD COLUMN revoked_reason TEXT;
+
+ALTER TABLE account_badge_version
+  ADD COLUMN revoked_at     TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN revoked_by     BIGINT,
+  ADD COLUMN revoked_reason TEXT;
+
+ALTER TABLE account_badge
+  DROP CONSTRAINT IF EXISTS account_badge_revoked;
+
+ALTER TABLE account_badge
+  ADD CONSTRAINT account_badge_revoked CHECK ((revoked_at IS NULL) = (revoked_by IS NULL));
@@ -0,0 +1,35 @@
+/*
+Badges for certifications that have to be renewed, like first aid or forklift training. Awarding a
+badge with a validity sets when it expires, expired badges are kept but don't grant anything.
+Circle memberships granted by the badge expire with it. reminder_sent_at records that the member
+has been told the badge is about to expire, renewing the badge clears it.
+*/
+ALTER TABLE badge_description
+  DROP COLUMN IF EXISTS validity_days;
+
+ALTER TABLE badge_description_version
+  DROP COLUMN IF EXISTS validity_days;
+
+ALTER TABLE badge_description
+  ADD COLUMN validity_days INTEGER CHECK (validity_days > 0);
+
+ALTER TABLE badge_description_version
+  ADD COLUMN validity_days INTEGER;
+
+ALTER TABLE account_badge
+  DROP COLUMN IF EXISTS expires_at,
+  DROP COLUMN IF EXISTS reminder_sent_at;
+
+ALTER TABLE account_badge_version
+  DROP COLUMN IF EXISTS expires_at,
+  DROP COLUMN IF EXISTS reminder_sent_at;
+
+ALTER TABLE account_badge
+  ADD COLUMN expires_at       TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN reminder_sent_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE account_badge_version
+  ADD COLUMN expires_at       TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN reminder_sent_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX account_badge_expires_at ON account_badge (expires_at) WHERE expires_at IS NOT NULL AND revoked_at IS NULL;
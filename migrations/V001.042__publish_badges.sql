@@ -0,0 +1,15 @@
+/*
+Members can choose to publish their badges as Open Badges assertions, so they can be shown on
+other sites. Nothing is published unless the member turns it on.
+*/
+ALTER TABLE account
+  DROP COLUMN IF EXISTS publish_badges;
+
+ALTER TABLE account_version
+  DROP COLUMN IF EXISTS publish_badges;
+
+ALTER TABLE account
+  ADD COLUMN publish_badges BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE account_version
+  ADD COLUMN publish_badges BOOLEAN;
@@ -0,0 +1,11 @@
+/*
+A tool can only be checked out by one member at a time. Checking in deletes the checkout, so there
+is at most one row per tool. The legacy app only enforced this in code, older duplicates are
+removed before the index is created.
+*/
+DELETE FROM tool_checkout tc
+WHERE EXISTS (SELECT 1 FROM tool_checkout newer WHERE newer.tool_description = tc.tool_description AND newer.id > tc.id);
+
+DROP INDEX IF EXISTS tool_checkout_tool_description_uq;
+
+CREATE UNIQUE INDEX tool_checkout_tool_description_uq ON tool_checkout (tool_description);